@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID int
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.UserID = app.readInt(qs, "user_id", 0, v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.APIKeyFilterSafelist
+
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = data.APIKeySortSafelist
+
+	v.Check(input.UserID >= 0, "user_id", validator.Positive)
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	keys, metadata, err := app.models.APIKeys.GetAll(int64(input.UserID), input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkAPIKeyGrant checks that the user holds every permission given to key,
+// in every warehouse and perusahaan the key can reach, so that nobody can
+// make a key that does more than they can.
+func (app *application) checkAPIKeyGrant(v *validator.Validator, userID int64, key *data.APIKey) error {
+	held, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	keyScope, err := app.models.APIKeys.Scope(key)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range key.Permissions {
+		if !held.Include(code) {
+			v.AddError("permissions", validator.PermissionNotHeld, code)
+			continue
+		}
+
+		scope, err := app.models.Permissions.ScopeForUser(userID, code)
+		if err != nil {
+			return err
+		}
+
+		if !scope.Covers(keyScope) {
+			switch {
+			case keyScope.Unlimited():
+				// The user only holds code in some warehouses, so the key
+				// must be limited to one of them.
+				v.AddError("warehouse_id", validator.Required)
+			case key.PerusahaanID != nil:
+				v.AddError("perusahaan_id", validator.OutOfScope)
+			default:
+				v.AddError("warehouse_id", validator.OutOfScope)
+			}
+		}
+	}
+
+	return nil
+}
+
+// saveAPIKey checks key and, if it is valid, saves it with save. It writes
+// the response for a key that fails validation, grants more than the current
+// user or the key's owner holds, or names a warehouse or perusahaan that does
+// not exist, and reports whether the key was saved.
+func (app *application) saveAPIKey(w http.ResponseWriter, r *http.Request, key *data.APIKey, save func(*data.APIKey) error) bool {
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	users := []int64{app.contextGetUser(r).ID}
+
+	if key.UserID != users[0] {
+		users = append(users, key.UserID)
+	}
+
+	for _, userID := range users {
+		err = app.checkAPIKeyGrant(v, userID, key)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	err = save(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// createAPIKeyHandler creates a key acting as the current user. The key itself
+// is only ever shown in this response.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		Permissions  []string `json:"permissions"`
+		AllowedIPs   []string `json:"allowed_ips"`
+		WarehouseID  *int64   `json:"warehouse_id"`
+		PerusahaanID *int64   `json:"perusahaan_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		Name:         input.Name,
+		UserID:       app.contextGetUser(r).ID,
+		Permissions:  input.Permissions,
+		AllowedIPs:   input.AllowedIPs,
+		WarehouseID:  input.WarehouseID,
+		PerusahaanID: input.PerusahaanID,
+	}
+
+	if key.Permissions == nil {
+		key.Permissions = data.Permissions{}
+	}
+
+	if key.AllowedIPs == nil {
+		key.AllowedIPs = []string{}
+	}
+
+	if !app.saveAPIKey(w, r, key, app.models.APIKeys.Insert) {
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/api-keys/%d", key.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key, "key": key.Plaintext}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getAPIKey returns the key named by the :id parameter, writing the response
+// if there is no such key.
+func (app *application) getAPIKey(w http.ResponseWriter, r *http.Request) (*data.APIKey, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	key, err := app.models.APIKeys.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return key, true
+}
+
+func (app *application) showAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := app.getAPIKey(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeRecord(w, r, http.StatusOK, key.Version, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := app.getAPIKey(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.ifMatch(w, r, key.Version) {
+		return
+	}
+
+	var input struct {
+		Name         *string  `json:"name"`
+		Permissions  []string `json:"permissions"`
+		AllowedIPs   []string `json:"allowed_ips"`
+		WarehouseID  *int64   `json:"warehouse_id"`
+		PerusahaanID *int64   `json:"perusahaan_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		key.Name = *input.Name
+	}
+
+	if input.Permissions != nil {
+		key.Permissions = input.Permissions
+	}
+
+	if input.AllowedIPs != nil {
+		key.AllowedIPs = input.AllowedIPs
+	}
+
+	// Giving either a warehouse or a perusahaan replaces the key's limit.
+	if input.WarehouseID != nil || input.PerusahaanID != nil {
+		key.WarehouseID = input.WarehouseID
+		key.PerusahaanID = input.PerusahaanID
+	}
+
+	if !app.saveAPIKey(w, r, key, app.models.APIKeys.Update) {
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, key.Version, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// rotateAPIKeyHandler gives a key a new secret. The old one keeps working for
+// grace_period seconds, a day by default, while clients are moved over.
+func (app *application) rotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := app.getAPIKey(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.ifMatch(w, r, key.Version) {
+		return
+	}
+
+	var input struct {
+		GracePeriod *int `json:"grace_period"`
+	}
+
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	grace := 24 * 60 * 60
+
+	if input.GracePeriod != nil {
+		grace = *input.GracePeriod
+	}
+
+	v := validator.New()
+
+	v.Check(grace >= 0, "grace_period", validator.GreaterThan, -1)
+	v.Check(grace <= 7*24*60*60, "grace_period", validator.MaxValue, 7*24*60*60)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.APIKeys.Rotate(key, time.Duration(grace)*time.Second)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, key.Version, envelope{"api_key": key, "key": key.Plaintext}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := app.getAPIKey(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.ifMatch(w, r, key.Version) {
+		return
+	}
+
+	err := app.models.APIKeys.Revoke(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
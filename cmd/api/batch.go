@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+var errBatchFailed = errors.New("batch operation failed")
+
+type batchOperation struct {
+	Ref      string          `json:"ref"`
+	Method   string          `json:"method"`
+	Resource string          `json:"resource"`
+	ID       json.RawMessage `json:"id"`
+	Version  *int32          `json:"version"`
+	Body     json.RawMessage `json:"body"`
+}
+
+type batchResult struct {
+	Index   int         `json:"index"`
+	Ref     string      `json:"ref,omitempty"`
+	Status  int         `json:"status"`
+	ID      interface{} `json:"id,omitempty"`
+	Version int32       `json:"version,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   interface{} `json:"error,omitempty"`
+}
+
+// batchResource applies one batch operation to a resource using models,
+// which may be bound to the batch transaction. It returns the record's ID,
+// its version and the record itself.
+type batchResource func(models data.Models, op batchOperation, id string, actor data.Actor) (interface{}, int32, interface{}, error)
+
+// batchValidationError carries validator errors out of a batchResource.
+type batchValidationError map[string]validator.Error
+
+func (e batchValidationError) Error() string {
+	return "failed validation"
+}
+
+var batchResources = map[string]batchResource{
+	"rak":        batchRak,
+	"brand":      batchBrand,
+	"brandasset": batchBrandAsset,
+	"stok":       batchStok,
+}
+
+func (app *application) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Transactional bool             `json:"transactional"`
+		Operations    []batchOperation `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Operations) > 0, "operations", validator.NotEmpty)
+	v.Check(len(input.Operations) <= 500, "operations", validator.MaxItems, 500)
+
+	refs := []string{}
+
+	for i, op := range input.Operations {
+		key := fmt.Sprintf("operations[%d]", i)
+
+		_, ok := batchResources[op.Resource]
+		v.Check(ok, key+".resource", validator.OneOf, "rak, brand, brandasset, stok")
+		v.Check(validator.In(op.Method, "create", "update", "delete"), key+".method", validator.OneOf, "create, update, delete")
+
+		if op.Method != "create" {
+			v.Check(len(op.ID) > 0, key+".id", validator.Required)
+			v.Check(op.Version != nil, key+".version", validator.Required)
+		}
+
+		if op.Ref != "" {
+			refs = append(refs, op.Ref)
+		}
+	}
+
+	v.Check(validator.Unique(refs), "operations", validator.Duplicate)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The batch is refused outright unless the user may write every resource
+	// it touches. Each resource is then limited to the warehouses the user may
+	// write it in.
+	permissions, err := app.permissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	scopes := map[string]*data.Scope{}
+
+	for _, op := range input.Operations {
+		if !permissions.Include(op.Resource + ":write") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		if _, ok := scopes[op.Resource]; !ok {
+			scopes[op.Resource], err = app.permissionScope(r, op.Resource+":write")
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	actor := app.actor(r)
+	results := make([]batchResult, 0, len(input.Operations))
+
+	run := func(models data.Models) error {
+		created := map[string]interface{}{}
+
+		for i, op := range input.Operations {
+			result := app.runBatchOperation(r, models.Scoped(scopes[op.Resource]), op, created, actor)
+			result.Index = i
+			result.Ref = op.Ref
+
+			results = append(results, result)
+
+			if result.Status >= 400 && input.Transactional {
+				return errBatchFailed
+			}
+		}
+
+		return nil
+	}
+
+	if input.Transactional {
+		err = app.models.Tx(run)
+	} else {
+		err = run(app.models)
+	}
+
+	if err != nil && !errors.Is(err, errBatchFailed) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for i := len(results); i < len(input.Operations); i++ {
+		results = append(results, batchResult{
+			Index:  i,
+			Ref:    input.Operations[i].Ref,
+			Status: http.StatusFailedDependency,
+			Error:  "not run because an earlier operation failed",
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"committed": err == nil, "results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) runBatchOperation(r *http.Request, models data.Models, op batchOperation, created map[string]interface{}, actor data.Actor) batchResult {
+	var err error
+
+	op.ID, err = resolveBatchRefs(op.ID, created)
+	if err == nil {
+		op.Body, err = resolveBatchRefs(op.Body, created)
+	}
+	if err != nil {
+		return batchResult{Status: http.StatusFailedDependency, Error: err.Error()}
+	}
+
+	var id string
+
+	if op.Method != "create" {
+		id, err = batchID(op.ID)
+		if err != nil {
+			return batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+		}
+	}
+
+	recordID, version, record, err := batchResources[op.Resource](models, op, id, actor)
+
+	var validationErr batchValidationError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case err == nil:
+	case errors.As(err, &validationErr):
+		return batchResult{Status: http.StatusUnprocessableEntity, Error: app.validationErrors(r, validationErr)}
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+	case errors.Is(err, data.ErrRecordNotFound):
+		return batchResult{Status: http.StatusNotFound, Error: app.message(r, "not_found")}
+	case errors.Is(err, data.ErrEditConflict):
+		return batchResult{Status: http.StatusPreconditionFailed, Error: app.message(r, "precondition_failed")}
+	case errors.Is(err, data.ErrOutOfScope):
+		return batchResult{Status: http.StatusUnprocessableEntity, Error: app.validationErrors(r, map[string]validator.Error{"warehouse_id": {Code: validator.OutOfScope}})}
+	default:
+		app.logError(r, err)
+		return batchResult{Status: http.StatusInternalServerError, Error: app.message(r, "operation_failed")}
+	}
+
+	status := http.StatusOK
+
+	if op.Method == "create" {
+		status = http.StatusCreated
+
+		if op.Ref != "" {
+			created[op.Ref] = recordID
+		}
+	}
+
+	return batchResult{Status: status, ID: recordID, Version: version, Data: record}
+}
+
+// resolveBatchRefs replaces every {"$ref": "name"} object in raw with the ID
+// created by the earlier operation with that ref.
+func resolveBatchRefs(raw json.RawMessage, created map[string]interface{}) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var value interface{}
+
+	err := dec.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolve func(value interface{}) (interface{}, error)
+
+	resolve = func(value interface{}) (interface{}, error) {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if ref, ok := value["$ref"].(string); ok && len(value) == 1 {
+				id, ok := created[ref]
+				if !ok {
+					return nil, fmt.Errorf("reference %q does not name an earlier successful create", ref)
+				}
+				return id, nil
+			}
+
+			for key, item := range value {
+				resolved, err := resolve(item)
+				if err != nil {
+					return nil, err
+				}
+				value[key] = resolved
+			}
+		case []interface{}:
+			for i, item := range value {
+				resolved, err := resolve(item)
+				if err != nil {
+					return nil, err
+				}
+				value[i] = resolved
+			}
+		}
+
+		return value, nil
+	}
+
+	value, err = resolve(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
+
+func batchID(raw json.RawMessage) (string, error) {
+	var id interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	err := dec.Decode(&id)
+	if err != nil {
+		return "", err
+	}
+
+	switch id := id.(type) {
+	case json.Number:
+		return id.String(), nil
+	case string:
+		return id, nil
+	}
+
+	return "", errors.New("id must be a number or a string")
+}
+
+// batchIntID parses the ID of a resource with integer keys. An ID that is
+// not a number cannot exist.
+func batchIntID(id string) (int64, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 1 {
+		return 0, data.ErrRecordNotFound
+	}
+
+	return n, nil
+}
+
+// batchBody decodes an operation body onto dst. For updates dst already
+// holds the stored record, so only the fields present in the body change.
+func batchBody(body json.RawMessage, dst interface{}) error {
+	if len(body) == 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(dst)
+}
+
+func batchRak(models data.Models, op batchOperation, id string, actor data.Actor) (interface{}, int32, interface{}, error) {
+	if op.Method == "create" {
+		rak := data.RakMultiInsert{}
+
+		err := batchBody(op.Body, &rak)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		raks := []data.RakMultiInsert{rak}
+
+		err = models.Rak.Insert(&raks, actor)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		id = strconv.FormatInt(raks[0].Rak_id, 10)
+	}
+
+	rakID, err := batchIntID(id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	usaha, err := models.Rak.Get(rakID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if op.Method != "create" && *usaha.Version != *op.Version {
+		return nil, 0, nil, data.ErrEditConflict
+	}
+
+	switch op.Method {
+	case "update":
+		err = batchBody(op.Body, usaha)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		v := validator.New()
+
+		if data.ValidateRak(v, usaha); !v.Valid() {
+			return nil, 0, nil, batchValidationError(v.Errors)
+		}
+
+		usaha.Rak_id = &rakID
+		usaha.Version = op.Version
+
+		err = models.Rak.Update(usaha, actor)
+	case "delete":
+		err = models.Rak.Delete(rakID, *usaha.Version, actor)
+		usaha = nil
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if usaha == nil {
+		return rakID, 0, nil, nil
+	}
+
+	return rakID, *usaha.Version, usaha, nil
+}
+
+func batchBrand(models data.Models, op batchOperation, id string, actor data.Actor) (interface{}, int32, interface{}, error) {
+	if op.Method == "create" {
+		usaha := &data.Brand{}
+
+		err := batchBody(op.Body, usaha)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		v := validator.New()
+
+		if data.ValidateBrand(v, usaha); !v.Valid() {
+			return nil, 0, nil, batchValidationError(v.Errors)
+		}
+
+		err = models.Brand.Insert(usaha, actor)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		return usaha.ID, usaha.Version, usaha, nil
+	}
+
+	brandID, err := batchIntID(id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	usaha, err := models.Brand.Get(brandID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if usaha.Version != *op.Version {
+		return nil, 0, nil, data.ErrEditConflict
+	}
+
+	if op.Method == "delete" {
+		return brandID, 0, nil, models.Brand.Delete(brandID, usaha.Version, actor)
+	}
+
+	err = batchBody(op.Body, usaha)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	v := validator.New()
+
+	if data.ValidateBrand(v, usaha); !v.Valid() {
+		return nil, 0, nil, batchValidationError(v.Errors)
+	}
+
+	usaha.ID = brandID
+	usaha.Version = *op.Version
+
+	err = models.Brand.Update(usaha, actor)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return brandID, usaha.Version, usaha, nil
+}
+
+func batchBrandAsset(models data.Models, op batchOperation, id string, actor data.Actor) (interface{}, int32, interface{}, error) {
+	if op.Method == "create" {
+		usaha := &data.BrandAsset{}
+
+		err := batchBody(op.Body, usaha)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		v := validator.New()
+
+		if data.ValidateBrandAsset(v, usaha); !v.Valid() {
+			return nil, 0, nil, batchValidationError(v.Errors)
+		}
+
+		err = models.BrandAssetModel.Insert(usaha, actor)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		return usaha.ID, usaha.Version, usaha, nil
+	}
+
+	assetID, err := batchIntID(id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	usaha, err := models.BrandAssetModel.Get(assetID)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if usaha.Version != *op.Version {
+		return nil, 0, nil, data.ErrEditConflict
+	}
+
+	if op.Method == "delete" {
+		return assetID, 0, nil, models.BrandAssetModel.Delete(assetID, usaha.Version, actor)
+	}
+
+	err = batchBody(op.Body, usaha)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	v := validator.New()
+
+	if data.ValidateBrandAsset(v, usaha); !v.Valid() {
+		return nil, 0, nil, batchValidationError(v.Errors)
+	}
+
+	usaha.ID = assetID
+	usaha.Version = *op.Version
+
+	err = models.BrandAssetModel.Update(usaha, actor)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return assetID, usaha.Version, usaha, nil
+}
+
+func batchStok(models data.Models, op batchOperation, id string, actor data.Actor) (interface{}, int32, interface{}, error) {
+	if op.Method == "create" {
+		usaha := &data.Stok{}
+
+		err := batchBody(op.Body, usaha)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		v := validator.New()
+
+		if data.ValidateStok(v, *usaha); !v.Valid() {
+			return nil, 0, nil, batchValidationError(v.Errors)
+		}
+
+		err = models.Stok.Insert(usaha, actor)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		id = *usaha.ID
+	}
+
+	usaha, err := models.Stok.Get(id)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if op.Method == "create" {
+		return id, *usaha.Version, usaha, nil
+	}
+
+	if *usaha.Version != *op.Version {
+		return nil, 0, nil, data.ErrEditConflict
+	}
+
+	if op.Method == "delete" {
+		return id, 0, nil, models.Stok.Delete(id, *usaha.Version, actor)
+	}
+
+	// Details in the body replace the stored ones rather than being merged
+	// into them.
+	var details struct {
+		JsonStokDetail json.RawMessage `json:"jsonstokdetail"`
+	}
+
+	err = json.Unmarshal(op.Body, &details)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if details.JsonStokDetail != nil {
+		usaha.JsonStokDetail = nil
+	}
+
+	err = batchBody(op.Body, usaha)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	v := validator.New()
+
+	if data.ValidateStok(v, *usaha); !v.Valid() {
+		return nil, 0, nil, batchValidationError(v.Errors)
+	}
+
+	usaha.ID = &id
+	usaha.Version = op.Version
+
+	err = models.Stok.Update(usaha, actor)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return id, *usaha.Version, usaha, nil
+}
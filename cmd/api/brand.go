@@ -34,7 +34,7 @@ func (app *application) createBrandHandler(w http.ResponseWriter, r *http.Reques
 		Version: input.Version,
 	}
 
-	err = app.models.Brand.Insert(usaha)
+	err = app.models.Brand.Insert(usaha, app.actor(r))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -56,6 +56,15 @@ func (app *application) showBrandHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	v := validator.New()
+
+	projection := app.readProjection(r.URL.Query(), data.BrandFieldSafelist, data.BrandRelations)
+
+	if data.ValidateProjection(v, projection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	usaha, err := app.models.Brand.Get(id)
 	if err != nil {
 		switch {
@@ -67,7 +76,13 @@ func (app *application) showBrandHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	projected, err := app.project(usaha, projection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": projected}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -91,6 +106,10 @@ func (app *application) updateBrandHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
 	var input struct {
 		ID        *int64     `json:"id"`
 		CreatedAt *time.Time `json:"-"`
@@ -118,18 +137,18 @@ func (app *application) updateBrandHandler(w http.ResponseWriter, r *http.Reques
 		usaha.Ket = *input.Ket
 	}
 
-	err = app.models.Brand.Update(usaha)
+	err = app.models.Brand.Update(usaha, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": usaha}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -142,11 +161,28 @@ func (app *application) deleteBrandHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Brand.Delete(id)
+	usaha, err := app.models.Brand.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
+	err = app.models.Brand.Delete(id, usaha.Version, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -175,9 +211,14 @@ func (app *application) listBrandHandler(w http.ResponseWriter, r *http.Request)
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.BrandFilterSafelist
+	input.Filters.Projection = app.readProjection(qs, data.BrandFieldSafelist, data.BrandRelations)
 
-	input.Filters.Sort = app.readString(qs, "sort", "rn")
-	input.Filters.SortSafelist = []string{"rn", "name", "-rn", "-name"}
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = data.BrandSortSafelist
 
 	// input.Filters.Sort = app.readString(qs, "sort", "rn")
 	// input.Filters.SortSafelist = []string{"id", "name","-id", "-name"}
@@ -190,11 +231,22 @@ func (app *application) listBrandHandler(w http.ResponseWriter, r *http.Request)
 	usahas, metadata, err := app.models.Brand.GetAll(input.Name, input.Ket, input.Filters)
 	if err != nil {
 		fmt.Println("sampai-err")
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	projected, err := app.project(usahas, input.Filters.Projection)
+	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": usahas, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": projected, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -33,7 +33,7 @@ func (app *application) createBrandAssetHandler(w http.ResponseWriter, r *http.R
 		BrandID: input.BrandID,
 	}
 
-	err = app.models.BrandAssetModel.Insert(usaha)
+	err = app.models.BrandAssetModel.Insert(usaha, app.actor(r))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -55,7 +55,16 @@ func (app *application) showBrandAsssetHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	usaha, err := app.models.BrandAssetModel.Get(id)
+	v := validator.New()
+
+	projection := app.readProjection(r.URL.Query(), data.BrandAssetFieldSafelist, data.BrandAssetRelations)
+
+	if data.ValidateProjection(v, projection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	usaha, err := app.models.BrandAssetModel.GetWith(id, projection)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -66,7 +75,13 @@ func (app *application) showBrandAsssetHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	projected, err := app.project(usaha, projection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": projected}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -90,6 +105,10 @@ func (app *application) updateBrandAssetHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
 	var input struct {
 		ID        *int64    `json:"id"`
 		CreatedAt time.Time `json:"-"`
@@ -122,18 +141,18 @@ func (app *application) updateBrandAssetHandler(w http.ResponseWriter, r *http.R
 		usaha.BrandID = *input.BrandID
 	}
 
-	err = app.models.BrandAssetModel.Update(usaha)
+	err = app.models.BrandAssetModel.Update(usaha, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": usaha}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -146,7 +165,7 @@ func (app *application) deleteBrandAssetHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.BrandAssetModel.Delete(id)
+	usaha, err := app.models.BrandAssetModel.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -157,6 +176,23 @@ func (app *application) deleteBrandAssetHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
+	err = app.models.BrandAssetModel.Delete(id, usaha.Version, app.actor(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "Brand successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -181,9 +217,14 @@ func (app *application) listBrandAssetHandler(w http.ResponseWriter, r *http.Req
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.BrandAssetFilterSafelist
+	input.Filters.Projection = app.readProjection(qs, data.BrandAssetFieldSafelist, data.BrandAssetRelations)
 
-	input.Filters.Sort = app.readString(qs, "sort", "rn")
-	input.Filters.SortSafelist = []string{"rn", "name", "-rn", "-name"}
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = data.BrandAssetSortSafelist
 
 	// input.Filters.Sort = app.readString(qs, "sort", "rn")
 	// input.Filters.SortSafelist = []string{"id", "name","-id", "-name"}
@@ -196,11 +237,22 @@ func (app *application) listBrandAssetHandler(w http.ResponseWriter, r *http.Req
 	usahas, metadata, err := app.models.BrandAssetModel.GetAll(input.Name, input.BrandName, input.Ket, input.Filters)
 	if err != nil {
 		fmt.Println("sampai-err")
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	projected, err := app.project(usahas, input.Filters.Projection)
+	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": usahas, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": projected, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -5,11 +5,19 @@ import (
 	"net/http"
 
 	"greenlight.alexedwards.net/internal/data"
+
+	"github.com/tomasen/realip"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey      = contextKey("user")
+	requestIDContextKey = contextKey("request_id")
+	scopeContextKey     = contextKey("scope")
+	apiKeyContextKey    = contextKey("api_key")
+	sessionContextKey   = contextKey("session")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -24,3 +32,116 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// actor identifies the authenticated user behind a request for the audit log.
+func (app *application) actor(r *http.Request) data.Actor {
+	return data.Actor{
+		UserID:    app.contextGetUser(r).ID,
+		RequestID: app.contextGetRequestID(r),
+		IP:        realip.FromRequest(r),
+	}
+}
+
+func (app *application) contextSetScope(r *http.Request, scope *data.Scope) *http.Request {
+	ctx := context.WithValue(r.Context(), scopeContextKey, scope)
+	return r.WithContext(ctx)
+}
+
+// contextGetScope returns the scope requirePermission worked out for the
+// request. If it did not run the scope is empty, so that a handler wired up
+// without it reaches no warehouse rather than every one.
+func (app *application) contextGetScope(r *http.Request) *data.Scope {
+	scope, ok := r.Context().Value(scopeContextKey).(*data.Scope)
+	if !ok || scope == nil {
+		return &data.Scope{}
+	}
+
+	return scope
+}
+
+// scoped returns the models limited to the warehouses in which the request's
+// user holds the permission the route requires.
+func (app *application) scoped(r *http.Request) data.Models {
+	return app.models.Scoped(app.contextGetScope(r))
+}
+
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key the request was authenticated with, or
+// nil if it was not made with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// permissions returns the permissions the request is made with: those of its
+// user, limited to those of its API key if it has one.
+func (app *application) permissions(r *http.Request) (data.Permissions, error) {
+	held, err := app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := app.contextGetAPIKey(r)
+	if key == nil {
+		return held, nil
+	}
+
+	// A key never does more than its owner can now, even if the owner has
+	// lost permissions since it was made.
+	permissions := data.Permissions{}
+
+	for _, code := range key.Permissions {
+		if held.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions, nil
+}
+
+// permissionScope returns the warehouses in which the request holds the
+// permission code, which for an API key are also limited to the warehouses
+// the key is.
+func (app *application) permissionScope(r *http.Request, code string) (*data.Scope, error) {
+	scope, err := app.models.Permissions.ScopeForUser(app.contextGetUser(r).ID, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if key := app.contextGetAPIKey(r); key != nil {
+		keyScope, err := app.models.APIKeys.Scope(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return keyScope.Intersect(scope), nil
+	}
+
+	return scope, nil
+}
+
+func (app *application) contextSetSession(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetSession returns the ID of the session the request's access token
+// belongs to, or 0 if it was not made with an access token.
+func (app *application) contextGetSession(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionContextKey).(int64)
+	return id
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+func TestContextGetScope(t *testing.T) {
+	app := newTestApplication(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/warehouses", nil)
+
+	if scope := app.contextGetScope(r); scope.Unlimited() {
+		t.Errorf("no scope set: got %+v, want an empty scope", scope)
+	}
+
+	if scope := app.contextGetScope(app.contextSetScope(r, data.AllWarehouses())); !scope.Unlimited() {
+		t.Errorf("all warehouses set: got %+v", scope)
+	}
+
+	limited := &data.Scope{Warehouses: []int64{1}}
+
+	if scope := app.contextGetScope(app.contextSetScope(r, limited)); scope != limited {
+		t.Errorf("limited scope set: got %+v", scope)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/mailer"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// newTransport returns the mail transport named by the -mail-transport flag.
+func newTransport(cfg config) (mailer.Transport, error) {
+	switch cfg.mail.transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return &mailer.FileTransport{Dir: cfg.mail.dir}, nil
+	case "memory":
+		return &mailer.MemoryTransport{}, nil
+	default:
+		return nil, errors.New("mail transport must be smtp, file or memory")
+	}
+}
+
+// queueEmail renders templateFile in lang for recipient and adds the message
+// to the email outbox, with a send_email job to deliver it. A mail server that
+// is down only delays the message.
+func (app *application) queueEmail(lang, recipient, templateFile string, templateData interface{}) error {
+	msg, err := app.mailer.Render(lang, recipient, templateFile, templateData)
+	if err != nil {
+		return err
+	}
+
+	email := &data.Email{
+		Recipient: recipient,
+		Template:  templateFile,
+		Subject:   msg.Subject,
+		PlainBody: msg.PlainBody,
+		HTMLBody:  msg.HTMLBody,
+	}
+
+	return app.models.Emails.Insert(email, app.config.mail.maxAttempts)
+}
+
+// sendEmailJob sends one email from the outbox and records the attempt on it.
+// A failed send is returned so that the job queue retries it; an email that
+// is gone or was already sent is skipped.
+func (app *application) sendEmailJob(ctx context.Context, payload json.RawMessage) error {
+	var input data.EmailJob
+
+	err := json.Unmarshal(payload, &input)
+	if err != nil {
+		return err
+	}
+
+	email, err := app.models.Emails.Get(input.EmailID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if email.Status != data.EmailPending {
+		return nil
+	}
+
+	sendErr := app.mailer.Send(&mailer.Message{
+		To:        email.Recipient,
+		Subject:   email.Subject,
+		PlainBody: email.PlainBody,
+		HTMLBody:  email.HTMLBody,
+	})
+
+	status := data.EmailSent
+	next := time.Now()
+	reason := ""
+
+	if sendErr != nil {
+		status = data.EmailPending
+		next = next.Add(retryBackoff(app.config.jobs.backoff, email.Attempts+1))
+		reason = sendErr.Error()
+
+		if email.Attempts+1 >= app.config.mail.maxAttempts {
+			status = data.EmailFailed
+		}
+	}
+
+	err = app.models.Emails.RecordAttempt(email.ID, status, next, reason)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"email_id": strconv.FormatInt(email.ID, 10)})
+	}
+
+	return sendErr
+}
+
+func (app *application) listEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.EmailFilterSafelist
+
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = data.EmailSortSafelist
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.EmailPending, data.EmailSent, data.EmailFailed), "status", validator.OneOf, "pending, sent, failed")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	emails, metadata, err := app.models.Emails.GetAll(input.Status, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emails": emails, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	email, err := app.models.Emails.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resendEmailHandler puts a failed email back in the outbox with a new send
+// job. Emails that are still pending or were sent cannot be resent.
+func (app *application) resendEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	email, err := app.models.Emails.Resend(id, app.config.mail.maxAttempts)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
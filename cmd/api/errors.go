@@ -1,20 +1,79 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/i18n"
+	"greenlight.alexedwards.net/internal/validator"
 )
 
+// language picks the language to answer r in: the authenticated user's
+// preference, then the Accept-Language header, then the configured default.
+func (app *application) language(r *http.Request) string {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if ok {
+		return app.userLanguage(r, user)
+	}
+
+	return app.requestLanguage(r)
+}
+
+// userLanguage picks the language to write to user in, such as for an email
+// sent while handling r.
+func (app *application) userLanguage(r *http.Request, user *data.User) string {
+	if user.Language != "" {
+		return user.Language
+	}
+
+	return app.requestLanguage(r)
+}
+
+func (app *application) requestLanguage(r *http.Request) string {
+	if lang := i18n.Negotiate(r.Header.Get("Accept-Language")); lang != "" {
+		return lang
+	}
+
+	return app.config.language
+}
+
+func (app *application) message(r *http.Request, code string, params ...interface{}) string {
+	return i18n.Message(app.language(r), code, params...)
+}
+
+// validationErrors gives every failed field its rule's code and the message
+// for it in the request's language.
+func (app *application) validationErrors(r *http.Request, errors map[string]validator.Error) map[string]interface{} {
+	lang := app.language(r)
+
+	out := make(map[string]interface{}, len(errors))
+
+	for key, e := range errors {
+		out[key] = map[string]string{
+			"code":    e.Code,
+			"message": i18n.Message(lang, e.Code, e.Params...),
+		}
+	}
+
+	return out
+}
+
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
+		"request_id":     app.contextGetRequestID(r),
 	})
 }
 
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
 
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", app.language(r))
+
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
@@ -25,17 +84,17 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
-	message := "the server encountered a problem and could not process your request"
+	message := app.message(r, "server_error")
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
-	message := "the requested resource could not be found"
+	message := app.message(r, "not_found")
 	app.errorResponse(w, r, http.StatusNotFound, message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
+	message := app.message(r, "method_not_allowed", r.Method)
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
@@ -43,43 +102,88 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]validator.Error) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, app.validationErrors(r, errors))
+}
+
+// outOfScopeResponse reports a write to a warehouse outside the ones the user
+// has been given, blaming field.
+func (app *application) outOfScopeResponse(w http.ResponseWriter, r *http.Request, field string) {
+	app.failedValidationResponse(w, r, map[string]validator.Error{field: {Code: validator.OutOfScope}})
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
-	message := "unable to update the record due to an edit conflict, please try again"
+	message := app.message(r, "edit_conflict")
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.message(r, "precondition_failed")
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.message(r, "precondition_required")
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+
+func (app *application) idempotencyKeyReusedResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.message(r, "idempotency_key_reused")
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+func (app *application) idempotencyKeyInProgressResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.message(r, "idempotency_key_in_progress")
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
-	message := "rate limit exceeded"
+	message := app.message(r, "rate_limit_exceeded")
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// tooManySignInAttemptsResponse tells the client to wait, rounded up to a
+// whole second, before signing in again.
+func (app *application) tooManySignInAttemptsResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+
+	message := app.message(r, "too_many_sign_in_attempts")
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
-	message := "invalid authentication credentials"
+	message := app.message(r, "invalid_credentials")
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
-	message := "invalid or missing authentication token"
+	message := app.message(r, "invalid_authentication_token")
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
-	message := "you must be authenticated to access this resource"
+	message := app.message(r, "authentication_required")
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account must be activated to access this resource"
+	message := app.message(r, "inactive_account")
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) noLinkedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.message(r, "no_linked_account")
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) linkedToOtherUserResponse(w http.ResponseWriter, r *http.Request) {
+	message := app.message(r, "linked_to_other_user")
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account doesn't have the necessary permissions to access this resource"
+	message := app.message(r, "not_permitted")
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
+	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/validator"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+var filterParamRX = regexp.MustCompile(`^filter\[([a-z_]+)\](?:\[([a-z]+)\])?$`)
+
 // func (app *application) readIDParam(r *http.Request) (int64, error) {
 func (app *application) readIDParam(r *http.Request) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
@@ -41,6 +48,17 @@ func (app *application) readIDParamString(r *http.Request) (string, error) {
 
 type envelope map[string]interface{}
 
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+
+	return int32(version), nil
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	js, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
@@ -193,26 +211,231 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddError(key, "must be an integer value")
+		v.AddError(key, validator.Integer)
 		return defaultValue
 	}
 
 	return i
 }
 
-func (app *application) background(fn func()) {
-	app.wg.Add(1)
+func (app *application) readConditions(qs url.Values, v *validator.Validator) []data.Condition {
+	keys := []string{}
+
+	for key := range qs {
+		if strings.HasPrefix(key, "filter[") {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	conditions := []data.Condition{}
+
+	for _, key := range keys {
+		matches := filterParamRX.FindStringSubmatch(key)
+		if matches == nil {
+			v.AddError(key, validator.InvalidFilter)
+			continue
+		}
+
+		operator := matches[2]
+		if operator == "" {
+			operator = "eq"
+		}
+
+		for _, value := range qs[key] {
+			values := []string{value}
+			if operator == "in" {
+				values = strings.Split(value, ",")
+			}
+
+			conditions = append(conditions, data.Condition{
+				Field:    matches[1],
+				Operator: operator,
+				Values:   values,
+			})
+		}
+	}
+
+	return conditions
+}
+
+func (app *application) readProjection(qs url.Values, fieldSafelist []string, relations map[string]string) data.Projection {
+	return data.Projection{
+		Fields:        app.readCSV(qs, "fields", []string{}),
+		Include:       app.readCSV(qs, "include", []string{}),
+		FieldSafelist: fieldSafelist,
+		Relations:     relations,
+	}
+}
+
+// project reduces a record, or a slice of records, to the top-level JSON keys
+// selected by the projection.
+func (app *application) project(v interface{}, p data.Projection) (interface{}, error) {
+	keys := p.Keys()
+	if keys == nil {
+		return v, nil
+	}
 
-	go func() {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
 
-		defer app.wg.Done()
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var generic interface{}
+
+	err = dec.Decode(&generic)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := func(record map[string]interface{}) {
+		for key := range record {
+			keep := false
+			for i := range keys {
+				if strings.EqualFold(key, keys[i]) {
+					keep = true
+					break
+				}
+			}
+
+			if !keep {
+				delete(record, key)
+			}
+		}
+	}
 
-		defer func() {
-			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+	switch value := generic.(type) {
+	case []interface{}:
+		for _, item := range value {
+			if record, ok := item.(map[string]interface{}); ok {
+				pick(record)
 			}
-		}()
+		}
+	case map[string]interface{}:
+		pick(value)
+	}
+
+	return generic, nil
+}
+
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, validator.Boolean)
+		return defaultValue
+	}
+
+	return b
+}
+
+// etag returns the strong entity tag of a representation of a record at
+// version. It carries the version, which If-Match is checked against, and a
+// hash of body, so that each projection of the record, and each state of the
+// relations included in it, has a tag of its own.
+func etag(version int32, body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%d-%x"`, version, sum[:8])
+}
+
+// etagVersion returns the record version a strong tag made by etag is for.
+func etagVersion(tag string) (int32, bool) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+
+	tag = tag[1 : len(tag)-1]
+
+	if i := strings.IndexByte(tag, '-'); i >= 0 {
+		tag = tag[:i]
+	}
+
+	version, err := strconv.ParseInt(tag, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return int32(version), true
+}
+
+// matchETag reports whether an If-None-Match header value matches tag. Weak
+// tags match too, as If-None-Match uses weak comparison.
+func matchETag(header string, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeRecord writes env as the response for a record at version, with its
+// ETag. A GET whose If-None-Match holds the tag gets a 304 instead.
+func (app *application) writeRecord(w http.ResponseWriter, r *http.Request, status int, version int32, env envelope, headers http.Header) error {
+	js, err := json.MarshalIndent(env, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	js = append(js, '\n')
+
+	tag := etag(version, js)
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("ETag", tag)
+
+	header := r.Header.Get("If-None-Match")
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && header != "" && matchETag(header, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+
+	return nil
+}
+
+// ifMatch checks the If-Match header against the stored record version and
+// reports whether the write may go ahead. Any tag of the version matches,
+// whichever projection it was served with, but weak tags never do. Otherwise
+// a 428 or 412 has already been sent.
+func (app *application) ifMatch(w http.ResponseWriter, r *http.Request, version int32) bool {
+	header := r.Header.Get("If-Match")
+
+	if header == "" {
+		app.preconditionRequiredResponse(w, r)
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if v, ok := etagVersion(candidate); ok && v == version {
+			return true
+		}
+	}
 
-		fn()
-	}()
+	app.preconditionFailedResponse(w, r)
+	return false
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// showMovie writes movie as showMovieHandler does for the query string qs,
+// sending ifNoneMatch if it is not empty.
+func showMovie(t *testing.T, app *application, movie *data.Movie, qs, ifNoneMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	values, err := url.ParseQuery(qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projected, err := app.project(movie, app.readProjection(values, data.MovieFieldSafelist, data.MovieRelations))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies/1?"+qs, nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	w := httptest.NewRecorder()
+
+	err = app.writeRecord(w, r, http.StatusOK, movie.Version, envelope{"movie": projected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+func TestWriteRecordProjection(t *testing.T) {
+	app := newTestApplication(t)
+	movie := &data.Movie{ID: 1, Title: "Moana", Year: 2016, Genres: []string{"animation"}, Version: 3}
+
+	first := showMovie(t, app, movie, "fields=title", "")
+	if first.Code != http.StatusOK {
+		t.Fatalf("got status %d", first.Code)
+	}
+
+	tag := first.Header().Get("ETag")
+
+	if w := showMovie(t, app, movie, "fields=title", tag); w.Code != http.StatusNotModified {
+		t.Errorf("same fields: got status %d, want 304", w.Code)
+	}
+
+	if w := showMovie(t, app, movie, "fields=title", "W/"+tag); w.Code != http.StatusNotModified {
+		t.Errorf("same fields, weak tag: got status %d, want 304", w.Code)
+	}
+
+	w := showMovie(t, app, movie, "fields=title,year", tag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("other fields: got status %d, want 200", w.Code)
+	}
+
+	if w.Header().Get("ETag") == tag {
+		t.Errorf("other fields: got the same tag %s", tag)
+	}
+
+	if w := showMovie(t, app, movie, "", tag); w.Code != http.StatusOK {
+		t.Errorf("no fields: got status %d, want 200", w.Code)
+	}
+
+	movie.Title = "Moana 2"
+
+	if w := showMovie(t, app, movie, "fields=title", tag); w.Code != http.StatusOK {
+		t.Errorf("changed record: got status %d, want 200", w.Code)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	app := newTestApplication(t)
+
+	projected := etag(3, []byte(`{"movie":{"title":"Moana"}}`))
+	full := etag(3, []byte(`{"movie":{"title":"Moana","year":2016}}`))
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"projected tag", projected, 0},
+		{"full tag", full, 0},
+		{"one of several", `"2-00", ` + projected, 0},
+		{"any", "*", 0},
+		{"missing", "", http.StatusPreconditionRequired},
+		{"older version", etag(2, []byte(`{}`)), http.StatusPreconditionFailed},
+		{"weak", "W/" + full, http.StatusPreconditionFailed},
+		{"unquoted", "3", http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Match", tt.header)
+		}
+
+		w := httptest.NewRecorder()
+
+		ok := app.ifMatch(w, r, 3)
+
+		if ok != (tt.status == 0) {
+			t.Errorf("%s: ifMatch = %t", tt.name, ok)
+		}
+
+		if tt.status != 0 && w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// jobKind describes one type of background job: the function that runs it,
+// how many may run at once in this process, how many times it is tried and
+// how long a single run may take.
+type jobKind struct {
+	run         func(ctx context.Context, payload json.RawMessage) error
+	concurrency int
+	maxAttempts int
+	timeout     time.Duration
+}
+
+// Job kinds.
+const (
+	jobRunTask = "run_task"
+)
+
+func (app *application) jobKinds() map[string]jobKind {
+	return map[string]jobKind{
+		jobRunTask:        {run: app.runTaskJob, concurrency: 1, maxAttempts: 5, timeout: 15 * time.Minute},
+		data.JobSendEmail: {run: app.sendEmailJob, concurrency: 4, maxAttempts: app.config.mail.maxAttempts, timeout: time.Minute},
+	}
+}
+
+// enqueue adds a job of kind to the queue. Unlike a goroutine, it survives a
+// restart and is retried if it fails.
+func (app *application) enqueue(kind string, payload interface{}) error {
+	k, ok := app.jobKinds()[kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	_, err := app.models.Jobs.Enqueue(kind, payload, k.maxAttempts)
+	return err
+}
+
+// startJobWorkers starts the workers for every job kind. They stop taking new
+// jobs when ctx is cancelled, and serve() waits for the jobs they are running
+// before it exits.
+func (app *application) startJobWorkers(ctx context.Context) {
+	for name, kind := range app.jobKinds() {
+		for i := 0; i < kind.concurrency; i++ {
+			app.wg.Add(1)
+
+			go func(name string, kind jobKind) {
+				defer app.wg.Done()
+				app.runJobWorker(ctx, name, kind)
+			}(name, kind)
+		}
+	}
+}
+
+func (app *application) runJobWorker(ctx context.Context, name string, kind jobKind) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		job, err := app.models.Jobs.Claim(name, kind.timeout+time.Minute)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job_kind": name})
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(app.config.jobs.interval):
+			}
+			continue
+		}
+
+		app.runJob(job, kind)
+	}
+}
+
+func (app *application) runJob(job *data.Job, kind jobKind) {
+	ctx, cancel := context.WithTimeout(context.Background(), kind.timeout)
+	defer cancel()
+
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+
+		return kind.run(ctx, job.Payload)
+	}()
+
+	properties := map[string]string{
+		"job_id":   strconv.FormatInt(job.ID, 10),
+		"job_kind": job.Kind,
+	}
+
+	if err == nil {
+		err = app.models.Jobs.Complete(job.ID)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+		return
+	}
+
+	app.logger.PrintError(err, properties)
+
+	var retryAt *time.Time
+
+	if job.Attempts < job.MaxAttempts {
+		t := time.Now().Add(retryBackoff(app.config.jobs.backoff, job.Attempts))
+		retryAt = &t
+	}
+
+	err = app.models.Jobs.Fail(job.ID, err.Error(), retryAt)
+	if err != nil {
+		app.logger.PrintError(err, properties)
+	}
+}
+
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		Kind   string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.Kind = app.readString(qs, "kind", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.JobFilterSafelist
+
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = data.JobSortSafelist
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.JobPending, data.JobRunning, data.JobDead), "status", validator.OneOf, "pending, running, dead")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	jobs, metadata, err := app.models.Jobs.GetAll(input.Status, input.Kind, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"jobs": jobs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// retryJobHandler puts a dead job back in the queue. Jobs that are still
+// pending or running cannot be retried.
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Retry(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
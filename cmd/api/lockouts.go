@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tomasen/realip"
+)
+
+// signInWait returns how long the client must wait before trying to sign in
+// as user, which may be nil for an address not yet matched to a user, because
+// of earlier failures from its IP address or against the user.
+func (app *application) signInWait(r *http.Request, user *data.User) (time.Duration, error) {
+	now := time.Now()
+
+	state, err := app.models.Lockouts.GetIP(realip.FromRequest(r))
+	if err != nil {
+		return 0, err
+	}
+
+	wait := app.config.lockout.ip.Wait(state, now)
+
+	if user != nil {
+		state, err = app.models.Lockouts.GetUser(user.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		if userWait := app.config.lockout.user.Wait(state, now); userWait > wait {
+			wait = userWait
+		}
+	}
+
+	return wait, nil
+}
+
+// recordFailedSignIn counts a failed sign in against the client's IP address
+// and user, if there is one. A user who gets locked out is told by email, in
+// case someone else is guessing their password.
+func (app *application) recordFailedSignIn(r *http.Request, user *data.User) error {
+	ip := realip.FromRequest(r)
+
+	_, locked, err := app.models.Lockouts.FailIP(ip, app.config.lockout.ip)
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		app.logger.PrintInfo("IP address locked out after failed sign ins", map[string]string{"ip": ip})
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	state, locked, err := app.models.Lockouts.FailUser(user.ID, app.config.lockout.user)
+	if err != nil || !locked {
+		return err
+	}
+
+	app.logger.PrintInfo("user locked out after failed sign ins", map[string]string{"email": user.Email})
+
+	return app.queueEmail(app.userLanguage(r, user), user.Email, "account_locked.tmpl", map[string]interface{}{
+		"failures":    state.Failures,
+		"ip":          ip,
+		"lockedUntil": state.LockedUntil.UTC().Format("2006-01-02 15:04 MST"),
+	})
+}
+
+func (app *application) listLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	users, ips, err := app.models.Lockouts.GetAll(app.config.lockout.user.Reset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "ips": ips}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	state, err := app.models.Lockouts.GetUser(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	wait := app.config.lockout.user.Wait(state, time.Now())
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"lockout": state, "retry_after": int(wait.Seconds())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unlockUserHandler forgets a user's failed sign ins, letting them sign in
+// again straight away.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Lockouts.ResetUser(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo("user unlocked", map[string]string{
+		"user_id": strconv.FormatInt(id, 10),
+		"by":      strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unlockIPHandler forgets the failed sign ins from an IP address.
+func (app *application) unlockIPHandler(w http.ResponseWriter, r *http.Request) {
+	ip := httprouter.ParamsFromContext(r.Context()).ByName("ip")
+
+	if net.ParseIP(ip) == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err := app.models.Lockouts.ResetIP(ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo("IP address unlocked", map[string]string{
+		"ip": ip,
+		"by": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "IP address successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -32,6 +37,30 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// requestID tags each request with the client's X-Request-ID, or a random
+// one, so log and audit entries can be tied back to it.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if id == "" || len(id) > 64 {
+			b := make([]byte, 16)
+
+			_, err := rand.Read(b)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
 func (app *application) rateLimit(next http.Handler) http.Handler {
 	type client struct {
 		limiter  *rate.Limiter
@@ -106,6 +135,34 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
+		if strings.HasPrefix(token, data.APIKeyPrefix) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
+		if strings.Count(token, ".") == 2 {
+			user, session, err := app.userForAccessToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			// Signing out or ending a session revokes its access tokens
+			// straight away on this instance, rather than when they expire.
+			if app.ended.has(session) {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetSession(r, session)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Opaque tokens are no longer issued, but those handed out before
+		// access tokens were introduced are honoured until they expire.
 		v := validator.New()
 
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -130,6 +187,155 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// authenticateAPIKey authenticates a request made with an API key as the
+// user who created the key, provided it comes from an address the key allows.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	key, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	if !key.AllowsIP(ip) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.APIKeys.Touch(key.ID, ip)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// idempotent makes POST requests carrying an Idempotency-Key header safe to
+// retry: the first response is stored and replayed for later requests with
+// the same key, and reusing a key for a different request is rejected. Keys
+// belong to the authenticated user, so it must run after authentication has
+// been required, and responses are stored as they are, so it must not wrap
+// routes that hand out tokens or secrets.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			app.badRequestResponse(w, r, errors.New("Idempotency-Key must not be more than 255 bytes long"))
+			return
+		}
+
+		if app.contextGetUser(r).IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		user := app.contextGetUser(r)
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.RequestURI())
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		record, err := app.models.Idempotency.Acquire(user.ID, key, fingerprint, app.config.idempotency.ttl)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if record != nil {
+			switch {
+			case record.Fingerprint != fingerprint:
+				app.idempotencyKeyReusedResponse(w, r)
+			case record.Status == 0:
+				app.idempotencyKeyInProgressResponse(w, r)
+			default:
+				for name, values := range record.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.Status)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.models.Idempotency.Release(user.ID, key)
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= 500 {
+			err = app.models.Idempotency.Release(user.ID, key)
+		} else {
+			header := rec.Header().Clone()
+			header.Del("X-Request-ID")
+
+			err = app.models.Idempotency.Complete(user.ID, key, rec.status, header, rec.body.Bytes())
+		}
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of its
+// status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -143,6 +349,21 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 	})
 }
 
+// requireSignedInUser only lets through requests made by a person who signed
+// in, not by a machine client using an API key.
+func (app *application) requireSignedInUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -160,9 +381,7 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.permissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -173,6 +392,14 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		scope, err := app.permissionScope(r, code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		r = app.contextSetScope(r, scope)
+
 		next.ServeHTTP(w, r)
 	}
 
@@ -191,12 +418,13 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
 						// w.Header().Set("Access-Control-Allow-Methods", "*")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, Idempotency-Key")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/oidc"
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/tomasen/realip"
+)
+
+var (
+	errNoLinkedAccount   = errors.New("no user linked to identity")
+	errLinkedToOtherUser = errors.New("identity linked to another user")
+)
+
+// oidcAuthorizeHandler starts a sign in through the identity provider. The
+// client sends the user to the returned URL; the provider then sends them to
+// the configured redirect URL with a code and the state, which the client
+// passes to oidcTokenHandler. A signed in user who starts one links the
+// provider account to themselves.
+func (app *application) oidcAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := oidc.NewLogin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var userID int64
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		userID = user.ID
+	}
+
+	err = app.models.Identities.InsertLogin(&data.OIDCLogin{
+		State:    login.State,
+		Nonce:    login.Nonce,
+		Verifier: login.Verifier,
+		UserID:   userID,
+		Expiry:   time.Now().Add(10 * time.Minute),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := app.oidc.AuthCodeURL(r.Context(), login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"authorization_url": authURL, "state": login.State}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oidcTokenHandler finishes a sign in through the identity provider, issuing
+// the same tokens as signing in with a password, after the same two-factor
+// challenge. A sign in started to link an account must be finished by the
+// same user, so that nobody can link their provider account to someone else.
+func (app *application) oidcTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", validator.Required)
+	v.Check(input.State != "", "state", validator.Required)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, err := app.models.Identities.TakeLogin(input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", validator.InvalidToken)
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if login.UserID != 0 && login.UserID != app.contextGetUser(r).ID {
+		v.AddError("state", validator.InvalidToken)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), input.Code, &oidc.Login{
+		State:    login.State,
+		Nonce:    login.Nonce,
+		Verifier: login.Verifier,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrRejected):
+			app.logger.PrintInfo(err.Error(), nil)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, linked, err := app.oidcUser(claims, login.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, errNoLinkedAccount):
+			app.noLinkedAccountResponse(w, r)
+		case errors.Is(err, errLinkedToOtherUser):
+			app.linkedToOtherUserResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Identities.Link(user.ID, claims.Issuer, claims.Subject, claims.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Whoever owns the account hears about every provider account linked
+	// to it, in case it was not them.
+	if linked {
+		err = app.queueEmail(app.userLanguage(r, user), user.Email, "identity_linked.tmpl", map[string]interface{}{
+			"issuer": claims.Issuer,
+			"email":  claims.Email,
+			"ip":     realip.FromRequest(r),
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.syncGroupRoles(user, claims)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The identity provider's own second factor is not trusted in place of
+	// ours, so a user who has one, or needs one, is challenged for it here.
+	if app.twoFactorChallenge(w, r, user) {
+		return
+	}
+
+	session := &data.Session{
+		UserID:    user.ID,
+		IP:        realip.FromRequest(r),
+		UserAgent: userAgent(r),
+	}
+
+	err = app.models.Sessions.Insert(session)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeTokens(w, r, http.StatusCreated, user, session, nil)
+}
+
+// oidcUser returns the user to sign in for the identity provider account in
+// claims, and whether the account has just been linked to an existing user.
+// An account not yet linked is linked to linkTo, the user who started the
+// sign in to link it, if that is not 0. Otherwise it is linked to the
+// activated user with the same, verified, email if linking by email is on,
+// or if there is no such user and auto-provisioning is on, to a new one.
+func (app *application) oidcUser(claims *oidc.Claims, linkTo int64) (*data.User, bool, error) {
+	user, err := app.models.Identities.GetUser(claims.Issuer, claims.Subject)
+	switch {
+	case err == nil && linkTo != 0 && user.ID != linkTo:
+		return nil, false, errLinkedToOtherUser
+	case err == nil:
+		return user, false, nil
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, false, err
+	}
+
+	if linkTo != 0 {
+		user, err = app.models.Users.Get(linkTo)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return user, true, nil
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, false, errNoLinkedAccount
+	}
+
+	user, err = app.models.Users.GetByEmail(claims.Email)
+	if err == nil {
+		// Anyone able to register the same email address at the provider
+		// could otherwise take the account over, so this is opt-in, and an
+		// account that was never activated is left to be activated first.
+		if !app.config.oidc.linkByEmail || !user.Activated {
+			return nil, false, errNoLinkedAccount
+		}
+
+		return user, true, nil
+	}
+
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	if !app.config.oidc.autoProvision {
+		return nil, false, errNoLinkedAccount
+	}
+
+	user, err = app.provisionUser(claims)
+	return user, false, err
+}
+
+// provisionUser creates an activated user for the identity provider account
+// in claims. The user gets a random password, so they can only sign in
+// through the provider unless they reset it.
+func (app *application) provisionUser(claims *oidc.Claims) (*data.User, error) {
+	user := &data.User{
+		Name:      claims.Name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	if user.Name == "" {
+		user.Name = claims.Email
+	}
+
+	if len(user.Name) > 500 {
+		user.Name = user.Name[:500]
+	}
+
+	randomBytes := make([]byte, 36)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, errNoLinkedAccount
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.config.roles.defaultRole != "" {
+		err = app.models.Roles.AddForUser(user.ID, app.config.roles.defaultRole)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app.logger.PrintInfo("user provisioned from identity provider", map[string]string{"email": user.Email})
+
+	return user, nil
+}
+
+// syncGroupRoles gives the user the roles mapped from the identity provider
+// groups in claims, and takes away the mapped roles of groups they have left.
+// Nothing is done when no groups are mapped.
+func (app *application) syncGroupRoles(user *data.User, claims *oidc.Claims) error {
+	if len(app.config.oidc.groupRoles) == 0 {
+		return nil
+	}
+
+	managed, granted := app.groupRoles(claims)
+
+	return app.models.Roles.SyncForUser(user.ID, managed, granted)
+}
+
+// groupRoles returns every role mapped from an identity provider group, and
+// those mapped from the groups in claims, each sorted.
+func (app *application) groupRoles(claims *oidc.Claims) ([]string, []string) {
+	managed := map[string]bool{}
+	granted := map[string]bool{}
+
+	for _, roles := range app.config.oidc.groupRoles {
+		for _, role := range roles {
+			managed[role] = true
+		}
+	}
+
+	for _, group := range claims.Strings(app.config.oidc.groupsClaim) {
+		for _, role := range app.config.oidc.groupRoles[group] {
+			granted[role] = true
+		}
+	}
+
+	return sortedKeys(managed), sortedKeys(granted)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
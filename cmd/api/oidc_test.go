@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/oidc"
+)
+
+// signInClaims signs in through an identity provider serving discovery and a
+// token endpoint, which hands back an ID token with extra added to valid
+// claims, and returns the claims the provider client accepted.
+func signInClaims(t *testing.T, extra map[string]interface{}) *oidc.Claims {
+	t.Helper()
+
+	login, err := oidc.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idp *httptest.Server
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		claims := map[string]interface{}{
+			"iss":   idp.URL,
+			"sub":   "user-1",
+			"aud":   "greenlight",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": login.Nonce,
+		}
+
+		for name, value := range extra {
+			claims[name] = value
+		}
+
+		payload, _ := json.Marshal(claims)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".c2ln",
+		})
+	})
+
+	idp = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	provider := oidc.New(oidc.Config{
+		Issuer:      idp.URL,
+		ClientID:    "greenlight",
+		RedirectURL: "https://app.example.com/callback",
+	})
+
+	claims, err := provider.Exchange(context.Background(), "the-code", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return claims
+}
+
+func TestGroupRoles(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.oidc.groupsClaim = "groups"
+	app.config.oidc.groupRoles = map[string][]string{
+		"admins":   {"admin", "staff"},
+		"staff":    {"staff"},
+		"auditors": {"auditor"},
+	}
+
+	tests := []struct {
+		name    string
+		groups  interface{}
+		granted []string
+	}{
+		{"no groups", nil, []string{}},
+		{"one group", []string{"auditors"}, []string{"auditor"}},
+		{"overlapping groups", []string{"staff", "admins"}, []string{"admin", "staff"}},
+		{"unmapped group", []string{"engineering", "staff"}, []string{"staff"}},
+		{"single string", "auditors", []string{"auditor"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra := map[string]interface{}{}
+			if tt.groups != nil {
+				extra["groups"] = tt.groups
+			}
+
+			managed, granted := app.groupRoles(signInClaims(t, extra))
+
+			if want := []string{"admin", "auditor", "staff"}; !reflect.DeepEqual(managed, want) {
+				t.Errorf("managed = %v, want %v", managed, want)
+			}
+
+			if !reflect.DeepEqual(granted, tt.granted) {
+				t.Errorf("granted = %v, want %v", granted, tt.granted)
+			}
+		})
+	}
+}
+
+// insertTestUser adds a user with a unique email, removed when the test ends.
+func insertTestUser(t *testing.T, app *application, db *sql.DB, activated bool) *data.User {
+	t.Helper()
+
+	user := &data.User{
+		Name:      "OIDC Test",
+		Email:     fmt.Sprintf("oidc-%d@example.com", time.Now().UnixNano()),
+		Activated: activated,
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+
+	return user
+}
+
+func TestOIDCUser(t *testing.T) {
+	db := newTestDB(t)
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db)
+
+	t.Run("linked account", func(t *testing.T) {
+		user := insertTestUser(t, app, db, true)
+
+		claims := signInClaims(t, map[string]interface{}{"email": "changed@example.com"})
+
+		err := app.models.Identities.Link(user.ID, claims.Issuer, claims.Subject, claims.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, linked, err := app.oidcUser(claims, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.ID != user.ID || linked {
+			t.Errorf("got user %d, linked %t, want user %d", got.ID, linked, user.ID)
+		}
+
+		other := insertTestUser(t, app, db, true)
+
+		_, _, err = app.oidcUser(claims, other.ID)
+		if !errors.Is(err, errLinkedToOtherUser) {
+			t.Errorf("linking to another user: got %v, want errLinkedToOtherUser", err)
+		}
+	})
+
+	t.Run("explicit link", func(t *testing.T) {
+		user := insertTestUser(t, app, db, true)
+
+		got, linked, err := app.oidcUser(signInClaims(t, nil), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.ID != user.ID || !linked {
+			t.Errorf("got user %d, linked %t, want user %d linked", got.ID, linked, user.ID)
+		}
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		user := insertTestUser(t, app, db, true)
+
+		app.config.oidc.linkByEmail = true
+		defer func() { app.config.oidc.linkByEmail = false }()
+
+		for _, verified := range []interface{}{false, nil} {
+			extra := map[string]interface{}{"email": user.Email}
+			if verified != nil {
+				extra["email_verified"] = verified
+			}
+
+			_, _, err := app.oidcUser(signInClaims(t, extra), 0)
+			if !errors.Is(err, errNoLinkedAccount) {
+				t.Errorf("email_verified %v: got %v, want errNoLinkedAccount", verified, err)
+			}
+		}
+	})
+
+	t.Run("no email", func(t *testing.T) {
+		_, _, err := app.oidcUser(signInClaims(t, map[string]interface{}{"email_verified": true}), 0)
+		if !errors.Is(err, errNoLinkedAccount) {
+			t.Errorf("got %v, want errNoLinkedAccount", err)
+		}
+	})
+
+	t.Run("verified email", func(t *testing.T) {
+		user := insertTestUser(t, app, db, true)
+		claims := signInClaims(t, map[string]interface{}{"email": user.Email, "email_verified": true})
+
+		_, _, err := app.oidcUser(claims, 0)
+		if !errors.Is(err, errNoLinkedAccount) {
+			t.Errorf("linking by email off: got %v, want errNoLinkedAccount", err)
+		}
+
+		app.config.oidc.linkByEmail = true
+		defer func() { app.config.oidc.linkByEmail = false }()
+
+		got, linked, err := app.oidcUser(claims, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.ID != user.ID || !linked {
+			t.Errorf("got user %d, linked %t, want user %d linked", got.ID, linked, user.ID)
+		}
+	})
+
+	t.Run("verified email, inactive account", func(t *testing.T) {
+		user := insertTestUser(t, app, db, false)
+
+		app.config.oidc.linkByEmail = true
+		defer func() { app.config.oidc.linkByEmail = false }()
+
+		_, _, err := app.oidcUser(signInClaims(t, map[string]interface{}{"email": user.Email, "email_verified": true}), 0)
+		if !errors.Is(err, errNoLinkedAccount) {
+			t.Errorf("got %v, want errNoLinkedAccount", err)
+		}
+
+		stored, err := app.models.Users.Get(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.Activated {
+			t.Error("user was activated")
+		}
+	})
+
+	t.Run("unknown email", func(t *testing.T) {
+		email := fmt.Sprintf("oidc-new-%d@example.com", time.Now().UnixNano())
+		claims := signInClaims(t, map[string]interface{}{"email": email, "email_verified": true, "name": "New User"})
+
+		app.config.oidc.autoProvision = false
+
+		_, _, err := app.oidcUser(claims, 0)
+		if !errors.Is(err, errNoLinkedAccount) {
+			t.Fatalf("got %v, want errNoLinkedAccount", err)
+		}
+
+		app.config.oidc.autoProvision = true
+		defer func() { app.config.oidc.autoProvision = false }()
+
+		user, linked, err := app.oidcUser(claims, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { db.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+
+		if user.Email != email || user.Name != "New User" || !user.Activated || linked {
+			t.Errorf("provisioned %+v, linked %t", user, linked)
+		}
+	})
+}
+
+// userRoleNames returns the names of the roles given to a user without a
+// warehouse or perusahaan limit.
+func userRoleNames(t *testing.T, db *sql.DB, userID int64) []string {
+	t.Helper()
+
+	rows, err := db.Query(`
+		SELECT roles.name FROM users_roles
+		INNER JOIN roles ON roles.id = users_roles.role_id
+		WHERE users_roles.user_id = $1 AND users_roles.warehouse_id IS NULL AND users_roles.perusahaan_id IS NULL
+		ORDER BY roles.name`, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rows.Close()
+
+	names := []string{}
+
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return names
+}
+
+func TestSyncGroupRoles(t *testing.T) {
+	db := newTestDB(t)
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db)
+
+	suffix := fmt.Sprintf("-%d", time.Now().UnixNano())
+	admin, staff, other := "admin"+suffix, "staff"+suffix, "other"+suffix
+
+	for _, name := range []string{admin, staff, other} {
+		role := &data.Role{Name: name}
+
+		err := app.models.Roles.Insert(role)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { db.Exec(`DELETE FROM roles WHERE id = $1`, role.ID) })
+	}
+
+	app.config.oidc.groupsClaim = "groups"
+	app.config.oidc.groupRoles = map[string][]string{
+		"admins": {admin, staff},
+		"staff":  {staff},
+	}
+
+	user := insertTestUser(t, app, db, true)
+
+	err := app.models.Roles.AddForUser(user.ID, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		groups []string
+		want   []string
+	}{
+		{[]string{"admins"}, []string{admin, other, staff}},
+		{[]string{"staff", "engineering"}, []string{other, staff}},
+		{nil, []string{other}},
+	}
+
+	for _, step := range steps {
+		err := app.syncGroupRoles(user, signInClaims(t, map[string]interface{}{"groups": step.groups}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := userRoleNames(t, db, user.ID); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("groups %v: roles = %v, want %v", step.groups, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+
+	"github.com/lib/pq"
+)
+
+// errOutboxSubscriberStalled is logged for a subscriber that has not handled
+// an event older than the outbox retention. The events after its cursor are
+// kept until it catches up, or its row in outbox_cursors is removed if it is
+// gone for good.
+var errOutboxSubscriberStalled = errors.New("outbox subscriber has fallen behind the retention period")
+
+// outboxSubscriber handles one outbox event. Returning an error stops the
+// subscriber at that event, which is handed to it again on the next pass, so
+// subscribers must cope with seeing an event more than once.
+type outboxSubscriber func(event *data.OutboxEvent) error
+
+// outboxSubscribers returns the in-process subscribers by name. The name keys
+// the subscriber's position in the outbox, so renaming one starts it afresh.
+func (app *application) outboxSubscribers() map[string]outboxSubscriber {
+	return map[string]outboxSubscriber{
+		"webhooks": app.models.Webhooks.Enqueue,
+	}
+}
+
+// dispatchOutbox hands outbox events to every subscriber until ctx is
+// cancelled. It wakes as soon as a transaction that wrote events commits, and
+// also polls in case a notification was missed while the listener was
+// reconnecting. serve() waits for it and the subscribers to stop.
+func (app *application) dispatchOutbox(ctx context.Context) {
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	defer listener.Close()
+
+	err := listener.Listen(data.OutboxChannel)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	wake := []chan struct{}{}
+
+	for name, fn := range app.outboxSubscribers() {
+		ch := make(chan struct{}, 1)
+		wake = append(wake, ch)
+
+		app.wg.Add(1)
+
+		go func(name string, fn outboxSubscriber) {
+			defer app.wg.Done()
+			app.runOutboxSubscriber(ctx, name, fn, ch)
+		}(name, fn)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-listener.Notify:
+		case <-time.After(app.config.outbox.interval):
+		}
+
+		for _, ch := range wake {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+
+		app.stream.broadcast()
+	}
+}
+
+func (app *application) runOutboxSubscriber(ctx context.Context, name string, fn outboxSubscriber, wake <-chan struct{}) {
+	for {
+		err := app.models.Outbox.Register(name)
+		if err == nil {
+			break
+		}
+
+		app.logger.PrintError(err, map[string]string{"subscriber": name})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(app.config.outbox.interval):
+		}
+	}
+
+	for {
+		app.drainOutbox(name, fn)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		}
+	}
+}
+
+// drainOutbox hands the subscriber its pending events in order, moving its
+// cursor past each one it handles.
+func (app *application) drainOutbox(name string, fn outboxSubscriber) {
+	const batch = 100
+
+	for {
+		events, err := app.models.Outbox.Pending(name, batch)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"subscriber": name})
+			return
+		}
+
+		for _, event := range events {
+			err = fn(event)
+			if err == nil {
+				err = app.models.Outbox.Ack(name, event)
+			}
+
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"subscriber":   name,
+					"outbox_event": strconv.FormatInt(event.ID, 10),
+				})
+				return
+			}
+		}
+
+		if len(events) < batch {
+			return
+		}
+	}
+}
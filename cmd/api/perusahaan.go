@@ -41,7 +41,7 @@ func (app *application) createPerusahaanHandler(w http.ResponseWriter, r *http.R
 	// // 	return
 	// // }
 
-	err = app.models.Perusahaans.Insert(usaha)
+	err = app.models.Perusahaans.Insert(usaha, app.actor(r))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -63,6 +63,15 @@ func (app *application) showPerusahaanHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	v := validator.New()
+
+	projection := app.readProjection(r.URL.Query(), data.PerusahaanFieldSafelist, data.PerusahaanRelations)
+
+	if data.ValidateProjection(v, projection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	usaha, err := app.models.Perusahaans.Get(id)
 	if err != nil {
 		switch {
@@ -74,7 +83,13 @@ func (app *application) showPerusahaanHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	projected, err := app.project(usaha, projection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": projected}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -98,6 +113,10 @@ func (app *application) updatePerusahaanHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
 	
 	fmt.Println("update jalan")
 
@@ -147,18 +166,18 @@ func (app *application) updatePerusahaanHandler(w http.ResponseWriter, r *http.R
 	// 	return
 	// }
 
-	err = app.models.Perusahaans.Update(usaha)
+	err = app.models.Perusahaans.Update(usaha, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": usaha}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -171,11 +190,28 @@ func (app *application) deletePerusahaanHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.Perusahaans.Delete(id)
+	usaha, err := app.models.Perusahaans.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
+	err = app.models.Perusahaans.Delete(id, usaha.Version, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -206,9 +242,14 @@ func (app *application) listPerusahaanHandler(w http.ResponseWriter, r *http.Req
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.PerusahaanFilterSafelist
+	input.Filters.Projection = app.readProjection(qs, data.PerusahaanFieldSafelist, data.PerusahaanRelations)
 
-	input.Filters.Sort = app.readString(qs, "sort", "rn")
-	input.Filters.SortSafelist = []string{"rn", "name","-rn", "-name"}
+	input.Filters.Sort = app.readString(qs, "sort", "name")
+	input.Filters.SortSafelist = data.PerusahaanSortSafelist
 
 	// input.Filters.Sort = app.readString(qs, "sort", "rn")
 	// input.Filters.SortSafelist = []string{"id", "name","-id", "-name"}
@@ -221,12 +262,23 @@ func (app *application) listPerusahaanHandler(w http.ResponseWriter, r *http.Req
 	usahas, metadata, err := app.models.Perusahaans.GetAll(input.Name, input.Filters)
 	if err != nil {
 		fmt.Println("sampai-err")
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+
+	projected, err := app.project(usahas, input.Filters.Projection)
+	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	
-	err = app.writeJSON(w, http.StatusOK, envelope{"Perusahaan": usahas, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"Perusahaan": projected, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
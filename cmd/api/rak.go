@@ -27,9 +27,14 @@ func (app *application) createRakHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.models.Rak.Insert(&RakMulti)
+	err = app.scoped(r).Rak.Insert(&RakMulti, app.actor(r))
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrOutOfScope):
+			app.outOfScopeResponse(w, r, "warehouse_id")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -42,7 +47,16 @@ func (app *application) showRakHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usaha, err := app.models.Rak.Get(id)
+	v := validator.New()
+
+	projection := app.readProjection(r.URL.Query(), data.RakFieldSafelist, data.RakRelations)
+
+	if data.ValidateProjection(v, projection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	usaha, err := app.scoped(r).Rak.GetWith(id, projection)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -53,7 +67,13 @@ func (app *application) showRakHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"rak": usaha}, nil)
+	projected, err := app.project(usaha, projection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, *usaha.Version, envelope{"rak": projected}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -66,7 +86,7 @@ func (app *application) updateRakHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	usaha, err := app.models.Rak.Get(id)
+	usaha, err := app.scoped(r).Rak.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -77,6 +97,10 @@ func (app *application) updateRakHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if !app.ifMatch(w, r, *usaha.Version) {
+		return
+	}
+
 	var input struct {
 		Rak_id         *int64     `json:"rak_id"`
 		Created_at     *time.Time `json:"created_at"`
@@ -104,10 +128,6 @@ func (app *application) updateRakHandler(w http.ResponseWriter, r *http.Request)
 		usaha.Rak_id = input.Rak_id
 	}
 
-	if input.Version != nil {
-		usaha.Version = input.Version
-	}
-
 	if input.Rak_code != nil {
 		usaha.Rak_code = input.Rak_code
 	}
@@ -119,18 +139,20 @@ func (app *application) updateRakHandler(w http.ResponseWriter, r *http.Request)
 		usaha.Warehouse_id = input.Warehouse_id
 	}
 
-	err = app.models.Rak.Update(usaha)
+	err = app.scoped(r).Rak.Update(usaha, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrOutOfScope):
+			app.outOfScopeResponse(w, r, "warehouse_id")
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"rak": usaha}, nil)
+	err = app.writeRecord(w, r, http.StatusOK, *usaha.Version, envelope{"rak": usaha}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -143,11 +165,28 @@ func (app *application) deleteRakHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.models.Rak.Delete(id)
+	usaha, err := app.scoped(r).Rak.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(w, r, *usaha.Version) {
+		return
+	}
+
+	err = app.scoped(r).Rak.Delete(id, *usaha.Version, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -160,6 +199,36 @@ func (app *application) deleteRakHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (app *application) restoreRakHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.scoped(r).Rak.Restore(id, app.actor(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	usaha, err := app.scoped(r).Rak.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, *usaha.Version, envelope{"rak": usaha}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) listRakHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Code          string
@@ -181,9 +250,14 @@ func (app *application) listRakHandler(w http.ResponseWriter, r *http.Request) {
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.RakFilterSafelist
+	input.Filters.Projection = app.readProjection(qs, data.RakFieldSafelist, data.RakRelations)
 
-	input.Filters.Sort = app.readString(qs, "sort", "rn")
-	input.Filters.SortSafelist = []string{"rn", "name", "-rn", "-name"}
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = data.RakSortSafelist
 
 	// input.Filters.Sort = app.readString(qs, "sort", "rn")
 	// input.Filters.SortSafelist = []string{"id", "name","-id", "-name"}
@@ -193,13 +267,24 @@ func (app *application) listRakHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usahas, metadata, err := app.models.Rak.GetAll(input.Code, input.Warehousename, input.Ket, input.Filters)
+	usahas, metadata, err := app.scoped(r).Rak.GetAll(input.Code, input.Warehousename, input.Ket, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	projected, err := app.project(usahas, input.Filters.Projection)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": usahas, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": projected, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
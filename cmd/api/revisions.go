@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+func (app *application) listRevisionsHandler(resource string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParamString(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		var input struct {
+			data.Filters
+		}
+
+		v := validator.New()
+
+		qs := r.URL.Query()
+
+		input.Filters.Page = app.readInt(qs, "page", 1, v)
+		input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+		input.Filters.Cursor = app.readString(qs, "cursor", "")
+		input.Filters.Count = app.readBool(qs, "count", true, v)
+		input.Filters.Conditions = app.readConditions(qs, v)
+		input.Filters.FilterSafelist = data.RevisionFilterSafelist
+
+		input.Filters.Sort = app.readString(qs, "sort", "-version")
+		input.Filters.SortSafelist = data.RevisionSortSafelist
+
+		if data.ValidateFilters(v, input.Filters); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		revisions, metadata, err := app.scoped(r).Revisions.GetAll(resource, id, input.Filters)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+				app.badRequestResponse(w, r, err)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revisions, "metadata": metadata}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+func (app *application) showRevisionHandler(resource string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParamString(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		version, err := app.readVersionParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		revision, err := app.scoped(r).Revisions.Get(resource, id, version)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"revision": revision}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+func (app *application) revertRevisionHandler(resource string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParamString(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		version, err := app.readVersionParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		current, err := app.scoped(r).Revisions.Version(resource, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !app.ifMatch(w, r, current) {
+			return
+		}
+
+		reverted, err := app.scoped(r).Revisions.Revert(resource, id, version, current, app.actor(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			case errors.Is(err, data.ErrEditConflict):
+				app.preconditionFailedResponse(w, r)
+			case errors.Is(err, data.ErrOutOfScope):
+				app.notPermittedResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		revision, err := app.scoped(r).Revisions.Get(resource, id, reverted)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeRecord(w, r, http.StatusOK, reverted, envelope{"revision": revision}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// bootstrapAdmin gives the admin role to the user with the given email, so
+// that a fresh install has someone who can hand out roles through the API.
+func (app *application) bootstrapAdmin(email string) error {
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return fmt.Errorf("admin user %q does not exist", email)
+		}
+		return err
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, "admin")
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("admin role given", map[string]string{"email": email})
+
+	return nil
+}
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// saveRole checks role and, if it is valid, saves it with save. It
+// writes the response for a role that fails validation or whose name is
+// taken, and reports whether the role was saved.
+func (app *application) saveRole(w http.ResponseWriter, r *http.Request, role *data.Role, save func(*data.Role) error) bool {
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	v := validator.New()
+
+	if data.ValidateRole(v, role, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	err = save(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", validator.AlreadyExists)
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name             string   `json:"name"`
+		Description      string   `json:"description"`
+		Permissions      []string `json:"permissions"`
+		RequireTwoFactor bool     `json:"require_two_factor"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:             input.Name,
+		Description:      input.Description,
+		Permissions:      input.Permissions,
+		RequireTwoFactor: input.RequireTwoFactor,
+	}
+
+	if role.Permissions == nil {
+		role.Permissions = data.Permissions{}
+	}
+
+	if !app.saveRole(w, r, role, app.models.Roles.Insert) {
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/roles/%d", role.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getRole returns the role named by the :id parameter, writing the response
+// if there is no such role.
+func (app *application) getRole(w http.ResponseWriter, r *http.Request) (*data.Role, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return role, true
+}
+
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.getRole(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeRecord(w, r, http.StatusOK, role.Version, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.getRole(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.ifMatch(w, r, role.Version) {
+		return
+	}
+
+	var input struct {
+		Name             *string  `json:"name"`
+		Description      *string  `json:"description"`
+		Permissions      []string `json:"permissions"`
+		RequireTwoFactor *bool    `json:"require_two_factor"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		role.Name = *input.Name
+	}
+
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+
+	if input.RequireTwoFactor != nil {
+		role.RequireTwoFactor = *input.RequireTwoFactor
+	}
+
+	if !app.saveRole(w, r, role, app.models.Roles.Update) {
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, role.Version, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.getRole(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.ifMatch(w, r, role.Version) {
+		return
+	}
+
+	err := app.models.Roles.Delete(role.ID, role.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listRoleUsersHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.getRole(w, r)
+	if !ok {
+		return
+	}
+
+	grants, err := app.models.Roles.GetGrants(role.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"grants": grants}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addRoleUserHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.getRole(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		UserID       int64  `json:"user_id"`
+		WarehouseID  *int64 `json:"warehouse_id"`
+		PerusahaanID *int64 `json:"perusahaan_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.UserID > 0, "user_id", validator.Positive)
+	v.Check(input.WarehouseID == nil || *input.WarehouseID > 0, "warehouse_id", validator.Positive)
+	v.Check(input.PerusahaanID == nil || *input.PerusahaanID > 0, "perusahaan_id", validator.Positive)
+	v.Check(input.WarehouseID == nil || input.PerusahaanID == nil, "warehouse_id", validator.Exclusive, "perusahaan_id")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.AddUser(role.ID, input.UserID, input.WarehouseID, input.PerusahaanID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully given to user"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) readUserParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("user_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid user_id parameter")
+	}
+
+	return id, nil
+}
+
+// removeRoleUserHandler takes a grant of a role from a user. The warehouse_id
+// or perusahaan_id query parameter picks a limited grant; without either the
+// unlimited grant is taken.
+func (app *application) removeRoleUserHandler(w http.ResponseWriter, r *http.Request) {
+	roleID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	userID, err := app.readUserParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	var warehouseID, perusahaanID *int64
+
+	if qs.Has("warehouse_id") {
+		id := int64(app.readInt(qs, "warehouse_id", 0, v))
+		warehouseID = &id
+	}
+
+	if qs.Has("perusahaan_id") {
+		id := int64(app.readInt(qs, "perusahaan_id", 0, v))
+		perusahaanID = &id
+	}
+
+	v.Check(warehouseID == nil || perusahaanID == nil, "warehouse_id", validator.Exclusive, "perusahaan_id")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.RemoveUser(roleID, userID, warehouseID, perusahaanID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully taken from user"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
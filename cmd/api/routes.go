@@ -15,64 +15,137 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
-	// router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	//router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-
-	// router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	// router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	// router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
-
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMoviesHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/perusahaans", app.listPerusahaanHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/warehouse", app.listWarehouseHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/rak", app.listRakHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/brand", app.listBrandHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/brandasset", app.listBrandAssetHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/stok", app.listStokHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/perusahaans", app.requirePermission("perusahaan:read", app.listPerusahaanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/warehouse", app.requirePermission("warehouse:read", app.listWarehouseHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/rak", app.requirePermission("rak:read", app.listRakHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/brand", app.requirePermission("brand:read", app.listBrandHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/brandasset", app.requirePermission("brandasset:read", app.listBrandAssetHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/stok", app.requirePermission("stok:read", app.listStokHandler))
 	//listStokHandler
 
-	router.HandlerFunc(http.MethodPost, "/v1/perusahaans", app.createPerusahaanHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/warehouse", app.createWarehouseHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/rak", app.createRakHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/brand", app.createBrandHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/brandasset", app.createBrandAssetHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/stok", app.createStokHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/perusahaans", app.requirePermission("perusahaan:write", app.idempotent(app.createPerusahaanHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.idempotent(app.createMovieHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/warehouse", app.requirePermission("warehouse:write", app.idempotent(app.createWarehouseHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/rak", app.requirePermission("rak:write", app.idempotent(app.createRakHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/brand", app.requirePermission("brand:write", app.idempotent(app.createBrandHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/brandasset", app.requirePermission("brandasset:write", app.idempotent(app.createBrandAssetHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/stok", app.requirePermission("stok:write", app.idempotent(app.createStokHandler)))
 	//createStokHandler
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/rak/:id", app.showRakHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/stok/:id", app.showStokHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/perusahaans/:id", app.requirePermission("perusahaan:read", app.showPerusahaanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/warehouse/:id", app.requirePermission("warehouse:read", app.showWarehouseHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/rak/:id", app.requirePermission("rak:read", app.showRakHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/brand/:id", app.requirePermission("brand:read", app.showBrandHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/brandasset/:id", app.requirePermission("brandasset:read", app.showBrandAsssetHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/stok/:id", app.requirePermission("stok:read", app.showStokHandler))
 	//router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
 
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/perusahaans/:id", app.updatePerusahaanHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/warehouse/:id", app.updateWarehouseHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/rak/:id", app.updateRakHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/brand/:id", app.updateBrandHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/brandasset/:id", app.updateBrandAssetHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/stok/:id", app.updateStokHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/perusahaans/:id", app.requirePermission("perusahaan:write", app.updatePerusahaanHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/warehouse/:id", app.requirePermission("warehouse:write", app.updateWarehouseHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/rak/:id", app.requirePermission("rak:write", app.updateRakHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/brand/:id", app.requirePermission("brand:write", app.updateBrandHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/brandasset/:id", app.requirePermission("brandasset:write", app.updateBrandAssetHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/stok/:id", app.requirePermission("stok:write", app.updateStokHandler))
 	//updateStokHandler
 
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/perusahaans/:id", app.deletePerusahaanHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/warehouse/:id", app.deleteWarehouseHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/rak/:id", app.deleteRakHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/brand/:id", app.deleteBrandHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/brandasset/:id", app.deleteBrandAssetHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/stok/:id", app.deleteStokHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/perusahaans/:id", app.requirePermission("perusahaan:write", app.deletePerusahaanHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/warehouse/:id", app.requirePermission("warehouse:write", app.deleteWarehouseHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/rak/:id", app.requirePermission("rak:write", app.deleteRakHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/brand/:id", app.requirePermission("brand:write", app.deleteBrandHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/brandasset/:id", app.requirePermission("brandasset:write", app.deleteBrandAssetHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/stok/:id", app.requirePermission("stok:write", app.deleteStokHandler))
 
 	//deleteStokHandler
 
+	router.HandlerFunc(http.MethodPost, "/v1/warehouse/:id/restore", app.requirePermission("warehouse:write", app.idempotent(app.restoreWarehouseHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/rak/:id/restore", app.requirePermission("rak:write", app.idempotent(app.restoreRakHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/stok/:id/restore", app.requirePermission("stok:write", app.idempotent(app.restoreStokHandler)))
+
+	for _, resource := range []string{"brand", "rak", "warehouse", "stok"} {
+		router.HandlerFunc(http.MethodGet, "/v1/"+resource+"/:id/revisions", app.requirePermission(resource+":read", app.listRevisionsHandler(resource)))
+		router.HandlerFunc(http.MethodGet, "/v1/"+resource+"/:id/revisions/:version", app.requirePermission(resource+":read", app.showRevisionHandler(resource)))
+		router.HandlerFunc(http.MethodPost, "/v1/"+resource+"/:id/revisions/:version/revert", app.requirePermission(resource+":write", app.idempotent(app.revertRevisionHandler(resource))))
+	}
+
+	router.HandlerFunc(http.MethodGet, "/v1/audit", app.requirePermission("audit:read", app.listAuditHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/trash", app.requirePermission("trash:read", app.listTrashHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/batch", app.requireActivatedUser(app.idempotent(app.batchHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/stream", app.requireActivatedUser(app.streamHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/jobs", app.requirePermission("jobs:read", app.listJobsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/jobs/:id", app.requirePermission("jobs:read", app.showJobHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/jobs/:id/retry", app.requirePermission("jobs:write", app.idempotent(app.retryJobHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/emails", app.requirePermission("emails:read", app.listEmailsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/emails/:id", app.requirePermission("emails:read", app.showEmailHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/emails/:id/resend", app.requirePermission("emails:write", app.idempotent(app.resendEmailHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/tasks", app.requirePermission("tasks:read", app.listTasksHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/tasks/:name/runs", app.requirePermission("tasks:read", app.listTaskRunsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tasks/:name/run", app.requirePermission("tasks:write", app.idempotent(app.runTaskHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requirePermission("webhooks:read", app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requirePermission("webhooks:write", app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requirePermission("webhooks:read", app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requirePermission("webhooks:write", app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requirePermission("webhooks:write", app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePermission("webhooks:read", app.listWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries/:delivery_id", app.requirePermission("webhooks:read", app.showWebhookDeliveryHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/:id/deliveries/:delivery_id/redeliver", app.requirePermission("webhooks:write", app.idempotent(app.redeliverWebhookHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/permissions", app.requirePermission("roles:read", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/roles", app.requirePermission("roles:read", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/roles", app.requirePermission("roles:write", app.idempotent(app.createRoleHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/roles/:id", app.requirePermission("roles:read", app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/roles/:id", app.requirePermission("roles:write", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/roles/:id", app.requirePermission("roles:write", app.deleteRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/roles/:id/users", app.requirePermission("roles:read", app.listRoleUsersHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/roles/:id/users", app.requirePermission("roles:write", app.idempotent(app.addRoleUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/roles/:id/users/:user_id", app.requirePermission("roles:write", app.removeRoleUserHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requirePermission("api_keys:read", app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requirePermission("api_keys:write", app.requireSignedInUser(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys/:id", app.requirePermission("api_keys:read", app.showAPIKeyHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/api-keys/:id", app.requirePermission("api_keys:write", app.requireSignedInUser(app.updateAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requirePermission("api_keys:write", app.revokeAPIKeyHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys/:id/rotate", app.requirePermission("api_keys:write", app.requireSignedInUser(app.rotateAPIKeyHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/lockouts", app.requirePermission("lockouts:read", app.listLockoutsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/lockouts/users/:id", app.requirePermission("lockouts:read", app.showUserLockoutHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/lockouts/users/:id", app.requirePermission("lockouts:write", app.unlockUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/lockouts/ips/:ip", app.requirePermission("lockouts:write", app.unlockIPHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/language", app.requireActivatedUser(app.updateUserLanguageHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireSignedInUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions", app.requireSignedInUser(app.deleteOtherSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireSignedInUser(app.deleteSessionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/two-factor", app.requireSignedInUser(app.enrolTwoFactorHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/two-factor", app.requireSignedInUser(app.confirmTwoFactorHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/two-factor", app.requireSignedInUser(app.disableTwoFactorHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/two-factor/recovery-codes", app.requireSignedInUser(app.regenerateRecoveryCodesHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireSignedInUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/two-factor", app.createTwoFactorTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/two-factor/enrolment", app.createTwoFactorEnrolmentHandler)
+
+	if app.oidc != nil {
+		router.HandlerFunc(http.MethodGet, "/v1/oidc/authorize", app.oidcAuthorizeHandler)
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc", app.oidcTokenHandler)
+	}
+
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	return app.metrics(app.recoverPanic(app.requestID(app.enableCORS(app.rateLimit(app.authenticate(router))))))
 }
@@ -11,15 +11,36 @@ import (
 	"time"
 )
 
+// writeTimeout bounds how long any response, including an event stream, may
+// take to write.
+const writeTimeout = 30 * time.Second
+
+// startWorker runs fn in the background until ctx is cancelled. serve()
+// waits for it to return before it exits.
+func (app *application) startWorker(ctx context.Context, fn func(ctx context.Context)) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+		fn(ctx)
+	}()
+}
+
 func (app *application) serve() error {
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: writeTimeout,
 	}
 
+	workers, stopWorkers := context.WithCancel(context.Background())
+	app.startJobWorkers(workers)
+	app.startWorker(workers, app.dispatchOutbox)
+	app.startWorker(workers, app.deliverWebhooks)
+	app.startScheduler(workers)
+
 	shutdownError := make(chan error)
 
 	go func() {
@@ -35,6 +56,7 @@ func (app *application) serve() error {
 		defer cancel()
 
 		err := srv.Shutdown(ctx)
+		stopWorkers()
 		if err != nil {
 			shutdownError <- err
 		}
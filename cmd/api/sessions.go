@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+// endedSessions remembers the sessions this instance has ended for as long as
+// their access tokens may still be valid, so that authenticate can refuse
+// those tokens without a query on every request. It lives in memory only:
+// other instances, and this one once restarted, keep accepting the tokens of
+// an ended session until they expire, at most the access token TTL later.
+type endedSessions struct {
+	mu       sync.Mutex
+	sessions map[int64]time.Time
+}
+
+// add remembers the sessions with the given IDs until ttl has passed.
+func (e *endedSessions) add(ttl time.Duration, ids ...int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.sessions == nil {
+		e.sessions = make(map[int64]time.Time)
+	}
+
+	now := time.Now()
+
+	for id, until := range e.sessions {
+		if now.After(until) {
+			delete(e.sessions, id)
+		}
+	}
+
+	for _, id := range ids {
+		e.sessions[id] = now.Add(ttl)
+	}
+}
+
+// has reports whether the session with the given ID has been ended.
+func (e *endedSessions) has(id int64) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	until, ok := e.sessions[id]
+	return ok && time.Now().Before(until)
+}
+
+// endSessions refuses the access tokens of the sessions with the given IDs,
+// which have just been ended, for as long as any of them can be valid.
+func (app *application) endSessions(ids ...int64) {
+	app.ended.add(app.config.tokens.accessTTL, ids...)
+}
+
+// userAgent returns the request's User-Agent header, cut short so that a
+// client cannot fill the sessions table with it.
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+
+	return ua
+}
+
+// listSessionsHandler lists the places the user is signed in, marking the one
+// the request is made from.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.models.Sessions.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	current := app.contextGetSession(r)
+
+	for _, session := range sessions {
+		session.Current = session.ID == current
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Sessions.Delete(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.endSessions(id)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully ended"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteOtherSessionsHandler signs the user out everywhere but the session
+// the request is made from.
+func (app *application) deleteOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	ended, err := app.models.Sessions.DeleteAllForUser(app.contextGetUser(r).ID, app.contextGetSession(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.endSessions(ended...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"ended": len(ended)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndedSessions(t *testing.T) {
+	var ended endedSessions
+
+	if ended.has(1) {
+		t.Error("session 1 ended before anything was added")
+	}
+
+	ended.add(time.Minute, 1, 2)
+
+	for _, id := range []int64{1, 2} {
+		if !ended.has(id) {
+			t.Errorf("session %d not ended", id)
+		}
+	}
+
+	if ended.has(3) {
+		t.Error("session 3 ended")
+	}
+
+	ended.add(-time.Second, 3)
+
+	if ended.has(3) {
+		t.Error("session 3 still refused after its tokens expired")
+	}
+
+	ended.add(time.Minute, 4)
+
+	if _, ok := ended.sessions[3]; ok {
+		t.Error("session 3 was not pruned")
+	}
+}
@@ -26,9 +26,14 @@ func (app *application) createStokHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Stok.Insert(&stok)
+	err = app.scoped(r).Stok.Insert(&stok, app.actor(r))
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrOutOfScope):
+			app.outOfScopeResponse(w, r, "jsonstokdetail")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -41,7 +46,16 @@ func (app *application) showStokHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	usaha, err := app.models.Stok.Get(id)
+	v := validator.New()
+
+	projection := app.readProjection(r.URL.Query(), data.StokFieldSafelist, data.StokRelations)
+
+	if data.ValidateProjection(v, projection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	usaha, err := app.scoped(r).Stok.GetWith(id, projection)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -52,7 +66,13 @@ func (app *application) showStokHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"stok": usaha}, nil)
+	projected, err := app.project(usaha, projection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, *usaha.Version, envelope{"stok": projected}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -65,7 +85,7 @@ func (app *application) updateStokHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	usaha, err := app.models.Stok.Get(id)
+	usaha, err := app.scoped(r).Stok.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -76,6 +96,10 @@ func (app *application) updateStokHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !app.ifMatch(w, r, *usaha.Version) {
+		return
+	}
+
 	input := data.Stok{}
 
 	err = app.readJSON(w, r, &input)
@@ -116,10 +140,6 @@ func (app *application) updateStokHandler(w http.ResponseWriter, r *http.Request
 		usaha.ModelID = input.ModelID
 	}
 
-	if input.Version != nil {
-		usaha.Version = input.Version
-	}
-
 	if len(input.JsonStokDetail) > 0 {
 		usaha.JsonStokDetail = nil
 		usaha.JsonStokDetail = input.JsonStokDetail
@@ -127,18 +147,20 @@ func (app *application) updateStokHandler(w http.ResponseWriter, r *http.Request
 		usaha.JsonStokDetail = nil
 	}
 
-	err = app.models.Stok.Update(usaha)
+	err = app.scoped(r).Stok.Update(usaha, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrOutOfScope):
+			app.outOfScopeResponse(w, r, "jsonstokdetail")
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"stok": usaha}, nil)
+	err = app.writeRecord(w, r, http.StatusOK, *usaha.Version, envelope{"stok": usaha}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -151,11 +173,28 @@ func (app *application) deleteStokHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Stok.Delete(id)
+	usaha, err := app.scoped(r).Stok.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(w, r, *usaha.Version) {
+		return
+	}
+
+	err = app.scoped(r).Stok.Delete(id, *usaha.Version, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -168,6 +207,36 @@ func (app *application) deleteStokHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+func (app *application) restoreStokHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParamString(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.scoped(r).Stok.Restore(id, app.actor(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	usaha, err := app.scoped(r).Stok.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, *usaha.Version, envelope{"stok": usaha}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) listStokHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Code      string
@@ -191,9 +260,14 @@ func (app *application) listStokHandler(w http.ResponseWriter, r *http.Request)
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.StokFilterSafelist
+	input.Filters.Projection = app.readProjection(qs, data.StokFieldSafelist, data.StokRelations)
 
-	input.Filters.Sort = app.readString(qs, "sort", "rn")
-	input.Filters.SortSafelist = []string{"rn", "name", "-rn", "-name"}
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = data.StokSortSafelist
 
 	// input.Filters.Sort = app.readString(qs, "sort", "rn")
 	// input.Filters.SortSafelist = []string{"id", "name","-id", "-name"}
@@ -203,13 +277,24 @@ func (app *application) listStokHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	usahas, metadata, err := app.models.Stok.GetAll(input.Code, input.Ket, input.Brandname, input.Modelname, input.Filters)
+	usahas, metadata, err := app.scoped(r).Stok.GetAll(input.Code, input.Ket, input.Brandname, input.Modelname, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	projected, err := app.project(usahas, input.Filters.Projection)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": usahas, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": projected, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// streamResources are the resources sent on /v1/stream, each guarded by the
+// read permission it maps to. A change to the details of a stok arrives both
+// as a stok event, with stok.quantity_changed marking the ones that moved
+// quantities, and as a stok_detail event for each detail it touched.
+var streamResources = map[string]string{
+	"warehouse":   "warehouse:read",
+	"rak":         "rak:read",
+	"stok":        "stok:read",
+	"stok_detail": "stok:read",
+}
+
+// streamHub wakes connected event streams when new outbox events may be
+// available. Each stream reads the outbox from its own position, so a slow
+// client never holds up the others.
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+func (h *streamHub) subscribe() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients == nil {
+		h.clients = make(map[chan struct{}]bool)
+	}
+
+	ch := make(chan struct{}, 1)
+	h.clients[ch] = true
+
+	return ch
+}
+
+func (h *streamHub) unsubscribe(ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients, ch)
+}
+
+func (h *streamHub) broadcast() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// streamHandler sends change events as Server-Sent Events. Event IDs are
+// outbox positions, so a client that reconnects with Last-Event-ID carries on
+// where it stopped. The server's write timeout applies to streams too, so
+// each one ends shortly before it and the client reconnects.
+func (app *application) streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("response writer does not support flushing"))
+		return
+	}
+
+	v := validator.New()
+
+	warehouses := map[string]bool{}
+
+	for _, id := range app.readCSV(r.URL.Query(), "warehouse_id", nil) {
+		n, err := strconv.ParseInt(id, 10, 64)
+		v.Check(err == nil && n > 0, "warehouse_id", validator.InvalidIDList)
+		warehouses[strconv.FormatInt(n, 10)] = true
+	}
+
+	position, err := parseEventID(r.Header.Get("Last-Event-ID"))
+	v.Check(err == nil, "Last-Event-ID", validator.InvalidEventID)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	permissions, err := app.permissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	resources := []string{}
+
+	// scopes holds, for the resources the user may only read in some
+	// warehouses, the warehouses their events must touch.
+	scopes := map[string]map[string]bool{}
+
+	for resource, permission := range streamResources {
+		if !permissions.Include(permission) {
+			continue
+		}
+
+		resources = append(resources, resource)
+
+		scope, err := app.permissionScope(r, permission)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !scope.Unlimited() {
+			scopes[resource] = map[string]bool{}
+			for _, id := range scope.Warehouses {
+				scopes[resource][strconv.FormatInt(id, 10)] = true
+			}
+		}
+	}
+
+	if len(resources) == 0 {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	if position == nil {
+		head, err := app.models.Outbox.Head()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		position = &head
+	}
+
+	wake := app.stream.subscribe()
+	defer app.stream.unsubscribe(wake)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	end := time.NewTimer(writeTimeout - 5*time.Second)
+	defer end.Stop()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		for {
+			events, err := app.models.Outbox.After(*position, resources, 100)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			for _, event := range events {
+				position = &data.OutboxPosition{TxID: event.TxID, ID: event.ID}
+
+				if len(warehouses) > 0 && !inWarehouses(event, warehouses) {
+					continue
+				}
+
+				if scope, ok := scopes[event.Resource]; ok {
+					if !inWarehouses(event, scope) {
+						continue
+					}
+
+					// A stok may have details in warehouses outside
+					// the scope, which the client must not see.
+					if event.Resource == "stok" {
+						event, err = scopeStokDetails(event, scope)
+						if err != nil {
+							app.logError(r, err)
+							return
+						}
+
+						if event == nil {
+							continue
+						}
+					}
+				}
+
+				js, err := json.Marshal(event)
+				if err != nil {
+					app.logError(r, err)
+					return
+				}
+
+				fmt.Fprintf(w, "id: %d-%d\nevent: %s\ndata: %s\n\n", event.TxID, event.ID, event.Event, js)
+			}
+
+			flusher.Flush()
+
+			if len(events) < 100 {
+				break
+			}
+		}
+
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-end.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// parseEventID reads a Last-Event-ID header of the form "<txid>-<id>". It
+// returns nil if the header is empty.
+func parseEventID(header string) (*data.OutboxPosition, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(header, "-", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid event id")
+	}
+
+	txid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.OutboxPosition{TxID: txid, ID: id}, nil
+}
+
+// inWarehouses reports whether an event touches any of the warehouses, either
+// before or after the change.
+func inWarehouses(event *data.OutboxEvent, warehouses map[string]bool) bool {
+	if event.Resource == "warehouse" {
+		return warehouses[event.ResourceID]
+	}
+
+	type record struct {
+		WarehouseID json.Number `json:"warehouse_id"`
+		Details     []struct {
+			WarehouseID json.Number `json:"warehouse_id"`
+		} `json:"details"`
+	}
+
+	var current record
+	var changes struct {
+		WarehouseID struct {
+			Old json.Number `json:"old"`
+		} `json:"warehouse_id"`
+		Details struct {
+			Old []struct {
+				WarehouseID json.Number `json:"warehouse_id"`
+			} `json:"old"`
+		} `json:"details"`
+	}
+
+	if event.Data != nil {
+		json.Unmarshal(event.Data, &current)
+	}
+	json.Unmarshal(event.Changes, &changes)
+
+	ids := []json.Number{current.WarehouseID, changes.WarehouseID.Old}
+
+	for _, d := range current.Details {
+		ids = append(ids, d.WarehouseID)
+	}
+
+	for _, d := range changes.Details.Old {
+		ids = append(ids, d.WarehouseID)
+	}
+
+	for _, id := range ids {
+		if warehouses[id.String()] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scopeStokDetails returns a copy of a stok event with only the details in
+// the warehouses left in its data and changes. It returns nil for a
+// stok.quantity_changed event whose quantities only moved elsewhere.
+func scopeStokDetails(event *data.OutboxEvent, warehouses map[string]bool) (*data.OutboxEvent, error) {
+	// quantities collects the qty of each kept detail by warehouse and rak.
+	filter := func(details []json.RawMessage, quantities map[string]string) ([]json.RawMessage, error) {
+		kept := []json.RawMessage{}
+
+		for _, detail := range details {
+			var d struct {
+				WarehouseID json.Number `json:"warehouse_id"`
+				RakID       json.Number `json:"rak_id"`
+				Qty         json.Number `json:"qty"`
+			}
+
+			err := json.Unmarshal(detail, &d)
+			if err != nil {
+				return nil, err
+			}
+
+			if warehouses[d.WarehouseID.String()] {
+				kept = append(kept, detail)
+				quantities[d.WarehouseID.String()+"/"+d.RakID.String()] = d.Qty.String()
+			}
+		}
+
+		return kept, nil
+	}
+
+	scoped := *event
+
+	if event.Data != nil {
+		var record map[string]json.RawMessage
+
+		err := json.Unmarshal(event.Data, &record)
+		if err != nil {
+			return nil, err
+		}
+
+		if js, ok := record["details"]; ok {
+			var details []json.RawMessage
+
+			err := json.Unmarshal(js, &details)
+			if err != nil {
+				return nil, err
+			}
+
+			details, err = filter(details, map[string]string{})
+			if err != nil {
+				return nil, err
+			}
+
+			record["details"], err = json.Marshal(details)
+			if err != nil {
+				return nil, err
+			}
+
+			scoped.Data, err = json.Marshal(record)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var changes map[string]json.RawMessage
+
+	err := json.Unmarshal(event.Changes, &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	before := map[string]string{}
+	after := map[string]string{}
+
+	if js, ok := changes["details"]; ok {
+		var change struct {
+			Old []json.RawMessage `json:"old"`
+			New []json.RawMessage `json:"new"`
+		}
+
+		err := json.Unmarshal(js, &change)
+		if err != nil {
+			return nil, err
+		}
+
+		change.Old, err = filter(change.Old, before)
+		if err != nil {
+			return nil, err
+		}
+
+		change.New, err = filter(change.New, after)
+		if err != nil {
+			return nil, err
+		}
+
+		old, err := json.Marshal(change.Old)
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := json.Marshal(change.New)
+		if err != nil {
+			return nil, err
+		}
+
+		if string(old) == string(current) {
+			delete(changes, "details")
+		} else {
+			changes["details"], err = json.Marshal(change)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		scoped.Changes, err = json.Marshal(changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if event.Event == "stok.quantity_changed" && reflect.DeepEqual(before, after) {
+		return nil, nil
+	}
+
+	return &scoped, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/data"
+)
+
+func TestScopeStokDetails(t *testing.T) {
+	scope := map[string]bool{"1": true}
+
+	event := &data.OutboxEvent{
+		Event:    "stok.quantity_changed",
+		Resource: "stok",
+		Data:     json.RawMessage(`{"id":"s1","details":[{"warehouse_id":1,"rak_id":10,"qty":5},{"warehouse_id":2,"rak_id":20,"qty":9}]}`),
+		Changes:  json.RawMessage(`{"details":{"old":[{"warehouse_id":1,"rak_id":10,"qty":4},{"warehouse_id":2,"rak_id":20,"qty":8}],"new":[{"warehouse_id":1,"rak_id":10,"qty":5},{"warehouse_id":2,"rak_id":20,"qty":9}]}}`),
+	}
+
+	scoped, err := scopeStokDetails(event, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := string(scoped.Data), `{"details":[{"warehouse_id":1,"rak_id":10,"qty":5}],"id":"s1"}`; got != want {
+		t.Errorf("data = %s, want %s", got, want)
+	}
+
+	if got, want := string(scoped.Changes), `{"details":{"old":[{"warehouse_id":1,"rak_id":10,"qty":4}],"new":[{"warehouse_id":1,"rak_id":10,"qty":5}]}}`; got != want {
+		t.Errorf("changes = %s, want %s", got, want)
+	}
+
+	elsewhere := &data.OutboxEvent{
+		Event:    "stok.quantity_changed",
+		Resource: "stok",
+		Data:     json.RawMessage(`{"id":"s1","details":[{"warehouse_id":1,"rak_id":10,"qty":5},{"warehouse_id":2,"rak_id":20,"qty":9}]}`),
+		Changes:  json.RawMessage(`{"details":{"old":[{"warehouse_id":1,"rak_id":10,"qty":5},{"warehouse_id":2,"rak_id":20,"qty":8}],"new":[{"warehouse_id":1,"rak_id":10,"qty":5},{"warehouse_id":2,"rak_id":20,"qty":9}]}}`),
+	}
+
+	scoped, err = scopeStokDetails(elsewhere, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scoped != nil {
+		t.Errorf("quantities that moved outside the scope were sent: %s", scoped.Changes)
+	}
+
+	elsewhere.Event = "stok.updated"
+
+	scoped, err = scopeStokDetails(elsewhere, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scoped == nil || string(scoped.Changes) != `{}` {
+		t.Errorf("stok.updated outside the scope: got %+v", scoped)
+	}
+}
+
+func TestInWarehousesStokDetail(t *testing.T) {
+	scope := map[string]bool{"1": true}
+
+	tests := []struct {
+		name  string
+		event *data.OutboxEvent
+		want  bool
+	}{
+		{
+			"created in scope",
+			&data.OutboxEvent{Resource: "stok_detail", Data: json.RawMessage(`{"warehouse_id":1,"rak_id":10,"qty":5}`), Changes: json.RawMessage(`{"qty":{"old":null,"new":5}}`)},
+			true,
+		},
+		{
+			"created elsewhere",
+			&data.OutboxEvent{Resource: "stok_detail", Data: json.RawMessage(`{"warehouse_id":2,"rak_id":20,"qty":5}`), Changes: json.RawMessage(`{"qty":{"old":null,"new":5}}`)},
+			false,
+		},
+		{
+			"deleted in scope",
+			&data.OutboxEvent{Resource: "stok_detail", Changes: json.RawMessage(`{"warehouse_id":{"old":1,"new":null},"qty":{"old":5,"new":null}}`)},
+			true,
+		},
+		{
+			"deleted elsewhere",
+			&data.OutboxEvent{Resource: "stok_detail", Changes: json.RawMessage(`{"warehouse_id":{"old":2,"new":null},"qty":{"old":5,"new":null}}`)},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := inWarehouses(tt.event, scope); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/cron"
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultSchedules are the cron expressions tasks run on unless the -cron-file
+// or -cron flags say otherwise.
+var defaultSchedules = map[string]string{
+	"purge_tokens":           "@hourly",
+	"purge_idempotency_keys": "@hourly",
+	"purge_trash":            "@hourly",
+	"prune_outbox":           "@hourly",
+	"stock_snapshot":         "55 23 * * *",
+	"low_stock":              "0 7 * * *",
+	"stock_report":           "0 7 * * 1",
+}
+
+func (app *application) taskFuncs() map[string]func(ctx context.Context) error {
+	return map[string]func(ctx context.Context) error{
+		"purge_tokens":           app.purgeTokensTask,
+		"purge_idempotency_keys": app.purgeIdempotencyKeysTask,
+		"purge_trash":            app.purgeTrashTask,
+		"prune_outbox":           app.pruneOutboxTask,
+		"stock_snapshot":         app.stockSnapshotTask,
+		"low_stock":              app.lowStockTask,
+		"stock_report":           app.stockReportTask,
+	}
+}
+
+// loadSchedules combines the default schedules with those in file, if any,
+// and then overrides, which come from -cron flags. Both use lines of the form
+// "task=expression"; an expression of "off" disables the task.
+func loadSchedules(file string, overrides []string) (map[string]*cron.Schedule, error) {
+	specs := map[string]string{}
+
+	for name, expr := range defaultSchedules {
+		specs[name] = expr
+	}
+
+	lines := []string{}
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, line := range append(lines, overrides...) {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("schedule %q must be of the form task=expression", line)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		if _, ok := defaultSchedules[name]; !ok {
+			return nil, fmt.Errorf("schedule %q names an unknown task", line)
+		}
+
+		specs[name] = strings.TrimSpace(parts[1])
+	}
+
+	schedules := map[string]*cron.Schedule{}
+
+	for name, expr := range specs {
+		if expr == "off" {
+			continue
+		}
+
+		schedule, err := cron.Parse(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		schedules[name] = schedule
+	}
+
+	return schedules, nil
+}
+
+// startScheduler runs tasks on their schedules until ctx is cancelled.
+// serve() waits for runs that are in progress before it exits.
+func (app *application) startScheduler(ctx context.Context) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		next := map[string]time.Time{}
+
+		for name, schedule := range app.config.cron.schedules {
+			next[name] = schedule.Next(time.Now())
+		}
+
+		for {
+			var earliest time.Time
+
+			for _, t := range next {
+				if !t.IsZero() && (earliest.IsZero() || t.Before(earliest)) {
+					earliest = t
+				}
+			}
+
+			if earliest.IsZero() {
+				<-ctx.Done()
+				return
+			}
+
+			timer := time.NewTimer(time.Until(earliest))
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			for name, t := range next {
+				if t.After(time.Now()) {
+					continue
+				}
+
+				app.wg.Add(1)
+
+				go func(name string, slot time.Time) {
+					defer app.wg.Done()
+					app.runTask(name, data.TaskScheduled, slot, 0)
+				}(name, t)
+
+				next[name] = app.config.cron.schedules[name].Next(time.Now())
+			}
+		}
+	}()
+}
+
+// runTask runs a task once and logs the outcome. A scheduled slot that
+// another instance has already run is not an error.
+func (app *application) runTask(name string, trigger string, slot time.Time, userID int64) error {
+	fn, ok := app.taskFuncs()[name]
+	if !ok {
+		return fmt.Errorf("unknown task %q", name)
+	}
+
+	properties := map[string]string{
+		"task":    name,
+		"trigger": trigger,
+	}
+
+	run, err := app.models.Tasks.Run(name, trigger, slot.UTC(), userID, fn)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTaskAlreadyRun):
+			return nil
+		case errors.Is(err, data.ErrTaskLocked):
+			app.logger.PrintInfo("task skipped: "+err.Error(), properties)
+		default:
+			app.logger.PrintError(err, properties)
+		}
+		return err
+	}
+
+	properties["duration"] = run.FinishedAt.Sub(run.StartedAt).String()
+	app.logger.PrintInfo("task finished", properties)
+
+	return nil
+}
+
+func (app *application) purgeTokensTask(ctx context.Context) error {
+	deleted, err := app.models.Tokens.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	sessions, err := app.models.Sessions.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	logins, err := app.models.Identities.DeleteExpiredLogins()
+	if err != nil {
+		return err
+	}
+
+	ips, err := app.models.Lockouts.DeleteExpiredIPs(app.config.lockout.ip.Reset)
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("purged expired tokens", map[string]string{
+		"tokens":   strconv.FormatInt(deleted, 10),
+		"sessions": strconv.FormatInt(sessions, 10),
+		"logins":   strconv.FormatInt(logins, 10),
+		"lockouts": strconv.FormatInt(ips, 10),
+	})
+
+	return nil
+}
+
+func (app *application) purgeIdempotencyKeysTask(ctx context.Context) error {
+	deleted, err := app.models.Idempotency.DeleteExpired(app.config.idempotency.ttl)
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("purged expired idempotency keys", map[string]string{
+		"keys": strconv.FormatInt(deleted, 10),
+	})
+
+	return nil
+}
+
+// purgeTrashTask hard-deletes records that have been in the trash for longer
+// than the configured retention.
+func (app *application) purgeTrashTask(ctx context.Context) error {
+	purged, err := app.models.Trash.Purge(app.config.trash.retention)
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("purged trash", map[string]string{
+		"records": strconv.Itoa(purged),
+	})
+
+	return nil
+}
+
+// pruneOutboxTask deletes outbox events older than the configured retention
+// once every subscriber has handled them, and reports the subscribers that
+// have fallen further behind than that, as they keep the outbox growing.
+func (app *application) pruneOutboxTask(ctx context.Context) error {
+	deleted, err := app.models.Outbox.DeleteExpired(app.config.outbox.retention)
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("pruned outbox", map[string]string{
+		"events": strconv.Itoa(deleted),
+	})
+
+	stalled, err := app.models.Outbox.Stalled(app.config.outbox.retention)
+	if err != nil {
+		return err
+	}
+
+	for _, cursor := range stalled {
+		app.logger.PrintError(errOutboxSubscriberStalled, map[string]string{
+			"subscriber":     cursor.Subscriber,
+			"cursor_updated": cursor.UpdatedAt.UTC().Format(time.RFC3339),
+			"oldest_event":   cursor.Oldest.UTC().Format(time.RFC3339),
+		})
+	}
+
+	return nil
+}
+
+func (app *application) stockSnapshotTask(ctx context.Context) error {
+	_, err := app.models.Reports.Snapshot(time.Now())
+	return err
+}
+
+// lowStockTask emails the report recipients a list of the items running low.
+// Nothing is sent when no item is below the threshold.
+func (app *application) lowStockTask(ctx context.Context) error {
+	items, err := app.models.Reports.LowStock(app.config.cron.lowStockThreshold)
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	app.logger.PrintInfo("items below low stock threshold", map[string]string{
+		"items": strconv.Itoa(len(items)),
+	})
+
+	return app.emailReport("low_stock.tmpl", map[string]interface{}{
+		"items":     items,
+		"threshold": app.config.cron.lowStockThreshold,
+	})
+}
+
+func (app *application) stockReportTask(ctx context.Context) error {
+	warehouses, err := app.models.Reports.StockByWarehouse()
+	if err != nil {
+		return err
+	}
+
+	return app.emailReport("stock_report.tmpl", map[string]interface{}{
+		"warehouses": warehouses,
+		"date":       time.Now().Format("2006-01-02"),
+	})
+}
+
+// emailReport queues an email to every report recipient. The report goes
+// through JSON first, so templates see it by the field names the API uses.
+func (app *application) emailReport(template string, report map[string]interface{}) error {
+	js, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+
+	err = json.Unmarshal(js, &values)
+	if err != nil {
+		return err
+	}
+
+	for _, recipient := range app.config.cron.reportRecipients {
+		err = app.queueEmail(app.config.language, recipient, template, values)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type runTaskPayload struct {
+	Task   string `json:"task"`
+	UserID int64  `json:"user_id"`
+}
+
+func (app *application) runTaskJob(ctx context.Context, payload json.RawMessage) error {
+	var input runTaskPayload
+
+	err := json.Unmarshal(payload, &input)
+	if err != nil {
+		return err
+	}
+
+	return app.runTask(input.Task, data.TaskManual, time.Now(), input.UserID)
+}
+
+func (app *application) listTasksHandler(w http.ResponseWriter, r *http.Request) {
+	type task struct {
+		Name      string        `json:"name"`
+		Schedule  string        `json:"schedule"`
+		NextRunAt *time.Time    `json:"next_run_at"`
+		LastRun   *data.TaskRun `json:"last_run"`
+	}
+
+	lastRuns, err := app.models.Tasks.LastRuns()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tasks := []task{}
+
+	for name := range app.taskFuncs() {
+		t := task{Name: name, Schedule: "off", LastRun: lastRuns[name]}
+
+		if schedule, ok := app.config.cron.schedules[name]; ok {
+			t.Schedule = schedule.String()
+
+			if next := schedule.Next(time.Now()); !next.IsZero() {
+				t.NextRunAt = &next
+			}
+		}
+
+		tasks = append(tasks, t)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Name < tasks[j].Name
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tasks": tasks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) readTaskParam(r *http.Request) (string, error) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+
+	if _, ok := app.taskFuncs()[name]; !ok {
+		return "", errors.New("invalid task parameter")
+	}
+
+	return name, nil
+}
+
+func (app *application) listTaskRunsHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := app.readTaskParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.TaskRunFilterSafelist
+
+	input.Filters.Sort = app.readString(qs, "sort", "-started_at")
+	input.Filters.SortSafelist = data.TaskRunSortSafelist
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	runs, metadata, err := app.models.Tasks.GetAll(name, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"runs": runs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runTaskHandler queues a manual run of a task. It goes through the job queue
+// so that it is retried if another instance is running the task right now.
+func (app *application) runTaskHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := app.readTaskParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.enqueue(jobRunTask, runTaskPayload{Task: name, UserID: app.contextGetUser(r).ID})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "task run queued"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
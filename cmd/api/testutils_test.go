@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"testing"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/jsonlog"
+)
+
+// newTestApplication returns an application that logs nothing and has no
+// database, for testing code that does not need one.
+func newTestApplication(t *testing.T) *application {
+	return &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+	}
+}
+
+// newTestDB connects to the database named by GREENLIGHT_TEST_DB_DSN, skipping
+// the test if it is not set. The database must be a disposable one with every
+// migration applied; tests add their own rows and remove them afterwards.
+func newTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// newTestDBApplication is newTestApplication with the models of newTestDB.
+func newTestDBApplication(t *testing.T) *application {
+	app := newTestApplication(t)
+	app.models = data.NewModels(newTestDB(t))
+
+	return app
+}
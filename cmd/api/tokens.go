@@ -3,12 +3,115 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/tomasen/realip"
 )
 
+// accessClaims are the claims of an access token. They carry what the
+// middleware needs to know about the user, so that a request made with an
+// access token does not have to look the user up.
+type accessClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Session   int64  `json:"sid"`
+	Activated bool   `json:"act"`
+	Language  string `json:"lang,omitempty"`
+}
+
+// newAccessToken returns a signed access token for user in session. Access
+// tokens are not stored, but authenticate refuses those of the sessions this
+// instance has ended, so signing out revokes them here before they expire.
+func (app *application) newAccessToken(user *data.User, session *data.Session) (*data.Token, error) {
+	now := time.Now()
+
+	token := &data.Token{
+		UserID: user.ID,
+		Expiry: now.Add(app.config.tokens.accessTTL),
+		Scope:  data.ScopeAuthentication,
+	}
+
+	claims := accessClaims{
+		Subject:   strconv.FormatInt(user.ID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: token.Expiry.Unix(),
+		Session:   session.ID,
+		Activated: user.Activated,
+		Language:  user.Language,
+	}
+
+	var err error
+
+	token.Plaintext, err = app.keys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// userForAccessToken returns the user an access token was issued to, made
+// from the token's claims, and the ID of its session.
+func (app *application) userForAccessToken(plaintext string) (*data.User, int64, error) {
+	var claims accessClaims
+
+	err := app.keys.Verify(plaintext, time.Now(), &claims)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, 0, errors.New("invalid access token subject")
+	}
+
+	if claims.Session < 1 {
+		return nil, 0, errors.New("invalid access token session")
+	}
+
+	user := &data.User{
+		ID:        id,
+		Activated: claims.Activated,
+		Language:  claims.Language,
+	}
+
+	return user, claims.Session, nil
+}
+
+// writeTokens issues user an access token and a refresh token in session and
+// writes them as the response, along with anything in env.
+func (app *application) writeTokens(w http.ResponseWriter, r *http.Request, status int, user *data.User, session *data.Session, env envelope) {
+	access, err := app.newAccessToken(user, session)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refresh, err := app.models.Tokens.NewRefresh(user.ID, app.config.tokens.refreshTTL, session.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if env == nil {
+		env = envelope{}
+	}
+
+	env["authentication_token"] = access
+	env["refresh_token"] = refresh
+
+	err = app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
@@ -32,34 +135,159 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	user, err := app.models.Users.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	match, err := user.Password.Matches(input.Password)
+	wait, err := app.signInWait(r, user)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if wait > 0 {
+		app.tooManySignInAttemptsResponse(w, r, wait)
+		return
+	}
+
+	match := false
+
+	if user != nil {
+		match, err = user.Password.Matches(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	if !match {
+		err = app.recordFailedSignIn(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if app.twoFactorChallenge(w, r, user) {
+		return
+	}
+
+	// Failures are only forgotten once the user is fully signed in, so that
+	// wrong two-factor codes keep counting after a right password.
+	err = app.models.Lockouts.ResetUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	session := &data.Session{
+		UserID:    user.ID,
+		IP:        realip.FromRequest(r),
+		UserAgent: userAgent(r),
+	}
+
+	err = app.models.Sessions.Insert(session)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	app.writeTokens(w, r, http.StatusCreated, user, session, nil)
+}
+
+// refreshTokenHandler trades a refresh token for a new access token and a new
+// refresh token.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.UseRefresh(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			if token.Session != 0 {
+				app.endSessions(token.Session)
+			}
+
+			app.logger.PrintInfo("refresh token reused, sign in revoked", map[string]string{
+				"user_id": strconv.FormatInt(token.UserID, 10),
+			})
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	session, err := app.models.Sessions.Touch(token.Family, realip.FromRequest(r), userAgent(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeTokens(w, r, http.StatusCreated, user, session, nil)
+}
+
+// deleteAuthenticationTokenHandler signs out, ending the session of the
+// access token the request is made with.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	session := app.contextGetSession(r)
+
+	if session != 0 {
+		err := app.models.Sessions.Delete(session, app.contextGetUser(r).ID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.endSessions(session)
+	} else {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		err := app.models.Tokens.Delete(data.ScopeAuthentication, token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "you have been signed out"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -87,7 +315,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
+			v.AddError("email", validator.EmailNotFound)
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -96,7 +324,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	}
 
 	if !user.Activated {
-		v.AddError("email", "user account must be activated")
+		v.AddError("email", validator.AccountInactive)
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -107,16 +335,13 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	app.background(func() {
-		data := map[string]interface{}{
-			"passwordResetToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
+	err = app.queueEmail(app.userLanguage(r, user), user.Email, "token_password_reset.tmpl", map[string]interface{}{
+		"passwordResetToken": token.Plaintext,
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
 
@@ -148,7 +373,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
+			v.AddError("email", validator.EmailNotFound)
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -157,7 +382,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	if user.Activated {
-		v.AddError("email", "user has already been activated")
+		v.AddError("email", validator.AlreadyActivated)
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -168,16 +393,13 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
+	err = app.queueEmail(app.userLanguage(r, user), user.Email, "token_activation.tmpl", map[string]interface{}{
+		"activationToken": token.Plaintext,
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	env := envelope{"message": "an email will be sent to you containing activation instructions"}
 
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/totp"
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/tomasen/realip"
+)
+
+// twoFactorChallenge is called once a user's password, or their sign in
+// through the identity provider, has been checked. If the user has a second
+// factor, or a role that requires one, it writes a short-lived two-factor
+// token as the response, to be traded for the real tokens together with a
+// code, and reports true.
+func (app *application) twoFactorChallenge(w http.ResponseWriter, r *http.Request, user *data.User) bool {
+	t, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return true
+	}
+
+	enrolled := t.Confirmed()
+
+	if !enrolled {
+		required, err := app.models.Roles.RequireTwoFactor(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return true
+		}
+
+		if !required {
+			return false
+		}
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTwoFactor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return true
+	}
+
+	env := envelope{"two_factor_token": token, "enrolment_required": !enrolled}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	return true
+}
+
+// enrolTwoFactor gives user a new authenticator secret and writes it as the
+// response, along with the URI to show as a QR code.
+func (app *application) enrolTwoFactor(w http.ResponseWriter, r *http.Request, user *data.User) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sealed, err := app.totpKeys.Seal(secret, totpContext(user.ID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Enrol(user.ID, sealed)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			v := validator.New()
+			v.AddError("two_factor", validator.AlreadyEnabled)
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.URI(app.config.tokens.totpIssuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// totpContext binds a user's sealed authenticator secret to them, so that it
+// cannot be opened if copied to another user.
+func totpContext(userID int64) []byte {
+	return []byte("totp:" + strconv.FormatInt(userID, 10))
+}
+
+// checkSecondFactor checks code against the user's authenticator t, or if
+// code is empty, spends recoveryCode. Recovery codes only work once t has
+// been confirmed.
+func (app *application) checkSecondFactor(t *data.TOTP, code, recoveryCode string) (bool, error) {
+	if t == nil {
+		return false, nil
+	}
+
+	if code == "" {
+		if !t.Confirmed() || recoveryCode == "" {
+			return false, nil
+		}
+
+		return app.models.TwoFactor.UseRecoveryCode(t.UserID, recoveryCode)
+	}
+
+	secret, err := app.totpKeys.Open(t.Secret, totpContext(t.UserID))
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.TwoFactor.UseStep(t.UserID, step)
+}
+
+// getTOTP returns the user's authenticator, or nil if they have none.
+func (app *application) getTOTP(userID int64) (*data.TOTP, error) {
+	t, err := app.models.TwoFactor.Get(userID)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil, nil
+	}
+
+	return t, err
+}
+
+// createTwoFactorTokenHandler finishes a sign in started with a password,
+// trading the two-factor token and a code from the user's authenticator, or
+// one of their recovery codes, for the real tokens. A user who enrolled
+// during sign in confirms their authenticator this way, and is given their
+// recovery codes.
+func (app *application) createTwoFactorTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TwoFactorToken string `json:"two_factor_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TwoFactorToken)
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", validator.Required)
+	v.Check(input.Code == "" || input.RecoveryCode == "", "code", validator.Exclusive, "recovery_code")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactor, input.TwoFactorToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("two_factor_token", validator.InvalidToken)
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	wait, err := app.signInWait(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		app.tooManySignInAttemptsResponse(w, r, wait)
+		return
+	}
+
+	t, err := app.getTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.checkSecondFactor(t, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		// A two-factor token allows a handful of tries, so that codes
+		// cannot be guessed by brute force, and each one also counts
+		// towards locking the user out.
+		err = app.models.Tokens.RecordFailure(data.ScopeTwoFactor, input.TwoFactorToken, 5)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.recordFailedSignIn(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		v.AddError("code", validator.InvalidToken)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Tokens.Delete(data.ScopeTwoFactor, input.TwoFactorToken)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Lockouts.ResetUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var env envelope
+
+	if !t.Confirmed() {
+		codes, err := data.NewRecoveryCodes()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.TwoFactor.Confirm(user.ID, codes)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env = envelope{"recovery_codes": codes}
+	}
+
+	session := &data.Session{
+		UserID:    user.ID,
+		IP:        realip.FromRequest(r),
+		UserAgent: userAgent(r),
+	}
+
+	err = app.models.Sessions.Insert(session)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeTokens(w, r, http.StatusCreated, user, session, env)
+}
+
+// createTwoFactorEnrolmentHandler lets a user whose role requires a second
+// factor, but who has none, set one up during sign in with their two-factor
+// token.
+func (app *application) createTwoFactorEnrolmentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TwoFactorToken string `json:"two_factor_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TwoFactorToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactor, input.TwoFactorToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("two_factor_token", validator.InvalidToken)
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.enrolTwoFactor(w, r, user)
+}
+
+// enrolTwoFactorHandler starts setting up an authenticator for the signed in
+// user, which confirmTwoFactorHandler finishes.
+func (app *application) enrolTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.enrolTwoFactor(w, r, user)
+}
+
+// readTwoFactorCode reads the code from the request body and checks it
+// against the signed in user's confirmed authenticator, or any authenticator
+// if unconfirmed is true. It writes the response if the code is not right.
+func (app *application) readTwoFactorCode(w http.ResponseWriter, r *http.Request, unconfirmed bool) (*data.TOTP, bool) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Code != "", "code", validator.Required); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	t, err := app.getTOTP(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if t == nil || t.Confirmed() == unconfirmed {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	ok, err := app.checkSecondFactor(t, input.Code, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if !ok {
+		v.AddError("code", validator.InvalidToken)
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return t, true
+}
+
+// confirmTwoFactorHandler turns on the authenticator the signed in user has
+// just set up, once they show a code from it, and returns their recovery
+// codes. They are only ever shown here.
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := app.readTwoFactorCode(w, r, true)
+	if !ok {
+		return
+	}
+
+	codes, err := data.NewRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Confirm(t.UserID, codes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// regenerateRecoveryCodesHandler replaces the signed in user's recovery codes,
+// such as when they have used most of them.
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := app.readTwoFactorCode(w, r, false)
+	if !ok {
+		return
+	}
+
+	codes, err := data.NewRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.SetRecoveryCodes(t.UserID, codes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTwoFactorHandler turns off the signed in user's second factor. It is
+// refused while one of their roles requires it.
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := app.readTwoFactorCode(w, r, false)
+	if !ok {
+		return
+	}
+
+	required, err := app.models.Roles.RequireTwoFactor(t.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if required {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	err = app.models.TwoFactor.Delete(t.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
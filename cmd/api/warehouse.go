@@ -45,9 +45,14 @@ func (app *application) createWarehouseHandler(w http.ResponseWriter, r *http.Re
 	// // 	return
 	// // }
 
-	err = app.models.Warehouse.Insert(usaha)
+	err = app.scoped(r).Warehouse.Insert(usaha, app.actor(r))
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrOutOfScope):
+			app.outOfScopeResponse(w, r, "perusahaan_id")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -67,7 +72,16 @@ func (app *application) showWarehouseHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	usaha, err := app.models.Warehouse.Get(id)
+	v := validator.New()
+
+	projection := app.readProjection(r.URL.Query(), data.WarehouseFieldSafelist, data.WarehouseRelations)
+
+	if data.ValidateProjection(v, projection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	usaha, err := app.scoped(r).Warehouse.GetWith(id, projection)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -78,7 +92,13 @@ func (app *application) showWarehouseHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	projected, err := app.project(usaha, projection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": projected}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -91,7 +111,7 @@ func (app *application) updateWarehouseHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	usaha, err := app.models.Warehouse.Get(id)
+	usaha, err := app.scoped(r).Warehouse.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -102,6 +122,10 @@ func (app *application) updateWarehouseHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
 
 	// var input struct {
 	// 	Name   		*string     `json:"name"`
@@ -176,18 +200,20 @@ func (app *application) updateWarehouseHandler(w http.ResponseWriter, r *http.Re
 	// 	return
 	// }
 
-	err = app.models.Warehouse.Update(usaha)
+	err = app.scoped(r).Warehouse.Update(usaha, app.actor(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrOutOfScope):
+			app.outOfScopeResponse(w, r, "perusahaan_id")
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"usaha": usaha}, nil)
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": usaha}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -200,7 +226,7 @@ func (app *application) deleteWarehouseHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.models.Warehouse.Delete(id)
+	usaha, err := app.scoped(r).Warehouse.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -211,12 +237,59 @@ func (app *application) deleteWarehouseHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	if !app.ifMatch(w, r, usaha.Version) {
+		return
+	}
+
+	err = app.scoped(r).Warehouse.Delete(id, usaha.Version, app.actor(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "Warehouse successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+func (app *application) restoreWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.scoped(r).Warehouse.Restore(id, app.actor(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	usaha, err := app.scoped(r).Warehouse.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeRecord(w, r, http.StatusOK, usaha.Version, envelope{"usaha": usaha}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) listWarehouseHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Name  string
@@ -237,9 +310,14 @@ func (app *application) listWarehouseHandler(w http.ResponseWriter, r *http.Requ
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.WarehouseFilterSafelist
+	input.Filters.Projection = app.readProjection(qs, data.WarehouseFieldSafelist, data.WarehouseRelations)
 
-	input.Filters.Sort = app.readString(qs, "sort", "rn")
-	input.Filters.SortSafelist = []string{"rn", "name","-rn", "-name"}
+	input.Filters.Sort = app.readString(qs, "sort", "created_at")
+	input.Filters.SortSafelist = data.WarehouseSortSafelist
 
 	// input.Filters.Sort = app.readString(qs, "sort", "rn")
 	// input.Filters.SortSafelist = []string{"id", "name","-id", "-name"}
@@ -249,15 +327,26 @@ func (app *application) listWarehouseHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	usahas, metadata, err := app.models.Warehouse.GetAll(input.Name,input.Alamat, input.Filters)
+	usahas, metadata, err := app.scoped(r).Warehouse.GetAll(input.Name,input.Alamat, input.Filters)
 	if err != nil {
 		fmt.Println("sampai-err")
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+
+	projected, err := app.project(usahas, input.Filters.Projection)
+	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	
-	err = app.writeJSON(w, http.StatusOK, envelope{"warehouse": usahas, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"warehouse": projected, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/netguard"
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Secret: input.Secret,
+		Events: input.Events,
+		Active: true,
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	// Generate a secret if the client did not bring its own. This response is
+	// the only place it is ever shown.
+	if webhook.Secret == "" {
+		b := make([]byte, 32)
+
+		_, err = rand.Read(b)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		webhook.Secret = hex.EncodeToString(b)
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); v.Valid() {
+		app.checkWebhookHost(r, v, webhook)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook, app.actor(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	webhook.Secret = ""
+
+	err = app.writeRecord(w, r, http.StatusOK, webhook.Version, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(w, r, webhook.Version) {
+		return
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); v.Valid() {
+		app.checkWebhookHost(r, v, webhook)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	webhook.Secret = ""
+
+	err = app.writeRecord(w, r, http.StatusOK, webhook.Version, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(w, r, webhook.Version) {
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id, webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.WebhookFilterSafelist
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = data.WebhookSortSafelist
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhooks, metadata, err := app.models.Webhooks.GetAll(input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.Count = app.readBool(qs, "count", true, v)
+	input.Filters.Conditions = app.readConditions(qs, v)
+	input.Filters.FilterSafelist = data.DeliveryFilterSafelist
+
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = data.DeliverySortSafelist
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(id, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor), errors.Is(err, data.ErrInvalidFilter):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) readDeliveryParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("delivery_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid delivery_id parameter")
+	}
+
+	return id, nil
+}
+
+func (app *application) showWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	deliveryID, err := app.readDeliveryParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	delivery, err := app.models.Webhooks.GetDelivery(id, deliveryID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	deliveryID, err := app.readDeliveryParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Redeliver(id, deliveryID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "delivery queued for redelivery"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// signWebhook returns the X-Webhook-Signature header for body. Receivers
+// recompute the HMAC-SHA256 of "<t>.<body>" with their secret, compare it to
+// v1 and reject timestamps that are too old to stop replays.
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%d,v1=%s", timestamp.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+// retryBackoff returns how long to wait before retrying work that has failed
+// attempts times: the base delay doubled for each failure, capped at six
+// hours.
+func retryBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+
+	for i := 1; i < attempts && backoff < 6*time.Hour; i++ {
+		backoff *= 2
+	}
+
+	if backoff > 6*time.Hour {
+		backoff = 6 * time.Hour
+	}
+
+	return backoff
+}
+
+// checkWebhookHost rejects a webhook whose receiver is on a private, loopback
+// or link-local address, such as a cloud metadata endpoint, unless they are
+// allowed with -webhook-allow-private. The sender checks the address again
+// when it connects, in case the name has since been pointed elsewhere.
+func (app *application) checkWebhookHost(r *http.Request, v *validator.Validator, webhook *data.Webhook) {
+	if app.config.webhooks.allowPrivate {
+		return
+	}
+
+	u, err := url.Parse(webhook.URL)
+	if err != nil {
+		return
+	}
+
+	err = netguard.CheckHost(r.Context(), u.Hostname())
+	switch {
+	case errors.Is(err, netguard.ErrNotPublic):
+		v.AddError("url", validator.PrivateAddress)
+	case err != nil:
+		v.AddError("url", validator.UnknownHost)
+	}
+}
+
+// deliverWebhooks sends due webhook deliveries until ctx is cancelled,
+// finishing the deliveries it has claimed first. It polls the queue, so
+// deliveries survive restarts and several API instances can share the work.
+func (app *application) deliverWebhooks(ctx context.Context) {
+	client := netguard.Client(app.config.webhooks.timeout)
+	if app.config.webhooks.allowPrivate {
+		client = &http.Client{Timeout: app.config.webhooks.timeout, CheckRedirect: netguard.NoRedirects}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		deliveries, err := app.models.Webhooks.Claim(20, 2*app.config.webhooks.timeout)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		var wg sync.WaitGroup
+
+		for _, delivery := range deliveries {
+			wg.Add(1)
+
+			go func(delivery *data.WebhookDelivery) {
+				defer wg.Done()
+				app.deliverWebhook(client, delivery)
+			}(delivery)
+		}
+
+		wg.Wait()
+
+		if len(deliveries) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(app.config.webhooks.interval):
+			}
+		}
+	}
+}
+
+// sendWebhook makes one attempt to send delivery. It returns the attempt, the
+// status the delivery moves to and, if it is still pending, when it is next
+// due.
+func (app *application) sendWebhook(client *http.Client, delivery *data.WebhookDelivery) (*data.WebhookAttempt, string, time.Time) {
+	attempt := &data.WebhookAttempt{DeliveryID: delivery.ID}
+
+	start := time.Now()
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "greenlight-webhooks/"+version)
+		req.Header.Set("X-Webhook-ID", strconv.FormatInt(delivery.ID, 10))
+		req.Header.Set("X-Webhook-Event", delivery.Event)
+		req.Header.Set("X-Webhook-Signature", signWebhook(delivery.Secret, start, delivery.Payload))
+
+		var res *http.Response
+
+		res, err = client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+			res.Body.Close()
+
+			attempt.StatusCode = res.StatusCode
+		}
+	}
+
+	attempt.DurationMS = time.Since(start).Milliseconds()
+
+	status := data.DeliverySucceeded
+	next := time.Now()
+
+	if err != nil || attempt.StatusCode < 200 || attempt.StatusCode > 299 {
+		if err != nil {
+			attempt.Error = err.Error()
+		} else {
+			attempt.Error = fmt.Sprintf("receiver responded with status %d", attempt.StatusCode)
+		}
+
+		status = data.DeliveryPending
+		next = next.Add(retryBackoff(app.config.webhooks.backoff, delivery.Attempts+1))
+
+		if delivery.Attempts+1 >= app.config.webhooks.maxAttempts {
+			status = data.DeliveryFailed
+		}
+	}
+
+	return attempt, status, next
+}
+
+func (app *application) deliverWebhook(client *http.Client, delivery *data.WebhookDelivery) {
+	attempt, status, next := app.sendWebhook(client, delivery)
+
+	err := app.models.Webhooks.RecordAttempt(attempt, status, next)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"webhook_delivery": strconv.FormatInt(delivery.ID, 10),
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/netguard"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// verifyWebhook checks header as a receiver would, returning the timestamp
+// it was signed at.
+func verifyWebhook(t *testing.T, secret, header string, body []byte) time.Time {
+	t.Helper()
+
+	parts := strings.Split(header, ",")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "t=") || !strings.HasPrefix(parts[1], "v1=") {
+		t.Fatalf("malformed signature header %q", header)
+	}
+
+	timestamp, err := strconv.ParseInt(strings.TrimPrefix(parts[0], "t="), 10, 64)
+	if err != nil {
+		t.Fatalf("malformed timestamp in %q", header)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	got, err := hex.DecodeString(strings.TrimPrefix(parts[1], "v1="))
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		t.Fatalf("signature %q does not match body", header)
+	}
+
+	return time.Unix(timestamp, 0)
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"stok.updated"}`)
+	at := time.Unix(1700000000, 0)
+
+	header := signWebhook("0123456789abcdef", at, body)
+
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Fatalf("got %q", header)
+	}
+
+	if got := verifyWebhook(t, "0123456789abcdef", header, body); !got.Equal(at) {
+		t.Errorf("signed at %v, want %v", got, at)
+	}
+
+	if signWebhook("another-secret!!", at, body) == header {
+		t.Error("signature does not depend on the secret")
+	}
+
+	if signWebhook("0123456789abcdef", at, []byte(`{}`)) == header {
+		t.Error("signature does not depend on the body")
+	}
+
+	if signWebhook("0123456789abcdef", at.Add(time.Second), body) == header {
+		t.Error("signature does not depend on the timestamp")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{6, 16 * time.Minute},
+		{20, 6 * time.Hour},
+		{1000, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := retryBackoff(30*time.Second, tt.attempts); got != tt.want {
+			t.Errorf("retryBackoff(30s, %d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	const secret = "0123456789abcdef"
+
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	status := http.StatusNoContent
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		received = append(received, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	app := newTestApplication(t)
+	app.config.webhooks.backoff = 30 * time.Second
+	app.config.webhooks.maxAttempts = 3
+
+	delivery := &data.WebhookDelivery{
+		ID:      42,
+		Event:   "stok.quantity_changed",
+		Payload: []byte(`{"id":7,"event":"stok.quantity_changed"}`),
+		URL:     receiver.URL,
+		Secret:  secret,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		attempt, got, _ := app.sendWebhook(receiver.Client(), delivery)
+
+		if got != data.DeliverySucceeded {
+			t.Fatalf("status %q, want %q (error %q)", got, data.DeliverySucceeded, attempt.Error)
+		}
+
+		if attempt.DeliveryID != 42 || attempt.StatusCode != http.StatusNoContent || attempt.Error != "" {
+			t.Errorf("unexpected attempt %+v", attempt)
+		}
+
+		mu.Lock()
+		r, body := received[len(received)-1], bodies[len(bodies)-1]
+		mu.Unlock()
+
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		if r.Header.Get("X-Webhook-ID") != "42" || r.Header.Get("X-Webhook-Event") != "stok.quantity_changed" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+
+		if string(body) != string(delivery.Payload) {
+			t.Errorf("body %s, want %s", body, delivery.Payload)
+		}
+
+		signedAt := verifyWebhook(t, secret, r.Header.Get("X-Webhook-Signature"), body)
+		if time.Since(signedAt) > time.Minute {
+			t.Errorf("signed at %v, long before it was sent", signedAt)
+		}
+	})
+
+	t.Run("retry on error status", func(t *testing.T) {
+		mu.Lock()
+		status = http.StatusInternalServerError
+		mu.Unlock()
+
+		for attempts, want := range map[int]time.Duration{0: 30 * time.Second, 1: time.Minute} {
+			d := *delivery
+			d.Attempts = attempts
+
+			before := time.Now()
+			attempt, got, next := app.sendWebhook(receiver.Client(), &d)
+
+			if got != data.DeliveryPending {
+				t.Fatalf("after %d attempts: status %q, want %q", attempts, got, data.DeliveryPending)
+			}
+
+			if attempt.StatusCode != http.StatusInternalServerError || attempt.Error == "" {
+				t.Errorf("unexpected attempt %+v", attempt)
+			}
+
+			if delay := next.Sub(before); delay < want || delay > want+5*time.Second {
+				t.Errorf("after %d attempts: retried in %v, want %v", attempts, delay, want)
+			}
+		}
+	})
+
+	t.Run("give up after max attempts", func(t *testing.T) {
+		d := *delivery
+		d.Attempts = app.config.webhooks.maxAttempts - 1
+
+		_, got, _ := app.sendWebhook(receiver.Client(), &d)
+		if got != data.DeliveryFailed {
+			t.Errorf("status %q, want %q", got, data.DeliveryFailed)
+		}
+	})
+
+	t.Run("unreachable receiver", func(t *testing.T) {
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+
+		d := *delivery
+		d.URL = closed.URL
+
+		attempt, got, _ := app.sendWebhook(closed.Client(), &d)
+		if got != data.DeliveryPending || attempt.StatusCode != 0 || attempt.Error == "" {
+			t.Errorf("status %q, attempt %+v", got, attempt)
+		}
+	})
+}
+
+func TestCheckWebhookHost(t *testing.T) {
+	app := newTestApplication(t)
+	r := httptest.NewRequest(http.MethodPost, "/v1/webhooks", nil)
+
+	for _, receiver := range []string{"http://127.0.0.1:8080/hook", "http://169.254.169.254/latest/meta-data", "https://[::1]/hook", "http://10.1.2.3/hook"} {
+		v := validator.New()
+
+		app.checkWebhookHost(r, v, &data.Webhook{URL: receiver})
+
+		if v.Errors["url"].Code != validator.PrivateAddress {
+			t.Errorf("%s: got errors %v, want %s", receiver, v.Errors, validator.PrivateAddress)
+		}
+	}
+
+	app.config.webhooks.allowPrivate = true
+
+	v := validator.New()
+
+	if app.checkWebhookHost(r, v, &data.Webhook{URL: "http://127.0.0.1:8080/hook"}); !v.Valid() {
+		t.Errorf("allowed private address: got errors %v", v.Errors)
+	}
+}
+
+func TestSendWebhookPrivateAddress(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook was sent to a loopback address")
+	}))
+	defer receiver.Close()
+
+	app := newTestApplication(t)
+	app.config.webhooks.backoff = 30 * time.Second
+	app.config.webhooks.maxAttempts = 3
+
+	delivery := &data.WebhookDelivery{ID: 1, Event: "stok.quantity_changed", Payload: []byte(`{}`), URL: receiver.URL, Secret: "0123456789abcdef"}
+
+	attempt, status, _ := app.sendWebhook(netguard.Client(time.Second), delivery)
+
+	if status != data.DeliveryPending || !strings.Contains(attempt.Error, "not public") {
+		t.Errorf("got status %q, error %q", status, attempt.Error)
+	}
+}
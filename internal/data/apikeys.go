@@ -0,0 +1,458 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// APIKeyPrefix starts every API key, which tells them apart from
+// authentication tokens in the Authorization header.
+const APIKeyPrefix = "glk_"
+
+// APIKey lets a machine client such as a barcode scanner call the API without
+// a person's password. A key acts as the user who created it but holds its own
+// permissions, optionally limited to one warehouse or to the warehouses of one
+// perusahaan, and may only be used from AllowedIPs when that is not empty.
+type APIKey struct {
+	ID           int64       `json:"id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Name         string      `json:"name"`
+	Prefix       string      `json:"prefix"`
+	UserID       int64       `json:"user_id"`
+	Permissions  Permissions `json:"permissions"`
+	AllowedIPs   []string    `json:"allowed_ips"`
+	WarehouseID  *int64      `json:"warehouse_id"`
+	PerusahaanID *int64      `json:"perusahaan_id"`
+	LastUsedAt   *time.Time  `json:"last_used_at"`
+	LastUsedIP   *string     `json:"last_used_ip"`
+	RotatedAt    *time.Time  `json:"rotated_at"`
+	RevokedAt    *time.Time  `json:"revoked_at"`
+	Version      int32       `json:"version"`
+	Plaintext    string      `json:"-"`
+	hash         []byte
+}
+
+// generate gives the key a new secret. The plaintext is only ever known here,
+// so it must be handed to the client straight away.
+func (k *APIKey) generate() error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	k.Plaintext = APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	k.Prefix = k.Plaintext[:len(APIKeyPrefix)+8]
+
+	hash := sha256.Sum256([]byte(k.Plaintext))
+	k.hash = hash[:]
+
+	return nil
+}
+
+// AllowsIP reports whether the key may be used from ip.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, allowed := range k.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if other := net.ParseIP(allowed); other != nil && other.Equal(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateAPIKey checks key against known, the codes of every permission.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, known Permissions) {
+	v.Check(key.Name != "", "name", validator.Required)
+	v.Check(len(key.Name) <= 100, "name", validator.MaxLength, 100)
+
+	v.Check(validator.Unique(key.Permissions), "permissions", validator.Duplicate)
+
+	for _, code := range key.Permissions {
+		v.Check(known.Include(code), "permissions", validator.UnknownPermission, code)
+	}
+
+	v.Check(len(key.AllowedIPs) <= 50, "allowed_ips", validator.MaxItems, 50)
+
+	for _, allowed := range key.AllowedIPs {
+		_, _, err := net.ParseCIDR(allowed)
+		v.Check(err == nil || net.ParseIP(allowed) != nil, "allowed_ips", validator.InvalidIP, allowed)
+	}
+
+	v.Check(key.WarehouseID == nil || *key.WarehouseID > 0, "warehouse_id", validator.Positive)
+	v.Check(key.PerusahaanID == nil || *key.PerusahaanID > 0, "perusahaan_id", validator.Positive)
+	v.Check(key.WarehouseID == nil || key.PerusahaanID == nil, "warehouse_id", validator.Exclusive, "perusahaan_id")
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+func (m APIKeyModel) setPermissions(ctx context.Context, tx *sql.Tx, key *APIKey) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM api_keys_permissions WHERE api_key_id = $1`, key.ID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO api_keys_permissions (api_key_id, permission_id)
+		SELECT $1, id FROM permissions WHERE code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, key.ID, pq.Array([]string(key.Permissions)))
+	return err
+}
+
+// apiKeyError maps a missing warehouse or perusahaan to ErrRecordNotFound.
+func apiKeyError(err error) error {
+	var pqErr *pq.Error
+
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrRecordNotFound
+	}
+
+	return err
+}
+
+// Insert saves a new key with a freshly generated secret, which is left in
+// key.Plaintext.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	err := key.generate()
+	if err != nil {
+		return err
+	}
+
+	err = withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			INSERT INTO api_keys (name, prefix, hash, user_id, allowed_ips, warehouse_id, perusahaan_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id, created_at, version`
+
+		args := []interface{}{key.Name, key.Prefix, key.hash, key.UserID, pq.Array(key.AllowedIPs), key.WarehouseID, key.PerusahaanID}
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt, &key.Version)
+		if err != nil {
+			return err
+		}
+
+		return m.setPermissions(ctx, tx, key)
+	})
+
+	return apiKeyError(err)
+}
+
+const apiKeyFields = `
+	api_keys.id, api_keys.created_at, api_keys.name, api_keys.prefix, api_keys.user_id,
+	array(SELECT p.code FROM permissions p INNER JOIN api_keys_permissions kp ON kp.permission_id = p.id
+		WHERE kp.api_key_id = api_keys.id ORDER BY p.code),
+	api_keys.allowed_ips, api_keys.warehouse_id, api_keys.perusahaan_id,
+	api_keys.last_used_at, api_keys.last_used_ip, api_keys.rotated_at, api_keys.revoked_at,
+	api_keys.version`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var key APIKey
+
+	err := row.Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		&key.UserID,
+		pq.Array((*[]string)(&key.Permissions)),
+		pq.Array(&key.AllowedIPs),
+		&key.WarehouseID,
+		&key.PerusahaanID,
+		&key.LastUsedAt,
+		&key.LastUsedIP,
+		&key.RotatedAt,
+		&key.RevokedAt,
+		&key.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (m APIKeyModel) Get(id int64) (*APIKey, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + apiKeyFields + ` FROM api_keys WHERE api_keys.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	key, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+
+	return key, err
+}
+
+// GetForKey returns the unrevoked key with the given plaintext. After a
+// rotation the old plaintext keeps working until its grace period ends.
+func (m APIKeyModel) GetForKey(plaintext string) (*APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT ` + apiKeyFields + `
+		FROM api_keys
+		WHERE (api_keys.hash = $1 OR (api_keys.previous_hash = $1 AND api_keys.previous_expiry > now()))
+		AND api_keys.revoked_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	key, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, hash[:]))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+
+	return key, err
+}
+
+var apiKeyColumns = map[string]string{
+	"id":            "api_keys.id",
+	"created_at":    "api_keys.created_at",
+	"name":          "api_keys.name",
+	"prefix":        "api_keys.prefix",
+	"user_id":       "api_keys.user_id",
+	"warehouse_id":  "api_keys.warehouse_id",
+	"perusahaan_id": "api_keys.perusahaan_id",
+	"last_used_at":  "api_keys.last_used_at",
+	"rotated_at":    "api_keys.rotated_at",
+	"revoked_at":    "api_keys.revoked_at",
+}
+
+var (
+	APIKeyFilterSafelist = safelist(apiKeyColumns)
+	APIKeySortSafelist   = sortSafelist(apiKeyColumns)
+)
+
+// GetAll returns a page of keys, revoked ones included, limited to those of
+// one user unless userID is 0.
+func (m APIKeyModel) GetAll(userID int64, filters Filters) ([]*APIKey, Metadata, error) {
+	q := listQuery{
+		columns: apiKeyFields,
+		from:    `api_keys`,
+		order:   filters.sortKeys(apiKeyColumns, "api_keys.id"),
+	}
+
+	if userID != 0 {
+		q.filter("api_keys.user_id = " + q.arg(userID))
+	}
+
+	q.conditions(filters.Conditions, apiKeyColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	apiKeys := []*APIKey{}
+	keys := []string{}
+
+	for rows.Next() {
+		var apiKey APIKey
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&apiKey.ID,
+			&apiKey.CreatedAt,
+			&apiKey.Name,
+			&apiKey.Prefix,
+			&apiKey.UserID,
+			pq.Array((*[]string)(&apiKey.Permissions)),
+			pq.Array(&apiKey.AllowedIPs),
+			&apiKey.WarehouseID,
+			&apiKey.PerusahaanID,
+			&apiKey.LastUsedAt,
+			&apiKey.LastUsedIP,
+			&apiKey.RotatedAt,
+			&apiKey.RevokedAt,
+			&apiKey.Version,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		apiKeys = append(apiKeys, &apiKey)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&apiKeys, keys, totalRecords)
+
+	return apiKeys, metadata, nil
+}
+
+// Update saves the name, permissions, IP allowlist and warehouse limit of a
+// key that has not been revoked.
+func (m APIKeyModel) Update(key *APIKey) error {
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			UPDATE api_keys
+			SET name = $1, allowed_ips = $2, warehouse_id = $3, perusahaan_id = $4, version = version + 1
+			WHERE id = $5 AND version = $6 AND revoked_at IS NULL
+			RETURNING version`
+
+		args := []interface{}{key.Name, pq.Array(key.AllowedIPs), key.WarehouseID, key.PerusahaanID, key.ID, key.Version}
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&key.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return m.setPermissions(ctx, tx, key)
+	})
+
+	return apiKeyError(err)
+}
+
+// Rotate gives a key a new secret, left in key.Plaintext. The old secret
+// keeps working for grace, so clients can be moved over without downtime.
+func (m APIKeyModel) Rotate(key *APIKey, grace time.Duration) error {
+	err := key.generate()
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE api_keys
+		SET previous_hash = CASE WHEN $3::integer > 0 THEN hash END,
+			previous_expiry = CASE WHEN $3::integer > 0 THEN now() + make_interval(secs => $3::integer) END,
+			hash = $1, prefix = $2, rotated_at = now(), version = version + 1
+		WHERE id = $4 AND version = $5 AND revoked_at IS NULL
+		RETURNING rotated_at, version`
+
+	args := []interface{}{key.hash, key.Prefix, int(grace.Seconds()), key.ID, key.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&key.RotatedAt, &key.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Revoke stops a key from working. Revoked keys are kept so that what they
+// did can still be traced.
+func (m APIKeyModel) Revoke(key *APIKey) error {
+	query := `
+		UPDATE api_keys
+		SET revoked_at = now(), previous_hash = NULL, previous_expiry = NULL, version = version + 1
+		WHERE id = $1 AND version = $2 AND revoked_at IS NULL
+		RETURNING revoked_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key.ID, key.Version).Scan(&key.RevokedAt, &key.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Touch records that a key was used from ip. It is only written once a
+// minute, so busy clients do not turn every request into a write.
+func (m APIKeyModel) Touch(id int64, ip string) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = now(), last_used_ip = $2
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute' OR last_used_ip <> $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, ip)
+	return err
+}
+
+// Scope returns the warehouses a key is limited to, which is AllWarehouses
+// if it is not.
+func (m APIKeyModel) Scope(key *APIKey) (*Scope, error) {
+	if key.WarehouseID == nil && key.PerusahaanID == nil {
+		return AllWarehouses(), nil
+	}
+
+	query := `
+		SELECT
+			array(SELECT warehouse_id FROM warehouse WHERE warehouse_id = $1 OR perusahaan_id = $2 ORDER BY 1),
+			array(SELECT id FROM perusahaan WHERE id = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var scope Scope
+
+	err := m.DB.QueryRowContext(ctx, query, key.WarehouseID, key.PerusahaanID).Scan(pq.Array(&scope.Warehouses), pq.Array(&scope.Perusahaans))
+	if err != nil {
+		return nil, err
+	}
+
+	return &scope, nil
+}
@@ -0,0 +1,294 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Actor identifies who made a change. It is taken from the authenticated
+// request rather than from anything the client puts in the body.
+type Actor struct {
+	UserID    int64
+	RequestID string
+	IP        string
+}
+
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UserID     *int64          `json:"user_id"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceID string          `json:"resource_id"`
+	Changes    json.RawMessage `json:"changes"`
+	RequestID  string          `json:"request_id"`
+	IP         string          `json:"ip"`
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+var auditColumns = map[string]string{
+	"id":          "id",
+	"created_at":  "created_at",
+	"user_id":     "user_id",
+	"action":      "action",
+	"resource":    "resource",
+	"resource_id": "resource_id",
+	"request_id":  "request_id",
+	"ip":          "ip",
+}
+
+var (
+	AuditFilterSafelist = safelist(auditColumns)
+	AuditSortSafelist   = sortSafelist(auditColumns)
+)
+
+// auditSource describes how to snapshot rows of one resource. extra is an
+// optional jsonb expression over the row alias t that is merged into the
+// snapshot, for child rows that belong to the record.
+//
+// Sources with revert columns also keep a full revision per version; revert
+// lists the columns restored from an old revision and revertChildren restores
+// whatever extra added. inScope is the condition, with a %s for the warehouse
+// ID array, that a row must meet to be within a Scope.
+type auditSource struct {
+	resource       string
+	table          string
+	key            string
+	extra          string
+	softDelete     bool
+	revert         []string
+	revertChildren func(ctx context.Context, tx *sql.Tx, id string, revision json.RawMessage, scope *Scope) error
+	inScope        string
+}
+
+var (
+	movieAudit      = auditSource{resource: "movies", table: "movies", key: "id"}
+	perusahaanAudit = auditSource{resource: "perusahaan", table: "perusahaan", key: "id"}
+	warehouseAudit  = auditSource{resource: "warehouse", table: "warehouse", key: "warehouse_id", softDelete: true,
+		revert:  []string{"name_warehouse", "address_warehouse", "tlp_warehouse", "ket_warehouse", "perusahaan_id"},
+		inScope: "t.warehouse_id = ANY(%s)"}
+	rakAudit = auditSource{resource: "rak", table: "rak", key: "rak_id", softDelete: true,
+		revert:  []string{"rak_code", "rak_ket", "warehouse_id"},
+		inScope: "t.warehouse_id = ANY(%s)"}
+	brandAudit = auditSource{resource: "brand", table: "brand", key: "id",
+		revert: []string{"name", "ket"}}
+	brandAssetAudit = auditSource{resource: "brandasset", table: "brandmodel", key: "id"}
+	stokAudit       = auditSource{resource: "stok", table: "stok", key: "id", softDelete: true, extra: `jsonb_build_object('details',
+		(select coalesce(jsonb_agg(to_jsonb(d) - 'id' - 'stok_id' order by d.warehouse_id, d.rak_id), '[]')
+		from stok_detail d where d.stok_id = t.id))`,
+		revert:         []string{"produk_code", "produk_ket", "buy", "sell", "year", "chasis", "brand_id", "model_id"},
+		revertChildren: revertStokDetails,
+		inScope:        "t.id IN (select stok_id from stok_detail where warehouse_id = ANY(%s))"}
+)
+
+// snapshot returns the current row as JSON, locking it for the rest of the
+// transaction. It returns nil when the row does not exist.
+func (s auditSource) snapshot(ctx context.Context, tx *sql.Tx, id interface{}) (json.RawMessage, error) {
+	row := "to_jsonb(t)"
+	if s.extra != "" {
+		row += " || " + s.extra
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM %s t WHERE t.%s = $1 FOR UPDATE`, row, s.table, s.key)
+
+	var snapshot []byte
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(&snapshot)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// record writes an audit entry for a change made in tx. old is the snapshot
+// taken before the change; the new state is read back from the table.
+func (s auditSource) record(ctx context.Context, tx *sql.Tx, actor Actor, action string, id interface{}, old json.RawMessage) error {
+	current, err := s.snapshot(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	changes, err := diff(old, current)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_log (user_id, action, resource, resource_id, changes, request_id, ip)
+		VALUES (NULLIF($1::bigint, 0), $2, $3, $4, $5, $6, $7)`
+
+	args := []interface{}{actor.UserID, action, s.resource, fmt.Sprint(id), string(changes), actor.RequestID, actor.IP}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	err = s.publish(ctx, tx, actor, action, id, old, current, changes)
+	if err != nil {
+		return err
+	}
+
+	if s.revert == nil || current == nil {
+		return nil
+	}
+
+	return s.saveRevision(ctx, tx, actor, id, current)
+}
+
+// diff returns the fields that differ between two row snapshots as
+// {"field": {"old": ..., "new": ...}}. Either snapshot may be nil.
+func diff(old, current json.RawMessage) ([]byte, error) {
+	before := map[string]interface{}{}
+	after := map[string]interface{}{}
+
+	if old != nil {
+		if err := json.Unmarshal(old, &before); err != nil {
+			return nil, err
+		}
+	}
+
+	if current != nil {
+		if err := json.Unmarshal(current, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	type change struct {
+		Old interface{} `json:"old"`
+		New interface{} `json:"new"`
+	}
+
+	changes := map[string]change{}
+
+	for field, value := range before {
+		if !reflect.DeepEqual(value, after[field]) {
+			changes[field] = change{Old: value, New: after[field]}
+		}
+	}
+
+	for field, value := range after {
+		if _, ok := before[field]; !ok && value != nil {
+			changes[field] = change{New: value}
+		}
+	}
+
+	return json.Marshal(changes)
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// withTx runs fn in a transaction, committing it if fn succeeds. When the
+// model is bound to an outer transaction fn runs in that one instead, and
+// committing is left to its owner.
+func withTx(db *sql.DB, outer *sql.Tx, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if outer != nil {
+		return fn(ctx, outer)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m AuditModel) GetAll(resource string, resourceID string, filters Filters) ([]*AuditEntry, Metadata, error) {
+	q := listQuery{
+		columns: `id, created_at, user_id, action, resource, resource_id, changes, request_id, ip`,
+		from:    `audit_log`,
+		order:   filters.sortKeys(auditColumns, "id"),
+	}
+
+	if resource != "" {
+		q.filter("resource = " + q.arg(resource))
+	}
+
+	if resourceID != "" {
+		q.filter("resource_id = " + q.arg(resourceID))
+	}
+
+	q.conditions(filters.Conditions, auditColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+	keys := []string{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.UserID,
+			&entry.Action,
+			&entry.Resource,
+			&entry.ResourceID,
+			&changes,
+			&entry.RequestID,
+			&entry.IP,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entry.Changes = changes
+
+		entries = append(entries, &entry)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&entries, keys, totalRecords)
+
+	return entries, metadata, nil
+}
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/lib/pq"
 )
 
 type Brand struct {
@@ -20,14 +22,36 @@ type Brand struct {
 }
 
 func ValidateBrand(v *validator.Validator, usaha *Brand) {
-	v.Check(usaha.Name != "", "Nama", "harus diisi")
+	v.Check(usaha.Name != "", "Nama", validator.Required)
 }
 
 type BrandModel struct {
 	DB *sql.DB
+	tx *sql.Tx
+}
+
+func (m BrandModel) db() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+var brandColumns = map[string]string{
+	"id":         "id",
+	"name":       "name",
+	"ket":        "ket",
+	"created_at": "created_at",
 }
 
-func (m BrandModel) Insert(usaha *Brand) error {
+var (
+	BrandFilterSafelist = safelist(brandColumns)
+	BrandSortSafelist   = sortSafelist(brandColumns)
+	BrandFieldSafelist  = jsonFields(Brand{})
+	BrandRelations      = map[string]string{}
+)
+
+func (m BrandModel) Insert(usaha *Brand, actor Actor) error {
 	query := `
 		INSERT INTO brand (name, ket) 
 		VALUES ($1, $2)
@@ -35,11 +59,14 @@ func (m BrandModel) Insert(usaha *Brand) error {
 
 	args := []interface{}{usaha.Name, usaha.Ket}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&usaha.ID, &usaha.CreatedAt, &usaha.Version)
+		if err != nil {
+			return err
+		}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.ID, &usaha.CreatedAt,
-		&usaha.Version)
+		return brandAudit.record(ctx, tx, actor, "insert", usaha.ID, nil)
+	})
 }
 
 func (m BrandModel) Get(id int64) (*Brand, error) {
@@ -57,7 +84,7 @@ func (m BrandModel) Get(id int64) (*Brand, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.db().QueryRowContext(ctx, query, id).Scan(
 		&usaha.ID,
 		&usaha.CreatedAt,
 		&usaha.Name,
@@ -77,7 +104,7 @@ func (m BrandModel) Get(id int64) (*Brand, error) {
 	return &usaha, nil
 }
 
-func (m BrandModel) Update(usaha *Brand) error {
+func (m BrandModel) Update(usaha *Brand, actor Actor) error {
 	query := `
 	UPDATE brand 
 	SET name = $1, ket = $2, modified_at = now(), version = version + 1
@@ -91,81 +118,95 @@ func (m BrandModel) Update(usaha *Brand) error {
 		usaha.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := brandAudit.snapshot(ctx, tx, usaha.ID)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return brandAudit.record(ctx, tx, actor, "update", usaha.ID, old)
+	})
 }
 
-func (m BrandModel) Delete(id int64) error {
+func (m BrandModel) Delete(id int64, version int32, actor Actor) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
         DELETE FROM brand
-        WHERE id = $1`
+        WHERE id = $1 AND version = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := brandAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+		result, err := tx.ExecContext(ctx, query, id, version)
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
-	}
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
 
-	return nil
+		return brandAudit.record(ctx, tx, actor, "delete", id, old)
+	})
 }
 
 func (m BrandModel) GetAll(name string, ket string, filters Filters) ([]*Brand, Metadata, error) {
+	q := listQuery{
+		columns: `id, created_at, name, ket, version`,
+		from:    `brand`,
+		order:   filters.sortKeys(brandColumns, "id"),
+	}
+
+	q.like("name", name)
+	q.like("ket", ket)
+
+	q.conditions(filters.Conditions, brandColumns)
 
-	query := fmt.Sprintf(`
-	SELECT count(*) OVER(),id,created_at,name,ket,version
-	FROM brand 
-	where lower(name) like lower('%%` + name + `%%')  and lower(ket) like lower('%%` + ket + `%%')
-	ORDER BY created_at desc
-	LIMIT $1 OFFSET $2`)
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	//args := []interface{}{name}
-	args := []interface{}{filters.limit(), filters.offset()}
-
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.db().QueryContext(ctx, query, args...)
 	if err != nil {
 		fmt.Println("err-db")
-		return nil, Metadata{}, err
+		return nil, Metadata{}, listError(err)
 	}
 
 	defer rows.Close()
 
 	totalRecords := 0
 	usahas := []*Brand{}
+	keys := []string{}
 
 	for rows.Next() {
 		var usaha Brand
+		var key string
 
-		//SELECT count(*) OVER(), id, created_at, name, address, tlp, npwp, rek,ket,version-10
 		err := rows.Scan(
 			&totalRecords,
 			&usaha.ID,
@@ -173,20 +214,67 @@ func (m BrandModel) GetAll(name string, ket string, filters Filters) ([]*Brand,
 			&usaha.Name,
 			&usaha.Ket,
 			&usaha.Version,
+			&key,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
 		usahas = append(usahas, &usaha)
+		keys = append(keys, key)
 	}
 
-
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := filters.paginate(&usahas, keys, totalRecords)
 
 	return usahas, metadata, nil
 }
+
+func (m BrandModel) getMany(ids []int64) (map[int64]*Brand, error) {
+	usahas := make(map[int64]*Brand)
+
+	if len(ids) == 0 {
+		return usahas, nil
+	}
+
+	query := `
+        SELECT id,created_at,name,ket,version
+        FROM brand
+        WHERE id = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.db().QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var usaha Brand
+
+		err := rows.Scan(
+			&usaha.ID,
+			&usaha.CreatedAt,
+			&usaha.Name,
+			&usaha.Ket,
+			&usaha.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		usahas[usaha.ID] = &usaha
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return usahas, nil
+}
@@ -19,18 +19,48 @@ type BrandAsset struct {
 	Rn        int32     `json:"rn"`
 	BrandID   int64     `json:"brand_id"`
 	BrandName string    `json:"brandname"`
+	Brand     *Brand    `json:"brand,omitempty"`
 }
 
 func ValidateBrandAsset(v *validator.Validator, usaha *BrandAsset) {
-	v.Check(usaha.Name != "", "Nama", "harus diisi")
-	v.Check(usaha.BrandID != 0, "Brand Name", "harus diisi")
+	v.Check(usaha.Name != "", "Nama", validator.Required)
+	v.Check(usaha.BrandID != 0, "Brand Name", validator.Required)
 }
 
 type BrandAssetModel struct {
 	DB *sql.DB
+	tx *sql.Tx
 }
 
-func (m BrandAssetModel) Insert(usaha *BrandAsset) error {
+func (m BrandAssetModel) db() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+var brandAssetColumns = map[string]string{
+	"id":         "b.id",
+	"name":       "b.name",
+	"ket":        "b.ket",
+	"brand_id":   "b.brand_id",
+	"brandname":  "a.name",
+	"created_at": "b.created_at",
+	"version":    "b.version",
+}
+
+var brandAssetJoins = map[string]string{
+	"a": "inner join brand a on a.id = b.brand_id",
+}
+
+var (
+	BrandAssetFilterSafelist = safelist(brandAssetColumns)
+	BrandAssetSortSafelist   = sortSafelist(brandAssetColumns)
+	BrandAssetFieldSafelist  = jsonFields(BrandAsset{})
+	BrandAssetRelations      = map[string]string{"brand": "brand"}
+)
+
+func (m BrandAssetModel) Insert(usaha *BrandAsset, actor Actor) error {
 	query := `
 		insert into brandmodel(name,ket,brand_id) 
 		VALUES ($1, $2,$3)
@@ -38,11 +68,14 @@ func (m BrandAssetModel) Insert(usaha *BrandAsset) error {
 
 	args := []interface{}{usaha.Name, usaha.Ket, usaha.BrandID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&usaha.ID, &usaha.CreatedAt, &usaha.Version)
+		if err != nil {
+			return err
+		}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.ID, &usaha.CreatedAt,
-		&usaha.Version)
+		return brandAssetAudit.record(ctx, tx, actor, "insert", usaha.ID, nil)
+	})
 }
 
 func (m BrandAssetModel) Get(id int64) (*BrandAsset, error) {
@@ -60,7 +93,7 @@ func (m BrandAssetModel) Get(id int64) (*BrandAsset, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.db().QueryRowContext(ctx, query, id).Scan(
 		&usaha.ID,
 		&usaha.CreatedAt,
 		&usaha.Name,
@@ -82,7 +115,7 @@ func (m BrandAssetModel) Get(id int64) (*BrandAsset, error) {
 	return &usaha, nil
 }
 
-func (m BrandAssetModel) Update(usaha *BrandAsset) error {
+func (m BrandAssetModel) Update(usaha *BrandAsset, actor Actor) error {
 	query := `
 	UPDATE brandmodel 
 	SET name = $1, ket = $2, modified_at = now(), version = version + 1,brand_id=$3
@@ -97,83 +130,100 @@ func (m BrandAssetModel) Update(usaha *BrandAsset) error {
 		usaha.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := brandAssetAudit.snapshot(ctx, tx, usaha.ID)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return brandAssetAudit.record(ctx, tx, actor, "update", usaha.ID, old)
+	})
 }
 
-func (m BrandAssetModel) Delete(id int64) error {
+func (m BrandAssetModel) Delete(id int64, version int32, actor Actor) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
         DELETE FROM brandmodel
-        WHERE id = $1`
+        WHERE id = $1 AND version = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := brandAssetAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+		result, err := tx.ExecContext(ctx, query, id, version)
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
-	}
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
 
-	return nil
+		return brandAssetAudit.record(ctx, tx, actor, "delete", id, old)
+	})
 }
 
 func (m BrandAssetModel) GetAll(name string, namebrand string, ket string, filters Filters) ([]*BrandAsset, Metadata, error) {
+	q := listQuery{
+		from:  "brandmodel b",
+		joins: brandAssetJoins,
+		order: filters.sortKeys(brandAssetColumns, "b.id"),
+	}
 
-	query := fmt.Sprintf(`
-	SELECT count(*) OVER(),b.id,b.created_at,b.name,b.ket,b.version,b.brand_id,a.name namebrand
-	FROM brand  a
-	inner join brandmodel b on a.id=b.brand_id
-	where lower(b.name) like lower('%%` + name + `%%') and lower(b.ket) like lower('%%` + ket + `%%') and 
-	lower(a.name) like lower('%%` + namebrand + `%%')
-	ORDER BY b.created_at desc
-	LIMIT $1 OFFSET $2`)
+	q.selects(filters.Projection, brandAssetColumns,
+		"id", "created_at", "name", "ket", "version", "brand_id", "brandname")
+
+	q.like("b.name", name)
+	q.like("b.ket", ket)
+	q.like("a.name", namebrand)
+
+	q.conditions(filters.Conditions, brandAssetColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	//args := []interface{}{name}
-	args := []interface{}{filters.limit(), filters.offset()}
-
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.db().QueryContext(ctx, query, args...)
 	if err != nil {
 		fmt.Println("err-db")
-		return nil, Metadata{}, err
+		return nil, Metadata{}, listError(err)
 	}
 
 	defer rows.Close()
 
 	totalRecords := 0
 	usahas := []*BrandAsset{}
+	keys := []string{}
 
 	for rows.Next() {
 		var usaha BrandAsset
+		var brandName sql.NullString
+		var key string
 
-		//SELECT count(*) OVER(), id, created_at, name, address, tlp, npwp, rek,ket,version-10
 		err := rows.Scan(
 			&totalRecords,
 			&usaha.ID,
@@ -182,21 +232,66 @@ func (m BrandAssetModel) GetAll(name string, namebrand string, ket string, filte
 			&usaha.Ket,
 			&usaha.Version,
 			&usaha.BrandID,
-			&usaha.BrandName,
+			&brandName,
+			&key,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
+		usaha.BrandName = brandName.String
+
 		usahas = append(usahas, &usaha)
+		keys = append(keys, key)
 	}
 
-
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := filters.paginate(&usahas, keys, totalRecords)
+
+	if filters.includes("brand") {
+		err = m.loadBrands(usahas)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
 
 	return usahas, metadata, nil
 }
+
+func (m BrandAssetModel) GetWith(id int64, p Projection) (*BrandAsset, error) {
+	usaha, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.includes("brand") {
+		err = m.loadBrands([]*BrandAsset{usaha})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return usaha, nil
+}
+
+func (m BrandAssetModel) loadBrands(usahas []*BrandAsset) error {
+	ids := []int64{}
+
+	for _, usaha := range usahas {
+		ids = append(ids, usaha.BrandID)
+	}
+
+	brands, err := BrandModel{DB: m.DB, tx: m.tx}.getMany(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, usaha := range usahas {
+		usaha.Brand = brands[usaha.BrandID]
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Email statuses. A pending email is retried until it is sent or runs out of
+// attempts and fails.
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+// Email is a message in the email outbox. The bodies are kept only until the
+// message is sent, since they can hold activation and password reset tokens,
+// and are never shown through the API.
+type Email struct {
+	ID            int64      `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Recipient     string     `json:"recipient"`
+	Template      string     `json:"template"`
+	Subject       string     `json:"subject"`
+	PlainBody     string     `json:"-"`
+	HTMLBody      string     `json:"-"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error"`
+	SentAt        *time.Time `json:"sent_at"`
+}
+
+type EmailModel struct {
+	DB *sql.DB
+}
+
+var emailColumns = map[string]string{
+	"id":              "id",
+	"created_at":      "created_at",
+	"recipient":       "recipient",
+	"template":        "template",
+	"status":          "status",
+	"attempts":        "attempts",
+	"next_attempt_at": "next_attempt_at",
+	"sent_at":         "sent_at",
+}
+
+var (
+	EmailFilterSafelist = safelist(emailColumns)
+	EmailSortSafelist   = sortSafelist(emailColumns)
+)
+
+const emailFields = `id, created_at, recipient, template, subject, plain_body, html_body, status, attempts, next_attempt_at, last_error, sent_at`
+
+func scanEmail(row interface{ Scan(...interface{}) error }) (*Email, error) {
+	var email Email
+
+	err := row.Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.Recipient,
+		&email.Template,
+		&email.Subject,
+		&email.PlainBody,
+		&email.HTMLBody,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+		&email.LastError,
+		&email.SentAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+// EmailJob is the payload of a JobSendEmail job.
+type EmailJob struct {
+	EmailID int64 `json:"email_id"`
+}
+
+// Insert adds email to the outbox, along with a job to send it straight away
+// that is tried up to maxAttempts times.
+func (m EmailModel) Insert(email *Email, maxAttempts int) error {
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			INSERT INTO emails (recipient, template, subject, plain_body, html_body)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, created_at, status, next_attempt_at`
+
+		args := []interface{}{email.Recipient, email.Template, email.Subject, email.PlainBody, email.HTMLBody}
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&email.ID, &email.CreatedAt, &email.Status, &email.NextAttemptAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = enqueueJob(ctx, tx, JobSendEmail, EmailJob{EmailID: email.ID}, maxAttempts)
+		return err
+	})
+}
+
+// RecordAttempt stores the outcome of one attempt to send an email and moves
+// it to status, retrying at next if it is still pending. The bodies of an
+// email that was sent are cleared.
+func (m EmailModel) RecordAttempt(id int64, status string, next time.Time, reason string) error {
+	query := `
+		UPDATE emails
+		SET attempts = attempts + 1, status = $2, next_attempt_at = $3, last_error = $4,
+			sent_at = CASE WHEN $2 = 'sent' THEN now() END,
+			plain_body = CASE WHEN $2 = 'sent' THEN '' ELSE plain_body END,
+			html_body = CASE WHEN $2 = 'sent' THEN '' ELSE html_body END
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, status, next, reason)
+	return err
+}
+
+// Resend queues a failed email to be sent again straight away, with a fresh
+// job of maxAttempts attempts. Emails that are pending or already sent cannot
+// be resent.
+func (m EmailModel) Resend(id int64, maxAttempts int) (*Email, error) {
+	var email *Email
+
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			UPDATE emails
+			SET status = 'pending', attempts = 0, next_attempt_at = now()
+			WHERE id = $1 AND status = 'failed'
+			RETURNING ` + emailFields
+
+		var err error
+
+		email, err = scanEmail(tx.QueryRowContext(ctx, query, id))
+		if err != nil {
+			return err
+		}
+
+		_, err = enqueueJob(ctx, tx, JobSendEmail, EmailJob{EmailID: email.ID}, maxAttempts)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+
+	return email, err
+}
+
+func (m EmailModel) Get(id int64) (*Email, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + emailFields + ` FROM emails WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	email, err := scanEmail(m.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+
+	return email, err
+}
+
+func (m EmailModel) GetAll(status string, filters Filters) ([]*Email, Metadata, error) {
+	q := listQuery{
+		columns: emailFields,
+		from:    `emails`,
+		order:   filters.sortKeys(emailColumns, "id"),
+	}
+
+	if status != "" {
+		q.filter("status = " + q.arg(status))
+	}
+
+	q.conditions(filters.Conditions, emailColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*Email{}
+	keys := []string{}
+
+	for rows.Next() {
+		var email Email
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&email.ID,
+			&email.CreatedAt,
+			&email.Recipient,
+			&email.Template,
+			&email.Subject,
+			&email.PlainBody,
+			&email.HTMLBody,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.SentAt,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		emails = append(emails, &email)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&emails, keys, totalRecords)
+
+	return emails, metadata, nil
+}
@@ -1,35 +1,83 @@
 package data
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 
 	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidFilter = errors.New("invalid filter value")
 )
 
+var aliasRX = regexp.MustCompile(`\b([a-z])\.[a-z_]+`)
+
+var filterOperators = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+// Condition is a single filter[field][operator]=value expression from the
+// query string. Values holds more than one entry only for the "in" operator.
+type Condition struct {
+	Field    string
+	Operator string
+	Values   []string
+}
+
 type Filters struct {
-	Page         int
-	PageSize     int
-	Sort         string
-	SortSafelist []string
+	Page           int
+	PageSize       int
+	Sort           string
+	SortSafelist   []string
+	Cursor         string
+	Count          bool
+	Conditions     []Condition
+	FilterSafelist []string
+	Projection
 }
 
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+// sortKeys maps the comma separated sort value onto the resource's columns
+// and appends the tiebreaker column so that the order is always total.
+func (f Filters) sortKeys(columns map[string]string, tiebreaker string) []sortKey {
+	var keys []sortKey
+
+	for _, value := range strings.Split(f.Sort, ",") {
+		if !validator.In(value, f.SortSafelist...) {
+			panic("unsafe sort parameter: " + value)
 		}
-	}
 
-	panic("unsafe sort parameter: " + f.Sort)
-}
+		column, ok := columns[strings.TrimPrefix(value, "-")]
+		if !ok || strings.Contains(column, "%s") {
+			panic("unsafe sort parameter: " + value)
+		}
 
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+		keys = append(keys, sortKey{column: column, desc: strings.HasPrefix(value, "-")})
 	}
 
-	return "ASC"
+	for _, key := range keys {
+		if key.column == tiebreaker {
+			return keys
+		}
+	}
+
+	return append(keys, sortKey{column: tiebreaker})
 }
 
 func (f Filters) limit() int {
@@ -41,20 +89,62 @@ func (f Filters) offset() int {
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(f.Page > 0, "page", validator.Positive)
+	v.Check(f.Page <= 10_000_000, "page", validator.MaxValue, 10_000_000)
+	v.Check(f.PageSize > 0, "page_size", validator.Positive)
+	v.Check(f.PageSize <= 100, "page_size", validator.MaxValue, 100)
+
+	sorts := strings.Split(f.Sort, ",")
+	names := make([]string, 0, len(sorts))
+
+	for _, value := range sorts {
+		v.Check(validator.In(value, f.SortSafelist...), "sort", validator.InvalidSort)
+		names = append(names, strings.TrimPrefix(value, "-"))
+	}
+
+	v.Check(validator.Unique(names), "sort", validator.Duplicate)
+
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			v.AddError("cursor", validator.InvalidCursor)
+			return
+		}
 
-	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+		v.Check(c.Sort == f.Sort, "cursor", validator.CursorMismatch)
+	}
+
+	ValidateProjection(v, f.Projection)
+
+	for _, c := range f.Conditions {
+		key := fmt.Sprintf("filter[%s][%s]", c.Field, c.Operator)
+
+		v.Check(validator.In(c.Field, f.FilterSafelist...), key, validator.UnknownFilterField)
+
+		switch c.Operator {
+		case "in":
+			v.Check(len(c.Values) >= 1, key, validator.NotEmpty)
+			v.Check(len(c.Values) <= 100, key, validator.MaxItems, 100)
+		case "null":
+			v.Check(len(c.Values) == 1 && validator.In(c.Values[0], "true", "false"), key, validator.Boolean)
+		case "like":
+			v.Check(len(c.Values) == 1, key, validator.SingleValue)
+		default:
+			_, ok := filterOperators[c.Operator]
+			v.Check(ok, key, validator.UnknownFilterOperator)
+			v.Check(len(c.Values) == 1, key, validator.SingleValue)
+		}
+	}
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -71,3 +161,378 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// cursor is the decoded form of the opaque next_cursor/prev_cursor values.
+// Key holds the ORDER BY values of the row the page starts after (or before,
+// when Prev is set), exactly as Postgres rendered them with json_build_array.
+type cursor struct {
+	Sort string          `json:"s"`
+	Prev bool            `json:"p,omitempty"`
+	Key  json.RawMessage `json:"k"`
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+
+	err = json.Unmarshal(js, &c)
+	if err != nil || len(c.Key) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+func encodeCursor(sort string, prev bool, key string) string {
+	js, err := json.Marshal(cursor{Sort: sort, Prev: prev, Key: json.RawMessage(key)})
+	if err != nil {
+		return ""
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func (c *cursor) values() ([]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(c.Key))
+	dec.UseNumber()
+
+	var values []interface{}
+
+	err := dec.Decode(&values)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return values, nil
+}
+
+type sortKey struct {
+	column string
+	desc   bool
+}
+
+// listQuery holds the pieces of a list endpoint's SELECT so that paging,
+// keyset cursors and the optional total count can be assembled in one place.
+// Joins are keyed by table alias and only added when a selected column, a
+// condition or the sort order refers to that alias.
+type listQuery struct {
+	columns string
+	from    string
+	joins   map[string]string
+	where   []string
+	args    []interface{}
+	order   []sortKey
+}
+
+// selects sets the column list from the resource's column map. Columns that
+// need a join or a subquery and are not part of the projection are selected
+// as NULL so that work can be left out.
+func (q *listQuery) selects(p Projection, columns map[string]string, names ...string) {
+	exprs := make([]string, 0, len(names))
+
+	for _, name := range names {
+		expr := columns[name]
+
+		if !p.wants(name) && (len(q.aliases(expr)) > 0 || strings.HasPrefix(expr, "(")) {
+			expr = "NULL"
+		}
+
+		exprs = append(exprs, expr)
+	}
+
+	q.columns = strings.Join(exprs, ", ")
+}
+
+func (q *listQuery) aliases(expr string) []string {
+	var aliases []string
+
+	for _, match := range aliasRX.FindAllStringSubmatch(expr, -1) {
+		if _, ok := q.joins[match[1]]; ok && !validator.In(match[1], aliases...) {
+			aliases = append(aliases, match[1])
+		}
+	}
+
+	return aliases
+}
+
+func (q *listQuery) table() string {
+	used := q.columns + " " + strings.Join(q.where, " ")
+	for _, key := range q.order {
+		used += " " + key.column
+	}
+
+	aliases := q.aliases(used)
+	sort.Strings(aliases)
+
+	from := q.from
+	for _, alias := range aliases {
+		from += "\n\t" + q.joins[alias]
+	}
+
+	return from
+}
+
+func (q *listQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *listQuery) filter(condition string) {
+	q.where = append(q.where, condition)
+}
+
+func (q *listQuery) like(column, value string) {
+	if value == "" {
+		return
+	}
+
+	q.filter(fmt.Sprintf("lower(%s) like lower(%s)", column, q.arg("%"+value+"%")))
+}
+
+// conditions translates the filter conditions into parameterised SQL using the
+// resource's column map. A column expression containing %s is a template
+// that receives the comparison, for fields that are not plain columns.
+func (q *listQuery) conditions(conditions []Condition, columns map[string]string) {
+	for _, c := range conditions {
+		column, ok := columns[c.Field]
+		if !ok {
+			panic("unsafe filter field: " + c.Field)
+		}
+
+		var predicate string
+
+		switch c.Operator {
+		case "in":
+			var placeholders []string
+			for _, value := range c.Values {
+				placeholders = append(placeholders, q.arg(value))
+			}
+			predicate = "IN (" + strings.Join(placeholders, ", ") + ")"
+		case "null":
+			predicate = "IS NOT NULL"
+			if c.Values[0] == "true" {
+				predicate = "IS NULL"
+			}
+		case "like":
+			predicate = "::text ILIKE " + q.arg("%"+c.Values[0]+"%")
+		default:
+			predicate = filterOperators[c.Operator] + " " + q.arg(c.Values[0])
+		}
+
+		if strings.Contains(column, "%s") {
+			q.filter(fmt.Sprintf(column, predicate))
+		} else {
+			q.filter(column + " " + predicate)
+		}
+	}
+}
+
+func (q *listQuery) build(f Filters) (string, []interface{}, error) {
+	where := append([]string{}, q.where...)
+	args := append([]interface{}{}, q.args...)
+
+	baseWhere := ""
+	if len(where) > 0 {
+		baseWhere = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	offset := f.offset()
+	prev := false
+
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+
+		values, err := c.values()
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(values) != len(q.order) {
+			return "", nil, ErrInvalidCursor
+		}
+
+		prev = c.Prev
+		offset = 0
+
+		var alternatives []string
+
+		for i, key := range q.order {
+			var terms []string
+
+			for j := 0; j < i; j++ {
+				if values[j] == nil {
+					terms = append(terms, q.order[j].column+" IS NULL")
+					continue
+				}
+
+				args = append(args, values[j])
+				terms = append(terms, fmt.Sprintf("%s = $%d", q.order[j].column, len(args)))
+			}
+
+			// Postgres sorts NULLs last when ascending and first when
+			// descending, so the rows after a NULL key are only ever the
+			// non-NULL ones on a descending scan.
+			descending := key.desc != prev
+
+			switch {
+			case values[i] == nil && descending:
+				terms = append(terms, key.column+" IS NOT NULL")
+			case values[i] == nil:
+				continue
+			case descending:
+				args = append(args, values[i])
+				terms = append(terms, fmt.Sprintf("%s < $%d", key.column, len(args)))
+			default:
+				args = append(args, values[i])
+				terms = append(terms, fmt.Sprintf("(%s > $%d OR %s IS NULL)", key.column, len(args), key.column))
+			}
+
+			alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+		}
+
+		if len(alternatives) == 0 {
+			alternatives = append(alternatives, "false")
+		}
+
+		where = append(where, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	count := "0"
+	switch {
+	case f.Count && f.Cursor == "":
+		count = "count(*) OVER()"
+	case f.Count:
+		count = fmt.Sprintf("(SELECT count(*) FROM %s %s)", q.table(), baseWhere)
+	}
+
+	var order, keys []string
+
+	for _, key := range q.order {
+		direction := "ASC"
+		if key.desc != prev {
+			direction = "DESC"
+		}
+
+		order = append(order, key.column+" "+direction)
+		keys = append(keys, key.column)
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	args = append(args, f.limit()+1, offset)
+
+	query := fmt.Sprintf(`
+	SELECT %s, %s, json_build_array(%s)
+	FROM %s
+	%s
+	ORDER BY %s
+	LIMIT $%d OFFSET $%d`,
+		count, q.columns, strings.Join(keys, ", "),
+		q.table(),
+		whereClause,
+		strings.Join(order, ", "),
+		len(args)-1, len(args))
+
+	return query, args, nil
+}
+
+// listError reports malformed filter values, which Postgres rejects with a
+// data exception once it knows the column type, as ErrInvalidFilter.
+func listError(err error) error {
+	var pqErr *pq.Error
+
+	if errors.As(err, &pqErr) && pqErr.Code.Class() == "22" {
+		return ErrInvalidFilter
+	}
+
+	return err
+}
+
+// sortSafelist lists the ascending and descending sort values for every
+// plain or computed column; template columns can only be filtered on.
+func sortSafelist(columns map[string]string) []string {
+	names := []string{}
+
+	for _, name := range safelist(columns) {
+		if !strings.Contains(columns[name], "%s") {
+			names = append(names, name, "-"+name)
+		}
+	}
+
+	return names
+}
+
+func safelist(columns map[string]string) []string {
+	names := make([]string, 0, len(columns))
+
+	for name := range columns {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// paginate trims the look-ahead row fetched by listQuery.build from rows
+// (a pointer to a slice), restores the requested order when paging
+// backwards, and works out the metadata including the cursors.
+func (f Filters) paginate(rows interface{}, keys []string, totalRecords int) Metadata {
+	prev := false
+	if c, err := decodeCursor(f.Cursor); err == nil {
+		prev = c.Prev
+	}
+
+	slice := reflect.ValueOf(rows).Elem()
+
+	more := len(keys) > f.limit()
+	if more {
+		keys = keys[:f.limit()]
+		slice.Set(slice.Slice(0, f.limit()))
+	}
+
+	if prev {
+		swap := reflect.Swapper(slice.Interface())
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	var metadata Metadata
+
+	switch {
+	case !f.Count:
+		metadata = Metadata{PageSize: f.PageSize}
+	case f.Cursor == "":
+		metadata = calculateMetadata(totalRecords, f.Page, f.PageSize)
+	default:
+		metadata = Metadata{PageSize: f.PageSize, TotalRecords: totalRecords}
+	}
+
+	if len(keys) == 0 {
+		return metadata
+	}
+
+	first, last := keys[0], keys[len(keys)-1]
+
+	if more || prev {
+		metadata.NextCursor = encodeCursor(f.Sort, false, last)
+	}
+
+	if (prev && more) || (!prev && (f.Cursor != "" || f.Page > 1)) {
+		metadata.PrevCursor = encodeCursor(f.Sort, true, first)
+	}
+
+	return metadata
+}
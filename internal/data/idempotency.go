@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// Idempotency-Key header. Status is zero while the first request is still
+// being processed.
+type IdempotencyRecord struct {
+	Fingerprint string
+	Status      int
+	Header      map[string][]string
+	Body        []byte
+}
+
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// Acquire claims key for the user. It returns nil if the caller now owns the
+// key and should process the request, or the existing record if the key was
+// used within ttl.
+func (m IdempotencyModel) Acquire(userID int64, key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, fingerprint)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, created_at = now(), status = NULL, header = NULL, body = NULL
+		WHERE idempotency_keys.created_at < $4
+		RETURNING key`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var claimed string
+
+	err := m.DB.QueryRowContext(ctx, query, userID, key, fingerprint, time.Now().Add(-ttl)).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	query = `
+		SELECT fingerprint, coalesce(status, 0), header, body
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	var record IdempotencyRecord
+	var header []byte
+
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(&record.Fingerprint, &record.Status, &header, &record.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if header != nil {
+		err = json.Unmarshal(header, &record.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &record, nil
+}
+
+// Complete stores the response for a key claimed with Acquire.
+func (m IdempotencyModel) Complete(userID int64, key string, status int, header map[string][]string, body []byte) error {
+	js, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status = $3, header = $4, body = $5
+		WHERE user_id = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, userID, key, status, string(js), body)
+	return err
+}
+
+// Release gives up a claimed key so the request can be retried.
+func (m IdempotencyModel) Release(userID int64, key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return err
+}
+
+func (m IdempotencyModel) DeleteExpired(ttl time.Duration) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE created_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-ttl))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
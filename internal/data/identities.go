@@ -0,0 +1,141 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// OIDCLogin is a sign in through the identity provider that has been started
+// but not finished, looked up by its state. UserID is the signed in user who
+// started it to link the provider account to themselves, or 0.
+type OIDCLogin struct {
+	State    string
+	Nonce    string
+	Verifier string
+	UserID   int64
+	Expiry   time.Time
+}
+
+// IdentityModel links users to the accounts they sign in with at an OpenID
+// Connect identity provider, which are named by issuer and subject.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// GetUser returns the user linked to the identity provider account.
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.language, users.version
+        FROM users
+        INNER JOIN user_identities ON user_identities.user_id = users.id
+        WHERE user_identities.issuer = $1 AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Language,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Link links the user to the identity provider account, or records another
+// sign in if it already is.
+func (m IdentityModel) Link(userID int64, issuer, subject, email string) error {
+	query := `
+        INSERT INTO user_identities (issuer, subject, user_id, email)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (issuer, subject) DO UPDATE
+        SET email = EXCLUDED.email, last_login_at = now()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID, email)
+	return err
+}
+
+func (m IdentityModel) InsertLogin(login *OIDCLogin) error {
+	query := `
+        INSERT INTO oidc_logins (state_hash, nonce, code_verifier, user_id, expiry)
+        VALUES ($1, $2, $3, NULLIF($4::bigint, 0), $5)`
+
+	hash := sha256.Sum256([]byte(login.State))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash[:], login.Nonce, login.Verifier, login.UserID, login.Expiry)
+	return err
+}
+
+// TakeLogin returns the unexpired sign in with the given state and removes
+// it, so that each state can only be used once.
+func (m IdentityModel) TakeLogin(state string) (*OIDCLogin, error) {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE state_hash = $1
+        RETURNING nonce, code_verifier, coalesce(user_id, 0), expiry`
+
+	hash := sha256.Sum256([]byte(state))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	login := OIDCLogin{State: state}
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(&login.Nonce, &login.Verifier, &login.UserID, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if time.Now().After(login.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+// DeleteExpiredLogins removes the sign ins that were never finished.
+func (m IdentityModel) DeleteExpiredLogins() (int64, error) {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE expiry < now()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
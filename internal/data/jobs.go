@@ -0,0 +1,264 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Job statuses. A job that fails is retried until it runs out of attempts and
+// becomes dead; a job that succeeds is deleted.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDead    = "dead"
+)
+
+// JobSendEmail is the kind of job that sends an email from the outbox. The
+// email model queues it along with the email; its payload is an EmailJob.
+const JobSendEmail = "send_email"
+
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"-"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error"`
+}
+
+type JobModel struct {
+	DB *sql.DB
+}
+
+var jobColumns = map[string]string{
+	"id":         "id",
+	"created_at": "created_at",
+	"kind":       "kind",
+	"status":     "status",
+	"attempts":   "attempts",
+	"run_at":     "run_at",
+}
+
+var (
+	JobFilterSafelist = safelist(jobColumns)
+	JobSortSafelist   = sortSafelist(jobColumns)
+)
+
+const jobFields = `id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	var payload []byte
+
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Payload = payload
+
+	return &job, nil
+}
+
+// Enqueue adds a job of kind to the queue. payload is stored as JSON and
+// handed back to the kind's handler.
+func (m JobModel) Enqueue(kind string, payload interface{}, maxAttempts int) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return enqueueJob(ctx, m.DB, kind, payload, maxAttempts)
+}
+
+// enqueueJob adds a job through q, so that other models can queue one in the
+// same transaction as the rows it works on.
+func enqueueJob(ctx context.Context, q querier, kind string, payload interface{}, maxAttempts int) (*Job, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO jobs (kind, payload, max_attempts)
+		VALUES ($1, $2, $3)
+		RETURNING ` + jobFields
+
+	return scanJob(q.QueryRowContext(ctx, query, kind, string(js), maxAttempts))
+}
+
+// Claim takes the next due job of kind and marks it running for lease. A
+// running job whose lease has expired belonged to a worker that died, and is
+// claimed again. It returns nil if there is no job to run.
+func (m JobModel) Claim(kind string, lease time.Duration) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1, locked_until = now() + make_interval(secs => $2)
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE kind = $1 AND run_at <= now()
+			AND (status = 'pending' OR (status = 'running' AND locked_until < now()))
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING ` + jobFields
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	job, err := scanJob(m.DB.QueryRowContext(ctx, query, kind, lease.Seconds()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return job, err
+}
+
+// Complete removes a job that ran successfully.
+func (m JobModel) Complete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, id)
+	return err
+}
+
+// Fail records why a job failed. It runs again at retryAt, or becomes dead if
+// retryAt is nil.
+func (m JobModel) Fail(id int64, reason string, retryAt *time.Time) error {
+	query := `
+		UPDATE jobs
+		SET status = CASE WHEN $3::timestamptz IS NULL THEN 'dead' ELSE 'pending' END,
+			run_at = coalesce($3, run_at), locked_until = NULL, last_error = $2
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, reason, retryAt)
+	return err
+}
+
+// Retry puts a dead job back in the queue with a fresh set of attempts.
+func (m JobModel) Retry(id int64) (*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'pending', attempts = 0, run_at = now()
+		WHERE id = $1 AND status = 'dead'
+		RETURNING ` + jobFields
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	job, err := scanJob(m.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+
+	return job, err
+}
+
+func (m JobModel) Get(id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + jobFields + ` FROM jobs WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	job, err := scanJob(m.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+
+	return job, err
+}
+
+func (m JobModel) GetAll(status string, kind string, filters Filters) ([]*Job, Metadata, error) {
+	q := listQuery{
+		columns: jobFields,
+		from:    `jobs`,
+		order:   filters.sortKeys(jobColumns, "id"),
+	}
+
+	if status != "" {
+		q.filter("status = " + q.arg(status))
+	}
+
+	if kind != "" {
+		q.filter("kind = " + q.arg(kind))
+	}
+
+	q.conditions(filters.Conditions, jobColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	jobs := []*Job{}
+	keys := []string{}
+
+	for rows.Next() {
+		var job Job
+		var payload []byte
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&job.ID,
+			&job.CreatedAt,
+			&job.Kind,
+			&payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.RunAt,
+			&job.LastError,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		job.Payload = payload
+
+		jobs = append(jobs, &job)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&jobs, keys, totalRecords)
+
+	return jobs, metadata, nil
+}
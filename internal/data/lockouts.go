@@ -0,0 +1,356 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LockoutPolicy decides how long sign in is blocked after failed attempts.
+// Each failure makes the next attempt wait Delay, doubled for every further
+// failure, and every Threshold failures lock sign in for Duration, doubled for
+// every further lockout up to a day. Failures are forgotten Reset after the
+// last one. A zero Delay means no waiting between attempts.
+type LockoutPolicy struct {
+	Threshold int
+	Duration  time.Duration
+	Delay     time.Duration
+	Reset     time.Duration
+}
+
+const maxLockout = 24 * time.Hour
+
+func backoff(base time.Duration, exponent int, max time.Duration) time.Duration {
+	d := base
+
+	for i := 0; i < exponent && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		return max
+	}
+
+	return d
+}
+
+// fail works out the state after one more failure at now. It reports whether
+// the failure locked sign in.
+func (p LockoutPolicy) fail(state *LoginFailures, now time.Time) bool {
+	if state.LastFailedAt == nil || now.Sub(*state.LastFailedAt) > p.Reset {
+		state.Failures = 0
+	}
+
+	state.Failures++
+	state.LastFailedAt = &now
+
+	if p.Threshold < 1 || state.Failures%p.Threshold != 0 {
+		return false
+	}
+
+	lockedUntil := now.Add(backoff(p.Duration, state.Failures/p.Threshold-1, maxLockout))
+	state.LockedUntil = &lockedUntil
+
+	return true
+}
+
+// Wait returns how long state blocks sign in for after now, which is 0 if
+// another attempt may be made.
+func (p LockoutPolicy) Wait(state *LoginFailures, now time.Time) time.Duration {
+	var wait time.Duration
+
+	if state.LockedUntil != nil {
+		wait = state.LockedUntil.Sub(now)
+	}
+
+	if p.Delay > 0 && state.Failures > 0 && state.LastFailedAt != nil && now.Sub(*state.LastFailedAt) <= p.Reset {
+		next := state.LastFailedAt.Add(backoff(p.Delay, state.Failures-1, p.Duration))
+		if next.Sub(now) > wait {
+			wait = next.Sub(now)
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// LoginFailures are the recent failed sign in attempts for a user or from an
+// IP address.
+type LoginFailures struct {
+	UserID       int64      `json:"user_id,omitempty"`
+	Email        string     `json:"email,omitempty"`
+	IP           string     `json:"ip,omitempty"`
+	Failures     int        `json:"failures"`
+	LastFailedAt *time.Time `json:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until"`
+}
+
+type LockoutModel struct {
+	DB *sql.DB
+}
+
+func scanLoginFailures(row interface{ Scan(...interface{}) error }, state *LoginFailures, key interface{}) error {
+	return row.Scan(key, &state.Failures, &state.LastFailedAt, &state.LockedUntil)
+}
+
+// GetUser returns the failed sign ins of a user.
+func (m LockoutModel) GetUser(userID int64) (*LoginFailures, error) {
+	query := `
+        SELECT id, email, failed_logins, last_failed_login_at, locked_until
+        FROM users
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var state LoginFailures
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&state.UserID, &state.Email, &state.Failures, &state.LastFailedAt, &state.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &state, nil
+}
+
+// GetIP returns the failed sign ins from an IP address.
+func (m LockoutModel) GetIP(ip string) (*LoginFailures, error) {
+	query := `
+        SELECT ip, failures, last_failed_at, locked_until
+        FROM login_ip_failures
+        WHERE ip = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var state LoginFailures
+
+	err := scanLoginFailures(m.DB.QueryRowContext(ctx, query, ip), &state, &state.IP)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &LoginFailures{IP: ip}, nil
+	}
+
+	return &state, err
+}
+
+// FailUser records a failed sign in by a user under policy, returning the new
+// state and whether it locked the user out.
+func (m LockoutModel) FailUser(userID int64, policy LockoutPolicy) (*LoginFailures, bool, error) {
+	var state LoginFailures
+	var locked bool
+
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+            SELECT id, email, failed_logins, last_failed_login_at, locked_until
+            FROM users
+            WHERE id = $1
+            FOR UPDATE`
+
+		err := tx.QueryRowContext(ctx, query, userID).Scan(&state.UserID, &state.Email, &state.Failures, &state.LastFailedAt, &state.LockedUntil)
+		if err != nil {
+			return err
+		}
+
+		locked = policy.fail(&state, time.Now())
+
+		query = `
+            UPDATE users
+            SET failed_logins = $2, last_failed_login_at = $3, locked_until = $4
+            WHERE id = $1`
+
+		_, err = tx.ExecContext(ctx, query, userID, state.Failures, state.LastFailedAt, state.LockedUntil)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &state, locked, nil
+}
+
+// FailIP records a failed sign in from an IP address under policy, returning
+// the new state and whether it locked the address out.
+func (m LockoutModel) FailIP(ip string, policy LockoutPolicy) (*LoginFailures, bool, error) {
+	state := LoginFailures{IP: ip}
+	var locked bool
+
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO login_ip_failures (ip) VALUES ($1) ON CONFLICT (ip) DO NOTHING`, ip)
+		if err != nil {
+			return err
+		}
+
+		query := `
+            SELECT ip, failures, last_failed_at, locked_until
+            FROM login_ip_failures
+            WHERE ip = $1
+            FOR UPDATE`
+
+		err = scanLoginFailures(tx.QueryRowContext(ctx, query, ip), &state, &state.IP)
+		if err != nil {
+			return err
+		}
+
+		locked = policy.fail(&state, time.Now())
+
+		query = `
+            UPDATE login_ip_failures
+            SET failures = $2, last_failed_at = $3, locked_until = $4
+            WHERE ip = $1`
+
+		_, err = tx.ExecContext(ctx, query, ip, state.Failures, state.LastFailedAt, state.LockedUntil)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &state, locked, nil
+}
+
+// ResetUser forgets a user's failed sign ins, unlocking them.
+func (m LockoutModel) ResetUser(userID int64) error {
+	query := `
+        UPDATE users
+        SET failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ResetIP forgets the failed sign ins from an IP address, unlocking it.
+func (m LockoutModel) ResetIP(ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM login_ip_failures WHERE ip = $1`, ip)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll returns the users and IP addresses with failed sign ins since reset
+// ago, or that are still locked out, most recent first.
+func (m LockoutModel) GetAll(reset time.Duration) ([]*LoginFailures, []*LoginFailures, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+        SELECT id, email, failed_logins, last_failed_login_at, locked_until
+        FROM users
+        WHERE failed_logins > 0 AND (last_failed_login_at > $1 OR locked_until > now())
+        ORDER BY last_failed_login_at DESC, id`
+
+	since := time.Now().Add(-reset)
+
+	rows, err := m.DB.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	users := []*LoginFailures{}
+
+	for rows.Next() {
+		var state LoginFailures
+
+		err := rows.Scan(&state.UserID, &state.Email, &state.Failures, &state.LastFailedAt, &state.LockedUntil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		users = append(users, &state)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	query = `
+        SELECT ip, failures, last_failed_at, locked_until
+        FROM login_ip_failures
+        WHERE last_failed_at > $1 OR locked_until > now()
+        ORDER BY last_failed_at DESC, ip`
+
+	ipRows, err := m.DB.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer ipRows.Close()
+
+	ips := []*LoginFailures{}
+
+	for ipRows.Next() {
+		var state LoginFailures
+
+		err := scanLoginFailures(ipRows, &state, &state.IP)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ips = append(ips, &state)
+	}
+
+	if err = ipRows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return users, ips, nil
+}
+
+// DeleteExpiredIPs removes the IP addresses whose failures are older than
+// reset and that are no longer locked out.
+func (m LockoutModel) DeleteExpiredIPs(reset time.Duration) (int64, error) {
+	query := `
+        DELETE FROM login_ip_failures
+        WHERE last_failed_at < $1 AND (locked_until IS NULL OR locked_until < now())`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-reset))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
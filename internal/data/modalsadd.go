@@ -1,6 +1,7 @@
 package data
 
 type RakMultiInsert struct {
+	Rak_id       int64  `json:"rak_id,omitempty"`
 	Rak_code     string `json:"rak_code"`
 	Rak_ket      string `json:"rak_ket"`
 	Warehouse_id int32  `json:"warehouse_id"`
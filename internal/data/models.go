@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -21,6 +23,22 @@ type Models struct {
 	Brand           BrandModel
 	BrandAssetModel BrandAssetModel
 	Stok            StokModel
+	Audit           AuditModel
+	Trash           TrashModel
+	Revisions       RevisionModel
+	Idempotency     IdempotencyModel
+	Webhooks        WebhookModel
+	Outbox          OutboxModel
+	Jobs            JobModel
+	Tasks           TaskModel
+	Reports         ReportModel
+	Emails          EmailModel
+	Roles           RoleModel
+	APIKeys         APIKeyModel
+	Sessions        SessionModel
+	Identities      IdentityModel
+	TwoFactor       TwoFactorModel
+	Lockouts        LockoutModel
 }
 
 func NewModels(db *sql.DB) Models {
@@ -35,5 +53,58 @@ func NewModels(db *sql.DB) Models {
 		Brand:           BrandModel{DB: db},
 		BrandAssetModel: BrandAssetModel{DB: db},
 		Stok:            StokModel{DB: db},
+		Audit:           AuditModel{DB: db},
+		Trash:           TrashModel{DB: db},
+		Revisions:       RevisionModel{DB: db},
+		Idempotency:     IdempotencyModel{DB: db},
+		Webhooks:        WebhookModel{DB: db},
+		Outbox:          OutboxModel{DB: db},
+		Jobs:            JobModel{DB: db},
+		Tasks:           TaskModel{DB: db},
+		Reports:         ReportModel{DB: db},
+		Emails:          EmailModel{DB: db},
+		Roles:           RoleModel{DB: db},
+		APIKeys:         APIKeyModel{DB: db},
+		Sessions:        SessionModel{DB: db},
+		Identities:      IdentityModel{DB: db},
+		TwoFactor:       TwoFactorModel{DB: db},
+		Lockouts:        LockoutModel{DB: db},
 	}
 }
+
+// Scoped returns the models with the warehouse, rak, stok and revision models
+// limited to scope.
+func (m Models) Scoped(scope *Scope) Models {
+	m.Warehouse.scope = scope
+	m.Rak.scope = scope
+	m.Stok.scope = scope
+	m.Revisions.scope = scope
+
+	return m
+}
+
+// Tx runs fn with the rak, brand, brand asset and stok models bound to one
+// transaction, which is committed only if fn returns nil.
+func (m Models) Tx(fn func(tx Models) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.Stok.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	bound := m
+	bound.Rak.tx = tx
+	bound.Brand.tx = tx
+	bound.BrandAssetModel.tx = tx
+	bound.Stok.tx = tx
+
+	err = fn(bound)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
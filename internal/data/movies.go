@@ -23,27 +23,41 @@ type Movie struct {
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(movie.Title != "", "title", validator.Required)
+	v.Check(len(movie.Title) <= 500, "title", validator.MaxLength, 500)
 
-	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+	v.Check(movie.Year != 0, "year", validator.Required)
+	v.Check(movie.Year >= 1888, "year", validator.GreaterThan, 1888)
+	v.Check(movie.Year <= int32(time.Now().Year()), "year", validator.NotInFuture)
 
-	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
+	v.Check(movie.Runtime != 0, "runtime", validator.Required)
+	v.Check(movie.Runtime > 0, "runtime", validator.Positive)
 
-	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.Check(movie.Genres != nil, "genres", validator.Required)
+	v.Check(len(movie.Genres) >= 1, "genres", validator.NotEmpty)
+	v.Check(len(movie.Genres) <= 5, "genres", validator.MaxItems, 5)
+	v.Check(validator.Unique(movie.Genres), "genres", validator.Duplicate)
 }
 
 type MovieModel struct {
 	DB *sql.DB
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+var movieColumns = map[string]string{
+	"id":      "id",
+	"title":   "title",
+	"year":    "year",
+	"runtime": "runtime",
+}
+
+var (
+	MovieFilterSafelist = safelist(movieColumns)
+	MovieSortSafelist   = sortSafelist(movieColumns)
+	MovieFieldSafelist  = jsonFields(Movie{})
+	MovieRelations      = map[string]string{}
+)
+
+func (m MovieModel) Insert(movie *Movie, actor Actor) error {
 	query := `
         INSERT INTO movies (title, year, runtime, genres) 
         VALUES ($1, $2, $3, $4)
@@ -51,10 +65,14 @@ func (m MovieModel) Insert(movie *Movie) error {
 
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+		if err != nil {
+			return err
+		}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+		return movieAudit.record(ctx, tx, actor, "insert", movie.ID, nil)
+	})
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
@@ -94,7 +112,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(movie *Movie, actor Actor) error {
 	query := `
         UPDATE movies 
         SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
@@ -110,77 +128,98 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := movieAudit.snapshot(ctx, tx, movie.ID)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return movieAudit.record(ctx, tx, actor, "update", movie.ID, old)
+	})
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(id int64, version int32, actor Actor) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
         DELETE FROM movies
-        WHERE id = $1`
+        WHERE id = $1 AND version = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := movieAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
+		result, err := tx.ExecContext(ctx, query, id, version)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
+
+		return movieAudit.record(ctx, tx, actor, "delete", id, old)
+	})
+}
+
+func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	q := listQuery{
+		columns: "id, created_at, title, year, runtime, genres, version",
+		from:    "movies",
+		order:   filters.sortKeys(movieColumns, "id"),
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
+	if title != "" {
+		q.filter(fmt.Sprintf("to_tsvector('simple', title) @@ plainto_tsquery('simple', %s)", q.arg(title)))
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	if len(genres) > 0 {
+		q.filter(fmt.Sprintf("genres @> %s", q.arg(pq.Array(genres))))
 	}
 
-	return nil
-}
+	q.conditions(filters.Conditions, movieColumns)
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-        FROM movies
-        WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
-        AND (genres @> $2 OR $2 = '{}')     
-        ORDER BY %s %s, id ASC
-        LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
-
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, listError(err)
 	}
 
 	defer rows.Close()
 
 	totalRecords := 0
 	movies := []*Movie{}
+	keys := []string{}
 
 	for rows.Next() {
 		var movie Movie
+		var key string
 
 		err := rows.Scan(
 			&totalRecords,
@@ -191,19 +230,21 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&key,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
 		movies = append(movies, &movie)
+		keys = append(keys, key)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := filters.paginate(&movies, keys, totalRecords)
 
 	return movies, metadata, nil
 }
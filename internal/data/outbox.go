@@ -0,0 +1,492 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OutboxChannel is the Postgres NOTIFY channel signalled whenever events are
+// written to the outbox.
+const OutboxChannel = "outbox"
+
+// OutboxEvent is a domain change as written to the outbox in the same
+// transaction as the change itself. Its JSON form is what subscribers such as
+// webhooks send on.
+type OutboxEvent struct {
+	ID         int64           `json:"id"`
+	TxID       int64           `json:"-"`
+	CreatedAt  time.Time       `json:"occurred_at"`
+	Event      string          `json:"event"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceID string          `json:"resource_id"`
+	UserID     *int64          `json:"user_id"`
+	RequestID  string          `json:"request_id"`
+	Data       json.RawMessage `json:"data"`
+	Changes    json.RawMessage `json:"changes"`
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// eventActions maps audit actions onto the past tense used in event names.
+var eventActions = map[string]string{
+	"insert":  "created",
+	"update":  "updated",
+	"delete":  "deleted",
+	"restore": "restored",
+	"revert":  "reverted",
+}
+
+// publish writes the events for a change made in tx to the outbox and
+// notifies listeners, which Postgres only does once tx commits.
+func (s auditSource) publish(ctx context.Context, tx *sql.Tx, actor Actor, action string, id interface{}, old, current json.RawMessage, changes []byte) error {
+	name, ok := eventActions[action]
+	if !ok {
+		return nil
+	}
+
+	events := []string{s.resource + "." + name}
+
+	if s.resource == "stok" && action != "insert" {
+		changed, err := quantitiesChanged(old, current)
+		if err != nil {
+			return err
+		}
+
+		if changed {
+			events = append(events, "stok.quantity_changed")
+		}
+	}
+
+	var data interface{}
+	if current != nil {
+		data = string(current)
+	}
+
+	query := `
+		INSERT INTO outbox (event, action, resource, resource_id, user_id, request_id, data, changes)
+		VALUES ($1, $2, $3, $4, NULLIF($5::bigint, 0), $6, $7, $8)`
+
+	for _, event := range events {
+		args := []interface{}{event, action, s.resource, fmt.Sprint(id), actor.UserID, actor.RequestID, data, string(changes)}
+
+		_, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.resource == "stok" {
+		err := publishStokDetails(ctx, tx, actor, id, old, current)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, "NOTIFY "+OutboxChannel)
+	return err
+}
+
+// publishStokDetails writes a stok_detail event for each detail of a stok
+// that was added, changed or removed between two snapshots, so that
+// subscribers limited to some warehouses can be sent only the details in
+// them. A detail's resource ID is "<stok id>/<warehouse id>/<rak id>".
+func publishStokDetails(ctx context.Context, tx *sql.Tx, actor Actor, id interface{}, old, current json.RawMessage) error {
+	before, err := stokDetails(old)
+	if err != nil {
+		return err
+	}
+
+	after, err := stokDetails(current)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+
+	for key := range before {
+		keys = append(keys, key)
+	}
+
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	query := `
+		INSERT INTO outbox (event, action, resource, resource_id, user_id, request_id, data, changes)
+		VALUES ($1, $2, 'stok_detail', $3, NULLIF($4::bigint, 0), $5, $6, $7)`
+
+	for _, key := range keys {
+		changes, err := detailChanges(before[key], after[key])
+		if err != nil {
+			return err
+		}
+
+		var action string
+
+		switch {
+		case before[key] == nil:
+			action = "insert"
+		case after[key] == nil:
+			action = "delete"
+		case changes == nil:
+			continue
+		default:
+			action = "update"
+		}
+
+		var data interface{}
+		if after[key] != nil {
+			detail := map[string]interface{}{}
+
+			err := json.Unmarshal(after[key], &detail)
+			if err != nil {
+				return err
+			}
+
+			detail["stok_id"] = id
+
+			js, err := json.Marshal(detail)
+			if err != nil {
+				return err
+			}
+
+			data = string(js)
+		}
+
+		args := []interface{}{"stok_detail." + eventActions[action], action, fmt.Sprint(id) + "/" + key, actor.UserID, actor.RequestID, data, string(changes)}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detailChanges returns the diff of two snapshots of a stok detail, leaving
+// out created_at and version, which change whenever the stok's details are
+// rewritten. It returns nil if nothing else changed.
+func detailChanges(old, current json.RawMessage) ([]byte, error) {
+	js, err := diff(old, current)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]json.RawMessage{}
+
+	err = json.Unmarshal(js, &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(changes, "created_at")
+	delete(changes, "version")
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(changes)
+}
+
+// stokDetails returns the details in a stok snapshot keyed by
+// "<warehouse id>/<rak id>", which is what tells details apart.
+func stokDetails(snapshot json.RawMessage) (map[string]json.RawMessage, error) {
+	details := map[string]json.RawMessage{}
+
+	if snapshot == nil {
+		return details, nil
+	}
+
+	var stok struct {
+		Details []json.RawMessage `json:"details"`
+	}
+
+	err := json.Unmarshal(snapshot, &stok)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, detail := range stok.Details {
+		var key struct {
+			WarehouseID json.Number `json:"warehouse_id"`
+			RakID       json.Number `json:"rak_id"`
+		}
+
+		err := json.Unmarshal(detail, &key)
+		if err != nil {
+			return nil, err
+		}
+
+		details[key.WarehouseID.String()+"/"+key.RakID.String()] = detail
+	}
+
+	return details, nil
+}
+
+// quantitiesChanged reports whether the qty of any stok detail differs
+// between two stok snapshots.
+func quantitiesChanged(old, current json.RawMessage) (bool, error) {
+	quantities := func(snapshot json.RawMessage) (map[string]string, error) {
+		qty := map[string]string{}
+
+		if snapshot == nil {
+			return qty, nil
+		}
+
+		var stok struct {
+			Details []struct {
+				WarehouseID json.Number `json:"warehouse_id"`
+				RakID       json.Number `json:"rak_id"`
+				Qty         json.Number `json:"qty"`
+			} `json:"details"`
+		}
+
+		err := json.Unmarshal(snapshot, &stok)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range stok.Details {
+			qty[d.WarehouseID.String()+"/"+d.RakID.String()] = d.Qty.String()
+		}
+
+		return qty, nil
+	}
+
+	before, err := quantities(old)
+	if err != nil {
+		return false, err
+	}
+
+	after, err := quantities(current)
+	if err != nil {
+		return false, err
+	}
+
+	return !reflect.DeepEqual(before, after), nil
+}
+
+const outboxColumns = `o.id, o.txid, o.created_at, o.event, o.action, o.resource, o.resource_id, o.user_id, o.request_id, o.data, o.changes`
+
+func scanOutboxEvents(rows *sql.Rows) ([]*OutboxEvent, error) {
+	defer rows.Close()
+
+	events := []*OutboxEvent{}
+
+	for rows.Next() {
+		var event OutboxEvent
+		var data, changes []byte
+
+		err := rows.Scan(
+			&event.ID,
+			&event.TxID,
+			&event.CreatedAt,
+			&event.Event,
+			&event.Action,
+			&event.Resource,
+			&event.ResourceID,
+			&event.UserID,
+			&event.RequestID,
+			&data,
+			&changes,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		event.Data = data
+		event.Changes = changes
+
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Register creates the cursor of a subscriber the first time it is seen,
+// positioned at the head of the outbox so that it does not replay history.
+func (m OutboxModel) Register(subscriber string) error {
+	query := `
+		INSERT INTO outbox_cursors (subscriber, txid, last_id)
+		SELECT $1, txid_snapshot_xmin(txid_current_snapshot()), 0
+		ON CONFLICT (subscriber) DO UPDATE SET updated_at = now()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, subscriber)
+	return err
+}
+
+// Pending returns up to limit events after the subscriber's cursor, in commit
+// order. Events are ordered by transaction ID and only returned once every
+// older transaction has finished, so one that commits late is never skipped.
+func (m OutboxModel) Pending(subscriber string, limit int) ([]*OutboxEvent, error) {
+	query := `
+		SELECT ` + outboxColumns + `
+		FROM outbox o
+		INNER JOIN outbox_cursors c ON c.subscriber = $1
+		WHERE (o.txid, o.id) > (c.txid, c.last_id)
+		AND o.txid < txid_snapshot_xmin(txid_current_snapshot())
+		ORDER BY o.txid, o.id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, subscriber, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOutboxEvents(rows)
+}
+
+// OutboxPosition is a point in the outbox; the events after it are those
+// with a greater (TxID, ID).
+type OutboxPosition struct {
+	TxID int64
+	ID   int64
+}
+
+// Head returns the position before every event that is not yet visible to
+// all readers. Reading from there may repeat a few recent events but never
+// misses one from a transaction that is still running.
+func (m OutboxModel) Head() (OutboxPosition, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var head OutboxPosition
+
+	err := m.DB.QueryRowContext(ctx, `SELECT txid_snapshot_xmin(txid_current_snapshot())`).Scan(&head.TxID)
+	return head, err
+}
+
+// After returns up to limit events for resources after position, in the same
+// order as Pending.
+func (m OutboxModel) After(position OutboxPosition, resources []string, limit int) ([]*OutboxEvent, error) {
+	query := `
+		SELECT ` + outboxColumns + `
+		FROM outbox o
+		WHERE (o.txid, o.id) > ($1, $2) AND o.resource = ANY($3)
+		AND o.txid < txid_snapshot_xmin(txid_current_snapshot())
+		ORDER BY o.txid, o.id
+		LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, position.TxID, position.ID, pq.Array(resources), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOutboxEvents(rows)
+}
+
+// Ack moves the subscriber's cursor past event.
+func (m OutboxModel) Ack(subscriber string, event *OutboxEvent) error {
+	query := `
+		UPDATE outbox_cursors
+		SET txid = $2, last_id = $3, updated_at = now()
+		WHERE subscriber = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, subscriber, event.TxID, event.ID)
+	return err
+}
+
+// OutboxCursor is a subscriber's position in the outbox.
+type OutboxCursor struct {
+	Subscriber string
+	UpdatedAt  time.Time
+	// Oldest is when the oldest event the subscriber has yet to handle
+	// was written.
+	Oldest time.Time
+}
+
+// DeleteExpired removes events older than retention that every subscriber
+// has handled. A subscriber that stops moving holds every event after its
+// cursor back, however old, until its cursor is removed; Stalled finds them.
+func (m OutboxModel) DeleteExpired(retention time.Duration) (int, error) {
+	query := `
+		DELETE FROM outbox o
+		WHERE o.created_at < $1
+		AND NOT EXISTS (
+			SELECT 1 FROM outbox_cursors c
+			WHERE (c.txid, c.last_id) < (o.txid, o.id))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// Stalled returns the subscribers that have not handled an event older than
+// retention, which DeleteExpired is keeping for them.
+func (m OutboxModel) Stalled(retention time.Duration) ([]*OutboxCursor, error) {
+	query := `
+		SELECT c.subscriber, c.updated_at, min(o.created_at)
+		FROM outbox_cursors c
+		INNER JOIN outbox o ON (o.txid, o.id) > (c.txid, c.last_id)
+		WHERE o.created_at < $1
+		GROUP BY c.subscriber, c.updated_at
+		ORDER BY c.subscriber`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now().Add(-retention))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	cursors := []*OutboxCursor{}
+
+	for rows.Next() {
+		var cursor OutboxCursor
+
+		err := rows.Scan(&cursor.Subscriber, &cursor.UpdatedAt, &cursor.Oldest)
+		if err != nil {
+			return nil, err
+		}
+
+		cursors = append(cursors, &cursor)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cursors, nil
+}
@@ -0,0 +1,93 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutboxDeleteExpired(t *testing.T) {
+	m := OutboxModel{DB: newTestDB(t)}
+
+	subscriber := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	err := m.Register(subscriber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { m.DB.Exec(`DELETE FROM outbox_cursors WHERE subscriber = $1`, subscriber) })
+
+	var event OutboxEvent
+
+	err = m.DB.QueryRow(`
+		INSERT INTO outbox (event, action, resource, resource_id, changes, created_at)
+		VALUES ('test.created', 'insert', 'test', '1', '{}', now() - interval '2 days')
+		RETURNING id, txid`).Scan(&event.ID, &event.TxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { m.DB.Exec(`DELETE FROM outbox WHERE id = $1`, event.ID) })
+
+	exists := func() bool {
+		t.Helper()
+
+		var exists bool
+
+		err := m.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM outbox WHERE id = $1)`, event.ID).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return exists
+	}
+
+	stalled := func() bool {
+		t.Helper()
+
+		cursors, err := m.Stalled(24 * time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, cursor := range cursors {
+			if cursor.Subscriber == subscriber {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	_, err = m.DeleteExpired(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists() {
+		t.Fatal("an event the subscriber has not handled was deleted")
+	}
+
+	if !stalled() {
+		t.Error("the subscriber is not reported as stalled")
+	}
+
+	err = m.Ack(subscriber, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stalled() {
+		t.Error("the subscriber is still reported as stalled after handling the event")
+	}
+
+	_, err = m.DeleteExpired(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists() {
+		t.Error("a handled event older than the retention was kept")
+	}
+}
@@ -23,13 +23,50 @@ type PermissionModel struct {
 	DB *sql.DB
 }
 
+// GetAll returns the code of every permission, in order.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT code FROM permissions ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// GetAllForUser returns the permissions a user has been given directly and
+// those that come with the user's roles.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
         SELECT permissions.code
         FROM permissions
         INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-        INNER JOIN users ON users_permissions.user_id = users.id
-        WHERE users.id = $1`
+        WHERE users_permissions.user_id = $1
+        UNION
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+        INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+        WHERE users_roles.user_id = $1`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -59,6 +96,49 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
+// ScopeForUser returns the warehouses in which a user holds a permission. It
+// returns AllWarehouses if the user holds the permission directly or through
+// a role given without a warehouse or perusahaan, as such grants are not
+// limited.
+func (m PermissionModel) ScopeForUser(userID int64, code string) (*Scope, error) {
+	query := `
+        WITH grants AS (
+            SELECT NULL::bigint AS warehouse_id, NULL::bigint AS perusahaan_id
+            FROM users_permissions
+            INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+            WHERE users_permissions.user_id = $1 AND permissions.code = $2
+            UNION ALL
+            SELECT users_roles.warehouse_id, users_roles.perusahaan_id
+            FROM users_roles
+            INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+            INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+            WHERE users_roles.user_id = $1 AND permissions.code = $2
+        )
+        SELECT
+            coalesce(bool_or(warehouse_id IS NULL AND perusahaan_id IS NULL), false),
+            array(SELECT DISTINCT w.warehouse_id FROM warehouse w INNER JOIN grants g
+                ON g.warehouse_id = w.warehouse_id OR g.perusahaan_id = w.perusahaan_id ORDER BY 1),
+            array(SELECT DISTINCT perusahaan_id FROM grants WHERE perusahaan_id IS NOT NULL ORDER BY 1)
+        FROM grants`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var unlimited bool
+	var scope Scope
+
+	err := m.DB.QueryRowContext(ctx, query, userID, code).Scan(&unlimited, pq.Array(&scope.Warehouses), pq.Array(&scope.Perusahaans))
+	if err != nil {
+		return nil, err
+	}
+
+	if unlimited {
+		return AllWarehouses(), nil
+	}
+
+	return &scope, nil
+}
+
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
         INSERT INTO users_permissions
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/lib/pq"
 )
 
 type Perusahaan struct {
@@ -24,18 +26,35 @@ type Perusahaan struct {
 }
 
 func ValidatePerusahaan(v *validator.Validator, usaha *Perusahaan) {
-	v.Check(usaha.Name != "", "Nama", "harus diisi")
-	v.Check(len(usaha.Address) >= 1888, "Alamat", "harus lebih besar dari 10 karakter")
+	v.Check(usaha.Name != "", "Nama", validator.Required)
+	v.Check(len(usaha.Address) >= 1888, "Alamat", validator.MinLength, 1888)
 
-	v.Check(usaha.Tlp != "", "Tlp", "harus  diisi")
-	v.Check(usaha.Npwp != "", "NPWP", "harus  diisi")
+	v.Check(usaha.Tlp != "", "Tlp", validator.Required)
+	v.Check(usaha.Npwp != "", "NPWP", validator.Required)
 }
 
 type PerusahaanModel struct {
 	DB *sql.DB
 }
 
-func (m PerusahaanModel) Insert(usaha *Perusahaan) error {
+var perusahaanColumns = map[string]string{
+	"id":      "id",
+	"name":    "name",
+	"address": "address",
+	"tlp":     "tlp",
+	"npwp":    "npwp",
+	"rek":     "rek",
+	"ket":     "ket",
+}
+
+var (
+	PerusahaanFilterSafelist = safelist(perusahaanColumns)
+	PerusahaanSortSafelist   = sortSafelist(perusahaanColumns)
+	PerusahaanFieldSafelist  = jsonFields(Perusahaan{})
+	PerusahaanRelations      = map[string]string{}
+)
+
+func (m PerusahaanModel) Insert(usaha *Perusahaan, actor Actor) error {
 	query := `
 		INSERT INTO perusahaan (name, address, tlp, npwp,rek,ket) 
 		VALUES ($1, $2, $3, $4,$5,$6)
@@ -43,11 +62,14 @@ func (m PerusahaanModel) Insert(usaha *Perusahaan) error {
 
 	args := []interface{}{usaha.Name, usaha.Address, usaha.Tlp, usaha.Npwp, usaha.Rek, usaha.Ket}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&usaha.ID, &usaha.CreatedAt, &usaha.Version)
+		if err != nil {
+			return err
+		}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.ID, &usaha.CreatedAt,
-		&usaha.Version)
+		return perusahaanAudit.record(ctx, tx, actor, "insert", usaha.ID, nil)
+	})
 }
 
 func (m PerusahaanModel) Get(id int64) (*Perusahaan, error) {
@@ -89,7 +111,7 @@ func (m PerusahaanModel) Get(id int64) (*Perusahaan, error) {
 	return &usaha, nil
 }
 
-func (m PerusahaanModel) Update(usaha *Perusahaan) error {
+func (m PerusahaanModel) Update(usaha *Perusahaan, actor Actor) error {
 	query := `
 	UPDATE perusahaan 
 	SET name = $1, address = $2, tlp = $3, npwp = $4, rek=$5,ket=$6, version = version + 1
@@ -107,95 +129,96 @@ func (m PerusahaanModel) Update(usaha *Perusahaan) error {
 		usaha.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := perusahaanAudit.snapshot(ctx, tx, usaha.ID)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return perusahaanAudit.record(ctx, tx, actor, "update", usaha.ID, old)
+	})
 }
 
-func (m PerusahaanModel) Delete(id int64) error {
+func (m PerusahaanModel) Delete(id int64, version int32, actor Actor) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
         DELETE FROM perusahaan
-        WHERE id = $1`
+        WHERE id = $1 AND version = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := perusahaanAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+		result, err := tx.ExecContext(ctx, query, id, version)
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
-	}
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
 
-	return nil
+		return perusahaanAudit.record(ctx, tx, actor, "delete", id, old)
+	})
 }
 
 func (m PerusahaanModel) GetAll(name string, filters Filters) ([]*Perusahaan, Metadata, error) {
+	q := listQuery{
+		columns: `id, created_at, name, address, tlp, npwp, rek, ket, version, 0`,
+		from:    `perusahaan`,
+		order:   filters.sortKeys(perusahaanColumns, "id"),
+	}
 
-	// query := " select *,row_number() over() rn from (SELECT count(*) OVER(), id, created_at, name, address, tlp, npwp, rek,ket,version
-	// FROM perusahaan
-	// WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-	// ORDER BY name ASC) a
-	// LIMIT $2 OFFSET $3 "
+	if name != "" {
+		q.filter(fmt.Sprintf("to_tsvector('simple', name) @@ plainto_tsquery('simple', %s)", q.arg(name)))
+	}
 
-	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, name, address, tlp, npwp, rek,ket,version,0
-        FROM perusahaan
-        WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')  
-        ORDER BY %s %s 
-		LIMIT $2 OFFSET $3`, "name", "asc")
-
-	// query := fmt.Sprintf(`
-	// SELECT count(*) OVER(), id, created_at, name, address, tlp, npwp, rek,ket,version,
-	// row_number() over ()rn
-	// FROM perusahaan
-	// WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-	// ORDER BY %s %s, id ASC
-	// LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	q.conditions(filters.Conditions, perusahaanColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	//args := []interface{}{name}
-	args := []interface{}{name, filters.limit(), filters.offset()}
-
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		fmt.Println("err-db")
-		return nil, Metadata{}, err
+		return nil, Metadata{}, listError(err)
 	}
 
 	defer rows.Close()
 
 	totalRecords := 0
 	usahas := []*Perusahaan{}
+	keys := []string{}
 
 	for rows.Next() {
 		var usaha Perusahaan
+		var key string
 
-		//SELECT count(*) OVER(), id, created_at, name, address, tlp, npwp, rek,ket,version-10
 		err := rows.Scan(
 			&totalRecords,
 			&usaha.ID,
@@ -208,19 +231,71 @@ func (m PerusahaanModel) GetAll(name string, filters Filters) ([]*Perusahaan, Me
 			&usaha.Ket,
 			&usaha.Version,
 			&usaha.Rn,
+			&key,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
 		usahas = append(usahas, &usaha)
+		keys = append(keys, key)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := filters.paginate(&usahas, keys, totalRecords)
 
 	return usahas, metadata, nil
 }
+
+func (m PerusahaanModel) getMany(ids []int64) (map[int64]*Perusahaan, error) {
+	usahas := make(map[int64]*Perusahaan)
+
+	if len(ids) == 0 {
+		return usahas, nil
+	}
+
+	query := `
+        SELECT id, created_at,name, address, tlp, npwp,rek,ket,version
+        FROM perusahaan
+        WHERE id = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var usaha Perusahaan
+
+		err := rows.Scan(
+			&usaha.ID,
+			&usaha.CreatedAt,
+			&usaha.Name,
+			&usaha.Address,
+			&usaha.Tlp,
+			&usaha.Npwp,
+			&usaha.Rek,
+			&usaha.Ket,
+			&usaha.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		usahas[usaha.ID] = &usaha
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return usahas, nil
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"reflect"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// Projection carries the fields= and include= query parameters. Relations
+// maps each include name a resource supports to the JSON key it embeds.
+type Projection struct {
+	Fields        []string
+	Include       []string
+	FieldSafelist []string
+	Relations     map[string]string
+}
+
+func ValidateProjection(v *validator.Validator, p Projection) {
+	for _, field := range p.Fields {
+		v.Check(inFold(field, p.FieldSafelist), "fields", validator.UnknownField, field)
+	}
+
+	for _, relation := range p.Include {
+		_, ok := p.Relations[relation]
+		v.Check(ok, "include", validator.UnknownInclude, relation)
+	}
+
+	v.Check(validator.Unique(p.Include), "include", validator.Duplicate)
+}
+
+// wants reports whether field is part of the response. Field names are
+// matched case-insensitively because some JSON tags are capitalised.
+func (p Projection) wants(field string) bool {
+	return len(p.Fields) == 0 || inFold(field, p.Fields)
+}
+
+func (p Projection) includes(relation string) bool {
+	return validator.In(relation, p.Include...)
+}
+
+// Keys lists the top-level JSON keys to keep in the response, or nil when
+// no fields were requested and the full representation should be sent.
+func (p Projection) Keys() []string {
+	if len(p.Fields) == 0 {
+		return nil
+	}
+
+	keys := append([]string{}, p.Fields...)
+
+	for _, relation := range p.Include {
+		keys = append(keys, p.Relations[relation])
+	}
+
+	return keys
+}
+
+func inFold(value string, list []string) bool {
+	for i := range list {
+		if strings.EqualFold(value, list[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFields lists the JSON keys of a record type, for use as a field
+// safelist.
+func jsonFields(record interface{}) []string {
+	t := reflect.TypeOf(record)
+	fields := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fields = append(fields, name)
+	}
+
+	return fields
+}
@@ -19,18 +19,56 @@ type Rak struct {
 	User_modified  *string    `json:"user_modified"`
 	Warehouse_id   *int32     `json:"warehouse_id"`
 	Name_warehouse *string    `json:"Name_warehouse"`
+	Warehouse      *Warehouse `json:"warehouse,omitempty"`
 }
 
 func ValidateRak(v *validator.Validator, rak *Rak) {
-	v.Check(rak.Rak_code != nil, "Code Rak", "harus diisi")
+	v.Check(rak.Rak_code != nil, "Code Rak", validator.Required)
 
 }
 
 type RakModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	tx    *sql.Tx
+	scope *Scope
 }
 
-func (m RakModel) Insert(usaha *[]RakMultiInsert) error {
+func (m RakModel) db() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+var rakColumns = map[string]string{
+	"rak_id":         "a.rak_id",
+	"rak_code":       "a.rak_code",
+	"rak_ket":        "a.rak_ket",
+	"warehouse_id":   "a.warehouse_id",
+	"name_warehouse": "b.name_warehouse",
+	"user_modified":  "a.user_modified",
+	"created_at":     "a.created_at",
+	"version":        "a.version",
+	"qty":            "(select coalesce(sum(sd.qty), 0) from stok_detail sd inner join stok st on st.id = sd.stok_id where sd.rak_id = a.rak_id and st.deleted_at is null)",
+}
+
+var rakJoins = map[string]string{
+	"b": "inner join warehouse b on a.warehouse_id = b.warehouse_id",
+}
+
+var (
+	RakFilterSafelist = safelist(rakColumns)
+	RakSortSafelist   = sortSafelist(rakColumns)
+	RakFieldSafelist  = jsonFields(Rak{})
+	RakRelations      = map[string]string{"warehouse": "warehouse"}
+)
+
+func (m RakModel) Insert(usaha *[]RakMultiInsert, actor Actor) error {
+	for _, row := range *usaha {
+		if !m.scope.allowsWarehouse(int64(row.Warehouse_id)) {
+			return ErrOutOfScope
+		}
+	}
 
 	sqlStr := "INSERT INTO rak (rak_code,rak_ket,warehouse_id) VALUES "
 	vals := []interface{}{}
@@ -48,16 +86,45 @@ func (m RakModel) Insert(usaha *[]RakMultiInsert) error {
 	}
 
 	//trim the last ,
-	sqlStr = sqlStr[0 : len(sqlStr)-1]
-	//prepare the statement
-	stmt, _ := m.DB.Prepare(sqlStr)
+	sqlStr = sqlStr[0:len(sqlStr)-1] + " RETURNING rak_id"
 
-	//format all vals at once
-	_, err := stmt.Exec(vals...)
-	if err != nil {
-		return err
-	}
-	return nil
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, sqlStr, vals...)
+		if err != nil {
+			return err
+		}
+
+		ids := []int64{}
+
+		for rows.Next() {
+			var id int64
+
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			ids = append(ids, id)
+		}
+
+		rows.Close()
+
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for i, id := range ids {
+			(*usaha)[i].Rak_id = id
+
+			err = rakAudit.record(ctx, tx, actor, "insert", id, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 
 	// query := `INSERT INTO rak (rak_code, rak_ket, warehouse_id)
 	// VALUES ($1, $2, $3)
@@ -68,7 +135,7 @@ func (m RakModel) Insert(usaha *[]RakMultiInsert) error {
 	// ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	// defer cancel()
 
-	// return m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.Rak_id, &usaha.Created_at,
+	// return m.db().QueryRowContext(ctx, query, args...).Scan(&usaha.Rak_id, &usaha.Created_at,
 	// 	&usaha.Version)
 }
 
@@ -80,7 +147,8 @@ func (m RakModel) Get(id int64) (*Rak, error) {
 	query := ` select a.rak_id,a.created_at,a.rak_code,a.rak_ket,a.version,a.user_modified,a.warehouse_id,b.name_warehouse
 	from rak a
 	inner join warehouse b on a.warehouse_id=b.warehouse_id
-	where a.rak_id=$1 `
+	where a.rak_id=$1 and a.deleted_at is null
+	and ($2::bigint[] is null or a.warehouse_id = any($2))`
 
 	var usaha Rak
 
@@ -90,7 +158,7 @@ func (m RakModel) Get(id int64) (*Rak, error) {
 	//a.rak_id,a.created_at,a.rak_code,a.rak_ket,a.version,
 	//a.modified_at,a.user_modified,a.warehouse_id,b.name_warehouse
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.db().QueryRowContext(ctx, query, id, m.scope.warehouses()).Scan(
 		&usaha.Rak_id,
 		&usaha.Created_at,
 		&usaha.Rak_code,
@@ -113,11 +181,12 @@ func (m RakModel) Get(id int64) (*Rak, error) {
 	return &usaha, nil
 }
 
-func (m RakModel) Update(usaha *Rak) error {
+func (m RakModel) Update(usaha *Rak, actor Actor) error {
 	query := `
 	UPDATE rak 
 	SET rak_code = $1, rak_ket = $2, version = version + 1, modified_at= now(),warehouse_id = $3
-	WHERE rak_id = $4 AND version = $5
+	WHERE rak_id = $4 AND version = $5 AND deleted_at IS NULL
+	AND ($6::bigint[] IS NULL OR warehouse_id = ANY($6))
 	RETURNING version`
 
 	args := []interface{}{
@@ -126,84 +195,146 @@ func (m RakModel) Update(usaha *Rak) error {
 		usaha.Warehouse_id,
 		usaha.Rak_id,
 		usaha.Version,
+		m.scope.warehouses(),
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	if usaha.Warehouse_id != nil && !m.scope.allowsWarehouse(int64(*usaha.Warehouse_id)) {
+		return ErrOutOfScope
+	}
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := rakAudit.snapshot(ctx, tx, *usaha.Rak_id)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return rakAudit.record(ctx, tx, actor, "update", *usaha.Rak_id, old)
+	})
 }
 
-func (m RakModel) Delete(id int64) error {
+func (m RakModel) Delete(id int64, version int32, actor Actor) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-        DELETE FROM rak
-        WHERE rak_id = $1`
+        UPDATE rak
+        SET deleted_at = now(), deleted_by = NULLIF($3::bigint, 0), version = version + 1
+        WHERE rak_id = $1 AND version = $2 AND deleted_at IS NULL
+        AND ($4::bigint[] IS NULL OR warehouse_id = ANY($4))`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := rakAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+		result, err := tx.ExecContext(ctx, query, id, version, actor.UserID, m.scope.warehouses())
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
+
+		return rakAudit.record(ctx, tx, actor, "delete", id, old)
+	})
+}
 
-	if rowsAffected == 0 {
+func (m RakModel) Restore(id int64, actor Actor) error {
+	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	query := `
+        UPDATE rak
+        SET deleted_at = NULL, deleted_by = NULL, version = version + 1
+        WHERE rak_id = $1 AND deleted_at IS NOT NULL
+        AND ($2::bigint[] IS NULL OR warehouse_id = ANY($2))`
+
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := rakAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, query, id, m.scope.warehouses())
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return rakAudit.record(ctx, tx, actor, "restore", id, old)
+	})
 }
 
 func (m RakModel) GetAll(code string, warehousename string, ket string, filters Filters) ([]*Rak, Metadata, error) {
+	q := listQuery{
+		from:  "rak a",
+		joins: rakJoins,
+		order: filters.sortKeys(rakColumns, "a.rak_id"),
+	}
 
-	query := fmt.Sprintf(`
-	SELECT count(*) OVER(),a.rak_id,a.created_at,a.rak_code,a.rak_ket,a.version,
-	a.user_modified,a.warehouse_id,b.name_warehouse
-	FROM rak a
-	inner join warehouse b on a.warehouse_id=b.warehouse_id
-	where lower(a.rak_code) like lower('%%` + code + `%%') and  lower(b.name_warehouse) like lower('%%` + warehousename + `%%') 
-	and lower(a.rak_ket) like lower('%%` + ket + `%%')
-	ORDER BY a.created_at desc
-	LIMIT $1 OFFSET $2`)
+	q.selects(filters.Projection, rakColumns,
+		"rak_id", "created_at", "rak_code", "rak_ket", "version", "user_modified", "warehouse_id", "name_warehouse")
+
+	q.filter("a.deleted_at IS NULL")
+	m.scope.filter(&q, "a.warehouse_id = ANY(%s)")
+
+	q.like("a.rak_code", code)
+	q.like("b.name_warehouse", warehousename)
+	q.like("a.rak_ket", ket)
+
+	q.conditions(filters.Conditions, rakColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	//args := []interface{}{name}
-	args := []interface{}{filters.limit(), filters.offset()}
-
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.db().QueryContext(ctx, query, args...)
 	if err != nil {
 		fmt.Println("err-db")
-		return nil, Metadata{}, err
+		return nil, Metadata{}, listError(err)
 	}
 
 	defer rows.Close()
 
 	totalRecords := 0
 	usahas := []*Rak{}
+	keys := []string{}
 
 	for rows.Next() {
 		var usaha Rak
+		var key string
+
 		err := rows.Scan(
 			&totalRecords,
 			&usaha.Rak_id,
@@ -214,19 +345,67 @@ func (m RakModel) GetAll(code string, warehousename string, ket string, filters
 			&usaha.User_modified,
 			&usaha.Warehouse_id,
 			&usaha.Name_warehouse,
+			&key,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
 		usahas = append(usahas, &usaha)
+		keys = append(keys, key)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := filters.paginate(&usahas, keys, totalRecords)
+
+	if filters.includes("warehouse") {
+		err = m.loadWarehouses(usahas)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
 
 	return usahas, metadata, nil
 }
+
+func (m RakModel) GetWith(id int64, p Projection) (*Rak, error) {
+	usaha, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.includes("warehouse") {
+		err = m.loadWarehouses([]*Rak{usaha})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return usaha, nil
+}
+
+func (m RakModel) loadWarehouses(usahas []*Rak) error {
+	ids := []int64{}
+
+	for _, usaha := range usahas {
+		if usaha.Warehouse_id != nil {
+			ids = append(ids, int64(*usaha.Warehouse_id))
+		}
+	}
+
+	warehouses, err := WarehouseModel{DB: m.DB}.getMany(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, usaha := range usahas {
+		if usaha.Warehouse_id != nil {
+			usaha.Warehouse = warehouses[int64(*usaha.Warehouse_id)]
+		}
+	}
+
+	return nil
+}
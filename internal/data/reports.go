@@ -0,0 +1,132 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type LowStockItem struct {
+	StokID string  `json:"stok_id"`
+	Code   string  `json:"produk_code"`
+	Ket    string  `json:"produk_ket"`
+	Qty    float64 `json:"qty"`
+}
+
+type WarehouseStock struct {
+	WarehouseID int64   `json:"warehouse_id"`
+	Name        string  `json:"name_warehouse"`
+	Items       int     `json:"items"`
+	Qty         float64 `json:"qty"`
+}
+
+type ReportModel struct {
+	DB *sql.DB
+}
+
+// Snapshot records the quantity held of every live stok item in every rak
+// for day. Taking a snapshot of a day twice keeps the first one.
+func (m ReportModel) Snapshot(day time.Time) (int64, error) {
+	query := `
+		INSERT INTO stock_snapshots (snapshot_date, stok_id, warehouse_id, rak_id, qty)
+		SELECT $1::date, d.stok_id::text, d.warehouse_id, d.rak_id, sum(d.qty)
+		FROM stok_detail d
+		INNER JOIN stok s ON s.id = d.stok_id
+		WHERE s.deleted_at IS NULL
+		GROUP BY d.stok_id, d.warehouse_id, d.rak_id
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, day.Format("2006-01-02"))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// LowStock returns the live stok items whose total quantity across all
+// warehouses is below threshold, lowest first.
+func (m ReportModel) LowStock(threshold float64) ([]*LowStockItem, error) {
+	query := `
+		SELECT s.id::text, coalesce(s.produk_code, ''), coalesce(s.produk_ket, ''), coalesce(sum(d.qty), 0) qty
+		FROM stok s
+		LEFT JOIN stok_detail d ON d.stok_id = s.id
+		WHERE s.deleted_at IS NULL
+		GROUP BY s.id
+		HAVING coalesce(sum(d.qty), 0) < $1
+		ORDER BY qty, s.produk_code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items := []*LowStockItem{}
+
+	for rows.Next() {
+		var item LowStockItem
+
+		err := rows.Scan(&item.StokID, &item.Code, &item.Ket, &item.Qty)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// StockByWarehouse returns the number of distinct stok items and their total
+// quantity held in each live warehouse.
+func (m ReportModel) StockByWarehouse() ([]*WarehouseStock, error) {
+	query := `
+		SELECT w.warehouse_id, coalesce(w.name_warehouse, ''), count(DISTINCT s.id), coalesce(sum(d.qty) FILTER (WHERE s.id IS NOT NULL), 0)
+		FROM warehouse w
+		LEFT JOIN stok_detail d ON d.warehouse_id = w.warehouse_id
+		LEFT JOIN stok s ON s.id = d.stok_id AND s.deleted_at IS NULL
+		WHERE w.deleted_at IS NULL
+		GROUP BY w.warehouse_id
+		ORDER BY w.name_warehouse`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stocks := []*WarehouseStock{}
+
+	for rows.Next() {
+		var stock WarehouseStock
+
+		err := rows.Scan(&stock.WarehouseID, &stock.Name, &stock.Items, &stock.Qty)
+		if err != nil {
+			return nil, err
+		}
+
+		stocks = append(stocks, &stock)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stocks, nil
+}
@@ -0,0 +1,306 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type Revision struct {
+	Resource   string          `json:"resource"`
+	ResourceID string          `json:"resource_id"`
+	Version    int32           `json:"version"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UserID     *int64          `json:"user_id"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+type RevisionModel struct {
+	DB    *sql.DB
+	scope *Scope
+}
+
+var revisionSources = map[string]auditSource{
+	"brand":     brandAudit,
+	"rak":       rakAudit,
+	"warehouse": warehouseAudit,
+	"stok":      stokAudit,
+}
+
+var revisionColumns = map[string]string{
+	"version":    "version",
+	"created_at": "created_at",
+	"user_id":    "user_id",
+}
+
+var (
+	RevisionFilterSafelist = safelist(revisionColumns)
+	RevisionSortSafelist   = sortSafelist(revisionColumns)
+)
+
+func (s auditSource) saveRevision(ctx context.Context, tx *sql.Tx, actor Actor, id interface{}, snapshot json.RawMessage) error {
+	query := `
+		INSERT INTO revisions (resource, resource_id, version, user_id, data)
+		VALUES ($1, $2, ($4::jsonb->>'version')::integer, NULLIF($3::bigint, 0), $4)
+		ON CONFLICT DO NOTHING`
+
+	_, err := tx.ExecContext(ctx, query, s.resource, fmt.Sprint(id), actor.UserID, string(snapshot))
+	return err
+}
+
+// live returns the condition that excludes soft-deleted rows, if the table
+// has them.
+func (s auditSource) live() string {
+	if s.softDelete {
+		return " AND t.deleted_at IS NULL"
+	}
+	return ""
+}
+
+// visible returns ErrRecordNotFound if a record is outside the model's scope.
+func (m RevisionModel) visible(ctx context.Context, db querier, s auditSource, id string) error {
+	if m.scope.Unlimited() || s.inScope == "" {
+		return nil
+	}
+
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s t WHERE t.%s = $1 AND %s)`, s.table, s.key, fmt.Sprintf(s.inScope, "$2"))
+
+	var found bool
+
+	err := db.QueryRowContext(ctx, query, id, m.scope.warehouses()).Scan(&found)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Code.Class() == "22":
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if !found {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Version returns the current version of a record that keeps revisions.
+func (m RevisionModel) Version(resource string, id string) (int32, error) {
+	s, ok := revisionSources[resource]
+	if !ok {
+		return 0, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`SELECT t.version FROM %s t WHERE t.%s = $1%s`, s.table, s.key, s.live())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var version int32
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&version)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		case errors.As(err, &pqErr) && pqErr.Code.Class() == "22":
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	err = m.visible(ctx, m.DB, s, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (m RevisionModel) GetAll(resource string, id string, filters Filters) ([]*Revision, Metadata, error) {
+	err := m.visible(context.Background(), m.DB, revisionSources[resource], id)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	q := listQuery{
+		columns: `resource, resource_id, version, created_at, user_id`,
+		from:    `revisions`,
+		order:   filters.sortKeys(revisionColumns, "version"),
+	}
+
+	q.filter("resource = " + q.arg(resource))
+	q.filter("resource_id = " + q.arg(id))
+
+	q.conditions(filters.Conditions, revisionColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	revisions := []*Revision{}
+	keys := []string{}
+
+	for rows.Next() {
+		var revision Revision
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&revision.Resource,
+			&revision.ResourceID,
+			&revision.Version,
+			&revision.CreatedAt,
+			&revision.UserID,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		revisions = append(revisions, &revision)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&revisions, keys, totalRecords)
+
+	return revisions, metadata, nil
+}
+
+const revisionQuery = `
+	SELECT resource, resource_id, version, created_at, user_id, data
+	FROM revisions
+	WHERE resource = $1 AND resource_id = $2 AND version = $3`
+
+func scanRevision(row *sql.Row) (*Revision, error) {
+	var revision Revision
+	var data []byte
+
+	err := row.Scan(
+		&revision.Resource,
+		&revision.ResourceID,
+		&revision.Version,
+		&revision.CreatedAt,
+		&revision.UserID,
+		&data,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	revision.Data = data
+
+	return &revision, nil
+}
+
+func (m RevisionModel) Get(resource string, id string, version int32) (*Revision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.visible(ctx, m.DB, revisionSources[resource], id)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanRevision(m.DB.QueryRowContext(ctx, revisionQuery, resource, id, version))
+}
+
+// Revert writes the contents of an old revision back to the record as a new
+// version. current is the version the caller expects the record to be at.
+// With a scope, ErrOutOfScope is returned if the reverted record would fall
+// outside it.
+func (m RevisionModel) Revert(resource string, id string, version int32, current int32, actor Actor) (int32, error) {
+	s, ok := revisionSources[resource]
+	if !ok {
+		return 0, ErrRecordNotFound
+	}
+
+	columns := strings.Join(s.revert, ", ")
+	query := fmt.Sprintf(`
+		UPDATE %s t
+		SET (%s) = (SELECT r.%s FROM jsonb_populate_record(NULL::%s, $2::jsonb) r),
+			modified_at = now(), version = t.version + 1
+		WHERE t.%s = $1 AND t.version = $3%s
+		RETURNING t.version`,
+		s.table, columns, strings.Join(s.revert, ", r."), s.table, s.key, s.live())
+
+	var reverted int32
+
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		revision, err := scanRevision(tx.QueryRowContext(ctx, revisionQuery, resource, id, version))
+		if err != nil {
+			return err
+		}
+
+		old, err := s.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		err = m.visible(ctx, tx, s, id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, query, id, string(revision.Data), current).Scan(&reverted)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		if s.revertChildren != nil {
+			err = s.revertChildren(ctx, tx, id, revision.Data, m.scope)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = m.visible(ctx, tx, s, id)
+		if err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				return ErrOutOfScope
+			}
+			return err
+		}
+
+		return s.record(ctx, tx, actor, "revert", id, old)
+	})
+
+	return reverted, err
+}
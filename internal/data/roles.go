@@ -0,0 +1,398 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+)
+
+// Role bundles permissions so that they can be given to users together. Users
+// given a role with RequireTwoFactor must sign in with a second factor.
+type Role struct {
+	ID               int64       `json:"id"`
+	CreatedAt        time.Time   `json:"created_at"`
+	Name             string      `json:"name"`
+	Description      string      `json:"description"`
+	Permissions      Permissions `json:"permissions"`
+	RequireTwoFactor bool        `json:"require_two_factor"`
+	Version          int32       `json:"version"`
+}
+
+// RoleGrant is a role given to a user. A grant with a WarehouseID applies only
+// in that warehouse, and one with a PerusahaanID only in the warehouses of that
+// perusahaan.
+type RoleGrant struct {
+	User         *User  `json:"user"`
+	WarehouseID  *int64 `json:"warehouse_id"`
+	PerusahaanID *int64 `json:"perusahaan_id"`
+}
+
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// ValidateRole checks role against known, the codes of every permission.
+func ValidateRole(v *validator.Validator, role *Role, known Permissions) {
+	v.Check(role.Name != "", "name", validator.Required)
+	v.Check(len(role.Name) <= 100, "name", validator.MaxLength, 100)
+	v.Check(len(role.Description) <= 500, "description", validator.MaxLength, 500)
+
+	v.Check(validator.Unique(role.Permissions), "permissions", validator.Duplicate)
+
+	for _, code := range role.Permissions {
+		v.Check(known.Include(code), "permissions", validator.UnknownPermission, code)
+	}
+}
+
+func (m RoleModel) setPermissions(ctx context.Context, tx *sql.Tx, role *Role) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, role.ID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO roles_permissions (role_id, permission_id)
+		SELECT $1, id FROM permissions WHERE code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, role.ID, pq.Array([]string(role.Permissions)))
+	return err
+}
+
+func roleError(err error) error {
+	var pqErr *pq.Error
+
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "roles_name_key" {
+		return ErrDuplicateRoleName
+	}
+
+	return err
+}
+
+func (m RoleModel) Insert(role *Role) error {
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			INSERT INTO roles (name, description, require_two_factor)
+			VALUES ($1, $2, $3)
+			RETURNING id, created_at, version`
+
+		err := tx.QueryRowContext(ctx, query, role.Name, role.Description, role.RequireTwoFactor).Scan(&role.ID, &role.CreatedAt, &role.Version)
+		if err != nil {
+			return err
+		}
+
+		return m.setPermissions(ctx, tx, role)
+	})
+
+	return roleError(err)
+}
+
+const roleFields = `
+	roles.id, roles.created_at, roles.name, roles.description,
+	array(SELECT p.code FROM permissions p INNER JOIN roles_permissions rp ON rp.permission_id = p.id
+		WHERE rp.role_id = roles.id ORDER BY p.code),
+	roles.require_two_factor, roles.version`
+
+func scanRole(row interface{ Scan(...interface{}) error }) (*Role, error) {
+	var role Role
+
+	err := row.Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		pq.Array((*[]string)(&role.Permissions)),
+		&role.RequireTwoFactor,
+		&role.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + roleFields + ` FROM roles WHERE roles.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRecordNotFound
+	}
+
+	return role, err
+}
+
+// GetAll returns every role, by name.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `SELECT ` + roleFields + ` FROM roles ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (m RoleModel) Update(role *Role) error {
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			UPDATE roles
+			SET name = $1, description = $2, require_two_factor = $3, version = version + 1
+			WHERE id = $4 AND version = $5
+			RETURNING version`
+
+		args := []interface{}{role.Name, role.Description, role.RequireTwoFactor, role.ID, role.Version}
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&role.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return m.setPermissions(ctx, tx, role)
+	})
+
+	return roleError(err)
+}
+
+func (m RoleModel) Delete(id int64, version int32) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM roles WHERE id = $1 AND version = $2`, id, version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// GetGrants returns the grants of a role, by user ID.
+func (m RoleModel) GetGrants(roleID int64) ([]*RoleGrant, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.activated, users.language,
+			users_roles.warehouse_id, users_roles.perusahaan_id
+		FROM users
+		INNER JOIN users_roles ON users_roles.user_id = users.id
+		WHERE users_roles.role_id = $1
+		ORDER BY users.id, users_roles.warehouse_id NULLS FIRST, users_roles.perusahaan_id NULLS FIRST`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, roleID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	grants := []*RoleGrant{}
+
+	for rows.Next() {
+		grant := RoleGrant{User: &User{}}
+
+		err := rows.Scan(
+			&grant.User.ID,
+			&grant.User.CreatedAt,
+			&grant.User.Name,
+			&grant.User.Email,
+			&grant.User.Activated,
+			&grant.User.Language,
+			&grant.WarehouseID,
+			&grant.PerusahaanID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		grants = append(grants, &grant)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return grants, nil
+}
+
+// AddUser gives a role to a user, limited to a warehouse or perusahaan if
+// either is given. Giving a grant the user already has does nothing, and
+// ErrRecordNotFound is returned if there is no such user, warehouse or
+// perusahaan.
+func (m RoleModel) AddUser(roleID int64, userID int64, warehouseID, perusahaanID *int64) error {
+	query := `
+		WITH u AS (SELECT id FROM users WHERE id = $1),
+		ins AS (
+			INSERT INTO users_roles (user_id, role_id, warehouse_id, perusahaan_id)
+			SELECT id, $2, $3, $4 FROM u
+			ON CONFLICT DO NOTHING)
+		SELECT count(*) FROM u`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var found int
+
+	err := m.DB.QueryRowContext(ctx, query, userID, roleID, warehouseID, perusahaanID).Scan(&found)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if found == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RemoveUser takes a grant of a role from a user. The warehouse and perusahaan
+// pick the grant, so nil for both removes only the unlimited grant.
+func (m RoleModel) RemoveUser(roleID int64, userID int64, warehouseID, perusahaanID *int64) error {
+	query := `
+		DELETE FROM users_roles
+		WHERE role_id = $1 AND user_id = $2
+		AND warehouse_id IS NOT DISTINCT FROM $3 AND perusahaan_id IS NOT DISTINCT FROM $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, roleID, userID, warehouseID, perusahaanID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// AddForUser gives the roles with the given names to a user, without limiting
+// them to a warehouse. Names that match no role are ignored.
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+		INSERT INTO users_roles (user_id, role_id)
+		SELECT $1, id FROM roles WHERE name = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	return err
+}
+
+// SyncForUser makes the user's unlimited grants of the managed roles match
+// granted: managed roles not in granted are taken away and those in granted
+// given. Grants of other roles, and grants limited to a warehouse or
+// perusahaan, are left alone.
+func (m RoleModel) SyncForUser(userID int64, managed, granted []string) error {
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			DELETE FROM users_roles
+			USING roles
+			WHERE users_roles.role_id = roles.id AND users_roles.user_id = $1
+			AND roles.name = ANY($2) AND NOT roles.name = ANY($3)
+			AND users_roles.warehouse_id IS NULL AND users_roles.perusahaan_id IS NULL`
+
+		_, err := tx.ExecContext(ctx, query, userID, pq.Array(managed), pq.Array(granted))
+		if err != nil {
+			return err
+		}
+
+		query = `
+			INSERT INTO users_roles (user_id, role_id)
+			SELECT $1, id FROM roles WHERE name = ANY($2)
+			ON CONFLICT DO NOTHING`
+
+		_, err = tx.ExecContext(ctx, query, userID, pq.Array(granted))
+		return err
+	})
+}
+
+// RequireTwoFactor reports whether any role given to the user, limited to a
+// warehouse or not, requires signing in with a second factor.
+func (m RoleModel) RequireTwoFactor(userID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM users_roles
+			INNER JOIN roles ON roles.id = users_roles.role_id
+			WHERE users_roles.user_id = $1 AND roles.require_two_factor
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var required bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&required)
+	return required, err
+}
@@ -0,0 +1,139 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ErrOutOfScope is returned when a record would be written to a warehouse or
+// perusahaan outside the model's scope.
+var ErrOutOfScope = errors.New("out of scope")
+
+// Scope limits the warehouse, rak and stok models to the warehouses a user
+// has been given access to. Warehouses includes the warehouses of every
+// perusahaan in Perusahaans. A scope with All set is not limited at all, and
+// neither is a nil *Scope, which is what the models of NewModels hold. An
+// empty scope reaches nothing.
+type Scope struct {
+	All         bool    `json:"all"`
+	Warehouses  []int64 `json:"warehouses"`
+	Perusahaans []int64 `json:"perusahaans"`
+}
+
+// AllWarehouses returns the scope of a grant that is not limited to any
+// warehouse or perusahaan.
+func AllWarehouses() *Scope {
+	return &Scope{All: true}
+}
+
+// Unlimited reports whether s reaches every warehouse.
+func (s *Scope) Unlimited() bool {
+	return s == nil || s.All
+}
+
+// warehouses returns the scope as a query argument, which is NULL for an
+// unlimited scope so that queries can test for it with "$n::bigint[] IS NULL".
+func (s *Scope) warehouses() interface{} {
+	if s.Unlimited() {
+		return pq.Array([]int64(nil))
+	}
+
+	ids := s.Warehouses
+	if ids == nil {
+		ids = []int64{}
+	}
+
+	return pq.Array(ids)
+}
+
+func (s *Scope) allowsWarehouse(id int64) bool {
+	if s.Unlimited() {
+		return true
+	}
+
+	for _, warehouse := range s.Warehouses {
+		if warehouse == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Scope) allowsPerusahaan(id int64) bool {
+	if s.Unlimited() {
+		return true
+	}
+
+	for _, perusahaan := range s.Perusahaans {
+		if perusahaan == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Covers reports whether s reaches every warehouse and perusahaan other does.
+func (s *Scope) Covers(other *Scope) bool {
+	if s.Unlimited() {
+		return true
+	}
+
+	if other.Unlimited() {
+		return false
+	}
+
+	for _, id := range other.Warehouses {
+		if !s.allowsWarehouse(id) {
+			return false
+		}
+	}
+
+	for _, id := range other.Perusahaans {
+		if !s.allowsPerusahaan(id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Intersect returns the scope reaching only what both s and other reach.
+func (s *Scope) Intersect(other *Scope) *Scope {
+	if s.Unlimited() {
+		return other
+	}
+
+	if other.Unlimited() {
+		return s
+	}
+
+	scope := &Scope{Warehouses: []int64{}, Perusahaans: []int64{}}
+
+	for _, id := range s.Warehouses {
+		if other.allowsWarehouse(id) {
+			scope.Warehouses = append(scope.Warehouses, id)
+		}
+	}
+
+	for _, id := range s.Perusahaans {
+		if other.allowsPerusahaan(id) {
+			scope.Perusahaans = append(scope.Perusahaans, id)
+		}
+	}
+
+	return scope
+}
+
+// filter limits a list query to the rows whose condition holds for the
+// warehouses in scope. condition has a %s for the warehouse ID array.
+func (s *Scope) filter(q *listQuery, condition string) {
+	if s.Unlimited() {
+		return
+	}
+
+	q.filter(fmt.Sprintf(condition, q.arg(s.warehouses())))
+}
@@ -0,0 +1,214 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Session is one sign in of a user, on one device. Its refresh tokens all
+// belong to its family, so ending the session revokes them.
+type Session struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+	Family     []byte    `json:"-"`
+}
+
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// Insert starts a session, giving it a new refresh token family.
+func (m SessionModel) Insert(session *Session) error {
+	session.Family = make([]byte, 16)
+
+	_, err := rand.Read(session.Family)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO sessions (family, user_id, ip, user_agent)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, last_used_at`
+
+	args := []interface{}{session.Family, session.UserID, session.IP, session.UserAgent}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt)
+}
+
+// Touch records that the session with the given family was refreshed from ip
+// with userAgent, and returns it.
+func (m SessionModel) Touch(family []byte, ip, userAgent string) (*Session, error) {
+	query := `
+        UPDATE sessions
+        SET last_used_at = now(), ip = $2, user_agent = $3
+        WHERE family = $1
+        RETURNING id, user_id, created_at, last_used_at, ip, user_agent, family`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var session Session
+
+	err := m.DB.QueryRowContext(ctx, query, family, ip, userAgent).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.IP,
+		&session.UserAgent,
+		&session.Family,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &session, nil
+}
+
+// GetAllForUser returns the user's sessions that still have a refresh token
+// that can be used, most recently used first.
+func (m SessionModel) GetAllForUser(userID int64) ([]*Session, error) {
+	query := `
+        SELECT id, user_id, created_at, last_used_at, ip, user_agent, family
+        FROM sessions
+        WHERE user_id = $1
+        AND EXISTS (SELECT 1 FROM tokens WHERE tokens.family = sessions.family AND tokens.used_at IS NULL AND tokens.expiry > now())
+        ORDER BY last_used_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.IP,
+			&session.UserAgent,
+			&session.Family,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Delete ends one of the user's sessions.
+func (m SessionModel) Delete(id, userID int64) error {
+	query := `
+        DELETE FROM sessions
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser ends every session of the user but the one with the ID
+// keep, which may be 0 to end them all. It returns the IDs of those ended.
+func (m SessionModel) DeleteAllForUser(userID, keep int64) ([]int64, error) {
+	query := `
+        DELETE FROM sessions
+        WHERE user_id = $1 AND id <> $2
+        RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ended := []int64{}
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ended = append(ended, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ended, nil
+}
+
+// DeleteExpired removes the sessions left without a refresh token, once the
+// last one has expired and been purged.
+func (m SessionModel) DeleteExpired() (int64, error) {
+	query := `
+        DELETE FROM sessions
+        WHERE NOT EXISTS (SELECT 1 FROM tokens WHERE tokens.family = sessions.family)
+        AND created_at < now() - interval '1 hour'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
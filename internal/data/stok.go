@@ -3,8 +3,11 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/twinj/uuid"
@@ -45,326 +48,417 @@ type StokDetail struct {
 }
 
 func ValidateStok(v *validator.Validator, usaha Stok) {
-	v.Check(usaha.Code != nil, "Product Code", "harus diisi")
+	v.Check(usaha.Code != nil, "Product Code", validator.Required)
 }
 
 type StokModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	tx    *sql.Tx
+	scope *Scope
 }
 
-func (m StokModel) Insert(usaha *Stok) error {
+func (m StokModel) db() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
 
-	ctx := context.Background()
-	tx, err := m.DB.BeginTx(ctx, nil)
-	if err != nil {
-		log.Fatal(err)
+var stokColumns = map[string]string{
+	"id":           "a.id",
+	"produk_code":  "a.produk_code",
+	"produk_ket":   "a.produk_ket",
+	"buy":          "a.buy",
+	"sell":         "a.sell",
+	"year":         "a.year",
+	"chasis":       "a.chasis",
+	"brand_id":     "a.brand_id",
+	"model_id":     "a.model_id",
+	"brandname":    "b.name",
+	"modelname":    "c.name",
+	"qty":          "(select coalesce(sum(qty), 0) from stok_detail where stok_id = a.id)",
+	"created_at":   "a.created_at",
+	"warehouse_id": "a.id IN (select stok_id from stok_detail where warehouse_id %s)",
+	"rak_id":       "a.id IN (select stok_id from stok_detail where rak_id %s)",
+}
+
+// stokInScope is the condition for a stok with stock in one of the warehouses
+// of a scope.
+const stokInScope = "a.id IN (select stok_id from stok_detail where warehouse_id = ANY(%s))"
+
+var stokJoins = map[string]string{
+	"b": "left outer join brand b on b.id = a.brand_id",
+	"c": "left outer join brandmodel c on c.id = a.model_id",
+}
+
+var (
+	StokFilterSafelist = safelist(stokColumns)
+	StokSortSafelist   = sortSafelist(stokColumns)
+	StokFieldSafelist  = jsonFields(Stok{})
+	StokRelations      = map[string]string{"details": "jsonstokdetail"}
+)
+
+// checkDetails returns ErrOutOfScope unless every detail is in a warehouse of
+// the model's scope. A scoped stok needs at least one detail, or it could not
+// be seen again once written.
+func (m StokModel) checkDetails(details []*StokDetail) error {
+	if m.scope.Unlimited() {
+		return nil
 	}
 
-	stok_id := uuid.NewV4()
-	stmtstok := (`
-		INSERT INTO stok (produk_code, produk_ket,buy,sell,year,chasis,brand_id,model_id,id) 
-		VALUES ($1, $2,$3,$4,$5,$6,$7,$8,$9)`)
+	if len(details) == 0 {
+		return ErrOutOfScope
+	}
 
-	args := []interface{}{usaha.Code, usaha.Ket, usaha.Buy, usaha.Sell, usaha.Year, usaha.Chasis, usaha.BrandID, usaha.ModelID, stok_id}
+	for _, detail := range details {
+		if detail.Warehouse_id == nil || !m.scope.allowsWarehouse(*detail.Warehouse_id) {
+			return ErrOutOfScope
+		}
+	}
 
-	// ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	// defer cancel()
+	return nil
+}
 
-	_, err = tx.ExecContext(ctx, stmtstok, args...)
+func (m StokModel) Insert(usaha *Stok, actor Actor) error {
+	err := m.checkDetails(usaha.JsonStokDetail)
 	if err != nil {
-		str := fmt.Sprintf("%v", args)
-		dataQuery := "error insert: " + stmtstok + " " + str
-		log.Println(dataQuery)
-		tx.Rollback()
 		return err
 	}
 
-	if len(usaha.JsonStokDetail) > 0 {
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		stok_id := uuid.NewV4()
+		stmtstok := (`
+			INSERT INTO stok (produk_code, produk_ket,buy,sell,year,chasis,brand_id,model_id,id) 
+			VALUES ($1, $2,$3,$4,$5,$6,$7,$8,$9)`)
 
-		sqlStr := "insert into stok_detail(id,qty,satuan,rak_id,warehouse_id,stok_id) VALUES"
-		vals := []interface{}{}
+		args := []interface{}{usaha.Code, usaha.Ket, usaha.Buy, usaha.Sell, usaha.Year, usaha.Chasis, usaha.BrandID, usaha.ModelID, stok_id}
 
-		for i, row := range usaha.JsonStokDetail {
+		// ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		// defer cancel()
 
-			stok_detail_id := uuid.NewV4()
+		_, err := tx.ExecContext(ctx, stmtstok, args...)
+		if err != nil {
+			str := fmt.Sprintf("%v", args)
+			dataQuery := "error insert: " + stmtstok + " " + str
+			log.Println(dataQuery)
+			return err
+		}
 
-			//fmt.Println(row.Rak_code)
-			//sqlStr += "($1, $2, $3),"
-			sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d),",
-				i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6)
+		id := stok_id.String()
+		usaha.ID = &id
 
-			//	sqlStr += "(?),"
-			vals = append(vals, stok_detail_id, row.Qty, row.Satuan, row.Rak_id, row.Warehouse_id, stok_id)
-		}
+		if len(usaha.JsonStokDetail) > 0 {
+
+			sqlStr := "insert into stok_detail(id,qty,satuan,rak_id,warehouse_id,stok_id) VALUES"
+			vals := []interface{}{}
 
-		//trim the last ,
-		sqlStr = sqlStr[0 : len(sqlStr)-1]
+			for i, row := range usaha.JsonStokDetail {
+
+				stok_detail_id := uuid.NewV4()
+
+				//fmt.Println(row.Rak_code)
+				//sqlStr += "($1, $2, $3),"
+				sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d),",
+					i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6)
+
+				//	sqlStr += "(?),"
+				vals = append(vals, stok_detail_id, row.Qty, row.Satuan, row.Rak_id, row.Warehouse_id, stok_id)
+			}
+
+			//trim the last ,
+			sqlStr = sqlStr[0 : len(sqlStr)-1]
+
+			_, err = tx.ExecContext(ctx, sqlStr, vals...)
+			if err != nil {
+				str := fmt.Sprintf("%v", vals)
+				dataQuery := "error insert: " + sqlStr + " " + str
+				log.Println(dataQuery)
+				return err
+			}
+
+		}
 
-		_, err = tx.ExecContext(ctx, sqlStr, vals...)
+		err = stokAudit.record(ctx, tx, actor, "insert", stok_id, nil)
 		if err != nil {
-			str := fmt.Sprintf("%v", vals)
-			dataQuery := "error insert: " + sqlStr + " " + str
-			log.Println(dataQuery)
-			tx.Rollback()
 			return err
 		}
 
-	}
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Failed insert Commit")
-		return err
-
-	}
-	return nil
+		return nil
+	})
 }
 
 func (m StokModel) Get(id string) (*Stok, error) {
+	return m.GetWith(id, Projection{})
+}
+
+// GetWith loads the stock details only when they are part of the projection;
+// without fields= or include= they are returned as they always have been.
+func (m StokModel) GetWith(id string, p Projection) (*Stok, error) {
 	if len(id) < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `select coalesce(g.total,0)total,a.id,a.produk_code, a.produk_ket,a.buy,a.sell,a.year,a.chasis,a.brand_id,a.model_id,
-	b.name brandname,c.name modelname,a.version,
-	d.qty,d.satuan,d.rak_id,d.warehouse_id,e.rak_code,f.name_warehouse
+	query := `select (select coalesce(sum(qty),0) from stok_detail where stok_id=a.id)total,
+	a.id,a.produk_code, a.produk_ket,a.buy,a.sell,a.year,a.chasis,a.brand_id,a.model_id,
+	b.name brandname,c.name modelname,a.version
 	from stok a
 	left outer join brand b on b.id=a.brand_id
 	left outer join brandmodel c on c.id=a.model_id
-	left outer join  stok_detail d on d.stok_id=a.id
-	left outer join rak e on e.rak_id=d.rak_id
-	left outer join warehouse  f on f.warehouse_id=d.warehouse_id
-	left outer join (select sum(qty)total,stok_id  from stok_detail group by stok_id)g on g.stok_id=a.id
-	where a.id = $1`
-
-	rows, err := m.DB.Query(query, id)
-	if err != nil {
-		return nil, err
-
-	}
-	defer rows.Close()
+	where a.id = $1 and a.deleted_at is null
+	and ($2::bigint[] is null or a.id in (select stok_id from stok_detail where warehouse_id = any($2)))`
 
 	s := Stok{}
 
-	detail := []*StokDetail{}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	for rows.Next() {
+	err := m.db().QueryRowContext(ctx, query, id, m.scope.warehouses()).Scan(
+		&s.Qty, //total qty detail
+		&s.ID,
+		&s.Code,
+		&s.Ket,
+		&s.Buy,
+		&s.Sell,
+		&s.Year,
+		&s.Chasis,
+		&s.BrandID,
+		&s.ModelID,
+		&s.BrandName,
+		&s.ModelName,
+		&s.Version,
+	)
 
-		u := StokDetail{}
-		err = rows.Scan(
-			&s.Qty, //total qty detail
-			&s.ID,
-			&s.Code,
-			&s.Ket,
-			&s.Buy,
-			&s.Sell,
-			&s.Year,
-			&s.Chasis,
-			&s.BrandID,
-			&s.ModelID,
-			&s.BrandName,
-			&s.ModelName,
-			&s.Version,
-			//untuk stok_detil
-			&u.Qty,
-			&u.Satuan,
-			&u.Rak_id,
-			&u.Warehouse_id,
-			&u.Rak_code,
-			&u.Name_warehouse,
-		)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
 
+	if p.includes("details") || p.wants("jsonstokdetail") {
+		err = m.loadDetails([]*Stok{&s})
 		if err != nil {
 			return nil, err
 		}
-		detail = append(detail, &u)
 	}
 
-	if len(detail) > 0 {
-		s.JsonStokDetail = detail
+	return &s, nil
+}
 
-	} else {
-		s.JsonStokDetail = nil
+// Update replaces the details of a stok along with the stok itself. With a
+// scope, only the details in the scope's warehouses are replaced.
+func (m StokModel) Update(usaha *Stok, actor Actor) error {
+	err := m.checkDetails(usaha.JsonStokDetail)
+	if err != nil {
+		return err
 	}
 
-	if err = rows.Err(); err != nil {
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		query := (`
+		update stok
+		set produk_code=$1,produk_ket=$2,buy=$3,sell=$4,year=$5,chasis=$6,brand_id=$7,model_id=$8,modified_at = now(), version = version + 1
+		where id=$9 and  version = $10 and deleted_at is null
+		and ($11::bigint[] is null or id in (select stok_id from stok_detail where warehouse_id = any($11)))
+		RETURNING version`)
+
+		args := []interface{}{
+			usaha.Code,
+			usaha.Ket,
+			usaha.Buy,
+			usaha.Sell,
+			usaha.Year,
+			usaha.Chasis,
+			usaha.BrandID,
+			usaha.ModelID,
+			usaha.ID,
+			usaha.Version,
+			m.scope.warehouses(),
+		}
 
-		return nil, err
-	}
+		old, err := stokAudit.snapshot(ctx, tx, *usaha.ID)
+		if err != nil {
+			return err
+		}
 
-	return &s, nil
-}
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrEditConflict
+			}
 
-func (m StokModel) Update(usaha *Stok) error {
+			str := fmt.Sprintf("%v", args)
+			dataQuery := "error update stok: " + query + " " + str
+			log.Println(dataQuery)
+			return err
+		}
 
-	ctx := context.Background()
-	tx, err := m.DB.BeginTx(ctx, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
+		querydel := (`
+	        DELETE FROM stok_detail
+	        WHERE stok_id = $1 AND ($2::bigint[] IS NULL OR warehouse_id = ANY($2))`)
 
-	query := (`
-	update stok
-	set produk_code=$1,produk_ket=$2,buy=$3,sell=$4,year=$5,chasis=$6,brand_id=$7,model_id=$8,modified_at = now(), version = version + 1
-	where id=$9 and  version = $10
-	RETURNING version`)
-
-	args := []interface{}{
-		usaha.Code,
-		usaha.Ket,
-		usaha.Buy,
-		usaha.Sell,
-		usaha.Year,
-		usaha.Chasis,
-		usaha.BrandID,
-		usaha.ModelID,
-		usaha.ID,
-		usaha.Version,
-	}
+		_, err = tx.ExecContext(ctx, querydel, usaha.ID, m.scope.warehouses())
+		if err != nil {
+			str := fmt.Sprintf("%v", args)
+			dataQuery := "error delete all stok_detail: " + querydel + " " + str
+			log.Println(dataQuery)
+			return err
+		}
 
-	_, err = tx.ExecContext(ctx, query, args...)
-	if err != nil {
-		str := fmt.Sprintf("%v", args)
-		dataQuery := "error update stok: " + query + " " + str
-		log.Println(dataQuery)
-		tx.Rollback()
-		return err
-	}
+		if len(usaha.JsonStokDetail) > 0 {
 
-	querydel := (`
-        DELETE FROM stok_detail
-        WHERE stok_id = $1`)
+			sqlStr := "insert into stok_detail(id,qty,satuan,rak_id,warehouse_id,stok_id) VALUES"
+			vals := []interface{}{}
 
-	_, err = tx.ExecContext(ctx, querydel, usaha.ID)
-	if err != nil {
-		str := fmt.Sprintf("%v", args)
-		dataQuery := "error delete all stok_detail: " + querydel + " " + str
-		log.Println(dataQuery)
-		tx.Rollback()
-		return err
-	}
+			for i, row := range usaha.JsonStokDetail {
 
-	if len(usaha.JsonStokDetail) > 0 {
+				stok_detail_id := uuid.NewV4()
 
-		sqlStr := "insert into stok_detail(id,qty,satuan,rak_id,warehouse_id,stok_id) VALUES"
-		vals := []interface{}{}
+				//fmt.Println(row.Rak_code)
+				//sqlStr += "($1, $2, $3),"
+				sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d),",
+					i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6)
 
-		for i, row := range usaha.JsonStokDetail {
+				//	sqlStr += "(?),"
+				vals = append(vals, stok_detail_id, row.Qty, row.Satuan, row.Rak_id, row.Warehouse_id, usaha.ID)
+			}
 
-			stok_detail_id := uuid.NewV4()
+			//trim the last ,
+			sqlStr = sqlStr[0 : len(sqlStr)-1]
 
-			//fmt.Println(row.Rak_code)
-			//sqlStr += "($1, $2, $3),"
-			sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d),",
-				i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6)
+			_, err = tx.ExecContext(ctx, sqlStr, vals...)
+			if err != nil {
+				str := fmt.Sprintf("%v", vals)
+				dataQuery := "error insert update stok_detail: " + sqlStr + " " + str
+				log.Println(dataQuery)
+				return err
+			}
 
-			//	sqlStr += "(?),"
-			vals = append(vals, stok_detail_id, row.Qty, row.Satuan, row.Rak_id, row.Warehouse_id, usaha.ID)
 		}
 
-		//trim the last ,
-		sqlStr = sqlStr[0 : len(sqlStr)-1]
-
-		_, err = tx.ExecContext(ctx, sqlStr, vals...)
+		err = stokAudit.record(ctx, tx, actor, "update", *usaha.ID, old)
 		if err != nil {
-			str := fmt.Sprintf("%v", vals)
-			dataQuery := "error insert update stok_detail: " + sqlStr + " " + str
-			log.Println(dataQuery)
-			tx.Rollback()
 			return err
 		}
 
+		return nil
+	})
+}
+
+func (m StokModel) Delete(id string, version int32, actor Actor) error {
+	if len(id) < 1 {
+		return ErrRecordNotFound
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Failed insert Commit Update stok_detail")
-		return err
+	query := `
+        UPDATE stok
+        SET deleted_at = now(), deleted_by = NULLIF($3::bigint, 0), version = version + 1
+        WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+        AND ($4::bigint[] IS NULL OR id IN (SELECT stok_id FROM stok_detail WHERE warehouse_id = ANY($4)))`
 
-	}
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := stokAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		result, err := tx.ExecContext(ctx, query, id, version, actor.UserID, m.scope.warehouses())
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
+
+		return stokAudit.record(ctx, tx, actor, "delete", id, old)
+	})
 }
 
-func (m StokModel) Delete(id string) error {
+func (m StokModel) Restore(id string, actor Actor) error {
 	if len(id) < 1 {
 		return ErrRecordNotFound
 	}
 
-	ctx := context.Background()
-	tx, err := m.DB.BeginTx(ctx, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
+	query := `
+        UPDATE stok
+        SET deleted_at = NULL, deleted_by = NULL, version = version + 1
+        WHERE id = $1 AND deleted_at IS NOT NULL
+        AND ($2::bigint[] IS NULL OR id IN (SELECT stok_id FROM stok_detail WHERE warehouse_id = ANY($2)))`
 
-	query := (`
-        DELETE FROM stok_detail
-        WHERE stok_id = $1`)
+	return withTx(m.DB, m.tx, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := stokAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	_, err = tx.ExecContext(ctx, query, id)
-	if err != nil {
-		str := fmt.Sprintf("%v", id)
-		dataQuery := "delete stok_detail: " + query + " " + str
-		log.Println(dataQuery)
-		tx.Rollback()
-		return err
-	}
+		result, err := tx.ExecContext(ctx, query, id, m.scope.warehouses())
+		if err != nil {
+			return err
+		}
 
-	querydel := (`
-	DELETE FROM stok
-	WHERE id = $1`)
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
 
-	_, err = tx.ExecContext(ctx, querydel, id)
-	if err != nil {
-		str := fmt.Sprintf("%v", id)
-		dataQuery := "error delete all stok: " + querydel + " " + str
-		log.Println(dataQuery)
-		tx.Rollback()
-		return err
-	}
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Failed delete stok dan stok_detail")
-		return err
+		return stokAudit.record(ctx, tx, actor, "restore", id, old)
+	})
+}
 
+func (m StokModel) GetAll(code string, ket string, brandname string, modelname string, filters Filters) ([]*Stok, Metadata, error) {
+	q := listQuery{
+		from:  "stok a",
+		joins: stokJoins,
+		order: filters.sortKeys(stokColumns, "a.id"),
 	}
 
-	return nil
-}
+	q.selects(filters.Projection, stokColumns,
+		"qty", "id", "produk_code", "produk_ket", "buy", "sell", "year", "chasis", "brand_id", "model_id", "brandname", "modelname")
 
-func (m StokModel) GetAll(code string, ket string, brandname string, modelname string, filters Filters) ([]*Stok, Metadata, error) {
+	q.filter("a.deleted_at IS NULL")
+	m.scope.filter(&q, stokInScope)
 
-	query := fmt.Sprintf(`
-	select count(*) OVER(),coalesce(d.qty,0)qty,a.id,a.produk_code, a.produk_ket,a.buy,a.sell,a.year,a.chasis,a.brand_id,a.model_id,b.name brandname,c.name modelname
-	from stok a
-	left outer join brand b on b.id=a.brand_id
-	left outer join brandmodel c on c.id=a.model_id
-	left outer join (select sum(qty)qty,stok_id  from stok_detail group by stok_id)d on d.stok_id=a.id
-	where lower(a.produk_code) like lower('%%` + code + `%%')  and lower(a.produk_ket) like lower('%%` + ket + `%%')
-	and  lower(b.name) like lower('%%` + brandname + `%%')
-	and  lower(c.name) like lower('%%` + modelname + `%%')
-	ORDER BY a.created_at desc
-	LIMIT $1 OFFSET $2`)
+	q.like("a.produk_code", code)
+	q.like("a.produk_ket", ket)
+	q.like("b.name", brandname)
+	q.like("c.name", modelname)
+
+	q.conditions(filters.Conditions, stokColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	//args := []interface{}{name}
-	args := []interface{}{filters.limit(), filters.offset()}
-
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.db().QueryContext(ctx, query, args...)
 	if err != nil {
 		fmt.Println("err-db")
-		return nil, Metadata{}, err
+		return nil, Metadata{}, listError(err)
 	}
 
 	defer rows.Close()
 
 	totalRecords := 0
 	usahas := []*Stok{}
+	keys := []string{}
 
 	for rows.Next() {
-		usaha := &Stok{}
+		var usaha Stok
+		var key string
 
 		err := rows.Scan(
 			&totalRecords,
@@ -380,19 +474,139 @@ func (m StokModel) GetAll(code string, ket string, brandname string, modelname s
 			&usaha.ModelID,
 			&usaha.BrandName,
 			&usaha.ModelName,
+			&key,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
-		usahas = append(usahas, usaha)
+		usahas = append(usahas, &usaha)
+		keys = append(keys, key)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := filters.paginate(&usahas, keys, totalRecords)
+
+	if filters.includes("details") {
+		err = m.loadDetails(usahas)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
 
 	return usahas, metadata, nil
 }
+
+func (m StokModel) loadDetails(usahas []*Stok) error {
+	if len(usahas) == 0 {
+		return nil
+	}
+
+	placeholders := []string{}
+	args := []interface{}{}
+
+	for i, usaha := range usahas {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+2))
+		args = append(args, usaha.ID)
+	}
+
+	args = append([]interface{}{m.scope.warehouses()}, args...)
+
+	query := `select d.stok_id,d.qty,d.satuan,d.rak_id,d.warehouse_id,e.rak_code,f.name_warehouse
+	from stok_detail d
+	left outer join rak e on e.rak_id=d.rak_id
+	left outer join warehouse  f on f.warehouse_id=d.warehouse_id
+	where d.stok_id in (` + strings.Join(placeholders, ",") + `)
+	and ($1::bigint[] is null or d.warehouse_id = any($1))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.db().QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	details := make(map[string][]*StokDetail)
+
+	for rows.Next() {
+		var stokID string
+		var u StokDetail
+
+		err = rows.Scan(
+			&stokID,
+			&u.Qty,
+			&u.Satuan,
+			&u.Rak_id,
+			&u.Warehouse_id,
+			&u.Rak_code,
+			&u.Name_warehouse,
+		)
+		if err != nil {
+			return err
+		}
+
+		details[stokID] = append(details[stokID], &u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, usaha := range usahas {
+		usaha.JsonStokDetail = details[*usaha.ID]
+	}
+
+	return nil
+}
+
+// revertStokDetails replaces the details of a stok with the ones stored in a
+// revision snapshot. With a scope, only the details in the scope's warehouses
+// are touched.
+func revertStokDetails(ctx context.Context, tx *sql.Tx, id string, revision json.RawMessage, scope *Scope) error {
+	var snapshot struct {
+		Details []*StokDetail `json:"details"`
+	}
+
+	err := json.Unmarshal(revision, &snapshot)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM stok_detail WHERE stok_id = $1 AND ($2::bigint[] IS NULL OR warehouse_id = ANY($2))`, id, scope.warehouses())
+	if err != nil {
+		return err
+	}
+
+	details := []*StokDetail{}
+
+	for _, row := range snapshot.Details {
+		if scope.Unlimited() || row.Warehouse_id != nil && scope.allowsWarehouse(*row.Warehouse_id) {
+			details = append(details, row)
+		}
+	}
+
+	if len(details) == 0 {
+		return nil
+	}
+
+	sqlStr := "insert into stok_detail(id,qty,satuan,rak_id,warehouse_id,stok_id) VALUES"
+	vals := []interface{}{}
+
+	for i, row := range details {
+		sqlStr += fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d),",
+			i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6)
+
+		vals = append(vals, uuid.NewV4(), row.Qty, row.Satuan, row.Rak_id, row.Warehouse_id, id)
+	}
+
+	sqlStr = sqlStr[0 : len(sqlStr)-1]
+
+	_, err = tx.ExecContext(ctx, sqlStr, vals...)
+	return err
+}
@@ -0,0 +1,244 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrTaskLocked     = errors.New("task is already running")
+	ErrTaskAlreadyRun = errors.New("task has already run for this slot")
+)
+
+// Task triggers.
+const (
+	TaskScheduled = "schedule"
+	TaskManual    = "manual"
+)
+
+type TaskRun struct {
+	ID          int64      `json:"id"`
+	Task        string     `json:"task"`
+	Trigger     string     `json:"trigger"`
+	ScheduledAt time.Time  `json:"scheduled_at"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error"`
+	UserID      *int64     `json:"user_id"`
+}
+
+type TaskModel struct {
+	DB *sql.DB
+}
+
+var taskRunColumns = map[string]string{
+	"id":           "id",
+	"trigger":      "trigger",
+	"scheduled_at": "scheduled_at",
+	"started_at":   "started_at",
+	"finished_at":  "finished_at",
+	"status":       "status",
+}
+
+var (
+	TaskRunFilterSafelist = safelist(taskRunColumns)
+	TaskRunSortSafelist   = sortSafelist(taskRunColumns)
+)
+
+// Run runs fn as task and records the run. A Postgres advisory lock makes
+// sure only one API instance runs a task at a time, and ErrTaskLocked is
+// returned if another one holds it. Scheduled runs are also recorded against
+// their slot, so an instance that reaches a slot after another has run it
+// gets ErrTaskAlreadyRun.
+func (m TaskModel) Run(task string, trigger string, scheduledAt time.Time, userID int64, fn func(ctx context.Context) error) (*TaskRun, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Session-level advisory locks belong to a connection, so the lock and
+	// the unlock have to go through the same one.
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var locked bool
+
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext('task:' || $1))`, task).Scan(&locked)
+	if err != nil {
+		return nil, err
+	}
+
+	if !locked {
+		return nil, ErrTaskLocked
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext('task:' || $1))`, task)
+	}()
+
+	query := `
+		INSERT INTO task_runs (task, trigger, scheduled_at, user_id)
+		VALUES ($1, $2, $3, NULLIF($4::bigint, 0))
+		ON CONFLICT DO NOTHING
+		RETURNING id, started_at, status`
+
+	run := &TaskRun{Task: task, Trigger: trigger, ScheduledAt: scheduledAt}
+
+	err = conn.QueryRowContext(ctx, query, task, trigger, scheduledAt, userID).Scan(&run.ID, &run.StartedAt, &run.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrTaskAlreadyRun
+		default:
+			return nil, err
+		}
+	}
+
+	if userID != 0 {
+		run.UserID = &userID
+	}
+
+	runErr := fn(context.Background())
+
+	run.Status = "succeeded"
+	if runErr != nil {
+		run.Status = "failed"
+		run.Error = runErr.Error()
+	}
+
+	query = `
+		UPDATE task_runs
+		SET finished_at = now(), status = $2, error = $3
+		WHERE id = $1
+		RETURNING finished_at`
+
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = conn.QueryRowContext(ctx, query, run.ID, run.Status, run.Error).Scan(&run.FinishedAt)
+	if err != nil {
+		return run, err
+	}
+
+	return run, runErr
+}
+
+const taskRunFields = `id, task, trigger, scheduled_at, started_at, finished_at, status, error, user_id`
+
+// LastRuns returns the most recent run of every task that has run.
+func (m TaskModel) LastRuns() (map[string]*TaskRun, error) {
+	query := `
+		SELECT DISTINCT ON (task) ` + taskRunFields + `
+		FROM task_runs
+		ORDER BY task, started_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	runs := map[string]*TaskRun{}
+
+	for rows.Next() {
+		var run TaskRun
+
+		err := rows.Scan(
+			&run.ID,
+			&run.Task,
+			&run.Trigger,
+			&run.ScheduledAt,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Status,
+			&run.Error,
+			&run.UserID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		runs[run.Task] = &run
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+func (m TaskModel) GetAll(task string, filters Filters) ([]*TaskRun, Metadata, error) {
+	q := listQuery{
+		columns: taskRunFields,
+		from:    `task_runs`,
+		order:   filters.sortKeys(taskRunColumns, "id"),
+	}
+
+	q.filter("task = " + q.arg(task))
+
+	q.conditions(filters.Conditions, taskRunColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	runs := []*TaskRun{}
+	keys := []string{}
+
+	for rows.Next() {
+		var run TaskRun
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&run.ID,
+			&run.Task,
+			&run.Trigger,
+			&run.ScheduledAt,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Status,
+			&run.Error,
+			&run.UserID,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		runs = append(runs, &run)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&runs, keys, totalRecords)
+
+	return runs, metadata, nil
+}
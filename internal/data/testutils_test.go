@@ -0,0 +1,26 @@
+package data
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// newTestDB connects to the database named by GREENLIGHT_TEST_DB_DSN, skipping
+// the test if it is not set. The database must be a disposable one with every
+// migration applied; tests add their own rows and remove them afterwards.
+func newTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
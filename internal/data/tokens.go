@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"greenlight.alexedwards.net/internal/validator"
@@ -15,14 +16,25 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeTwoFactor      = "two-factor"
 )
 
+// ErrTokenReused is returned when a refresh token is presented a second time,
+// which means it has leaked.
+var ErrTokenReused = errors.New("refresh token reused")
+
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Family    []byte    `json:"-"`
+
+	// Session is the ID of the session ended when UseRefresh finds the
+	// token reused, or 0.
+	Session int64 `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -48,8 +60,8 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	v.Check(tokenPlaintext != "", "token", validator.Required)
+	v.Check(len(tokenPlaintext) == 26, "token", validator.ExactLength, 26)
 }
 
 type TokenModel struct {
@@ -80,6 +92,136 @@ func (m TokenModel) Insert(token *Token) error {
 	return err
 }
 
+// NewRefresh issues a refresh token in family, the chain of tokens issued
+// from one sign in, which is the family of its session.
+func (m TokenModel) NewRefresh(userID int64, ttl time.Duration, family []byte) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+
+	query := `
+        INSERT INTO tokens (hash, user_id, expiry, scope, family)
+        VALUES ($1, $2, $3, $4, $5)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// UseRefresh spends a refresh token, returning it so that its successor can
+// be issued in the same family. A refresh token can only be spent once: if a
+// spent one comes back, whoever holds the family's tokens cannot be trusted,
+// so its session is ended, revoking the whole family, and ErrTokenReused
+// returned.
+func (m TokenModel) UseRefresh(tokenPlaintext string) (*Token, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	token := &Token{
+		Plaintext: tokenPlaintext,
+		Hash:      hash[:],
+		Scope:     ScopeRefresh,
+	}
+
+	var reused bool
+
+	err := withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+            SELECT user_id, expiry, family, used_at IS NOT NULL
+            FROM tokens
+            WHERE hash = $1 AND scope = $2 AND expiry > now()
+            FOR UPDATE`
+
+		err := tx.QueryRowContext(ctx, query, token.Hash, ScopeRefresh).Scan(&token.UserID, &token.Expiry, &token.Family, &reused)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		if reused {
+			err = tx.QueryRowContext(ctx, `DELETE FROM sessions WHERE family = $1 RETURNING id`, token.Family).Scan(&token.Session)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = now() WHERE hash = $1`, token.Hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reused {
+		return token, ErrTokenReused
+	}
+
+	return token, nil
+}
+
+// Delete revokes the token with the given plaintext in scope.
+func (m TokenModel) Delete(scope, tokenPlaintext string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE scope = $1 AND hash = $2`
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, hash[:])
+	return err
+}
+
+// RecordFailure counts a failed attempt to use the token with the given
+// plaintext in scope, revoking it once max attempts have failed.
+func (m TokenModel) RecordFailure(scope, tokenPlaintext string, max int) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+            UPDATE tokens SET attempts = attempts + 1
+            WHERE scope = $1 AND hash = $2
+            RETURNING attempts`
+
+		var attempts int
+
+		err := tx.QueryRowContext(ctx, query, scope, hash[:]).Scan(&attempts)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if attempts < max {
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE hash = $1`, hash[:])
+		return err
+	})
+}
+
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `
         DELETE FROM tokens 
@@ -91,3 +233,20 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteExpired removes tokens of every scope that have passed their expiry.
+func (m TokenModel) DeleteExpired() (int64, error) {
+	query := `
+        DELETE FROM tokens
+        WHERE expiry < now()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type TrashItem struct {
+	Resource  string    `json:"resource"`
+	ID        string    `json:"id"`
+	Label     *string   `json:"label"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy *int64    `json:"deleted_by"`
+}
+
+type TrashModel struct {
+	DB *sql.DB
+}
+
+var trashColumns = map[string]string{
+	"resource":   "resource",
+	"id":         "id",
+	"label":      "label",
+	"deleted_at": "deleted_at",
+	"deleted_by": "deleted_by",
+}
+
+var (
+	TrashFilterSafelist = safelist(trashColumns)
+	TrashSortSafelist   = sortSafelist(trashColumns)
+)
+
+const trashQuery = `(
+	SELECT 'warehouse' AS resource, warehouse_id::text AS id, name_warehouse AS label, deleted_at, deleted_by
+	FROM warehouse WHERE deleted_at IS NOT NULL
+	UNION ALL
+	SELECT 'rak', rak_id::text, rak_code, deleted_at, deleted_by
+	FROM rak WHERE deleted_at IS NOT NULL
+	UNION ALL
+	SELECT 'stok', id::text, produk_code, deleted_at, deleted_by
+	FROM stok WHERE deleted_at IS NOT NULL
+) trash`
+
+// trashPurges hard-deletes soft-deleted rows older than $1, children first.
+// Rak and warehouse rows still referenced by live rows are kept.
+var trashPurges = []struct {
+	source  auditSource
+	queries []string
+}{
+	{stokAudit, []string{
+		`DELETE FROM stok_detail WHERE stok_id IN (SELECT id FROM stok WHERE deleted_at < $1)`,
+		`DELETE FROM stok WHERE deleted_at < $1 RETURNING id`,
+	}},
+	{rakAudit, []string{
+		`DELETE FROM rak WHERE deleted_at < $1
+		AND NOT EXISTS (SELECT 1 FROM stok_detail sd WHERE sd.rak_id = rak.rak_id)
+		RETURNING rak_id`,
+	}},
+	{warehouseAudit, []string{
+		`DELETE FROM warehouse WHERE deleted_at < $1
+		AND NOT EXISTS (SELECT 1 FROM rak r WHERE r.warehouse_id = warehouse.warehouse_id)
+		AND NOT EXISTS (SELECT 1 FROM stok_detail sd WHERE sd.warehouse_id = warehouse.warehouse_id)
+		RETURNING warehouse_id`,
+	}},
+}
+
+func (m TrashModel) GetAll(resource string, filters Filters) ([]*TrashItem, Metadata, error) {
+	q := listQuery{
+		columns: `resource, id, label, deleted_at, deleted_by`,
+		from:    trashQuery,
+		order:   filters.sortKeys(trashColumns, "resource || '/' || id"),
+	}
+
+	if resource != "" {
+		q.filter("resource = " + q.arg(resource))
+	}
+
+	q.conditions(filters.Conditions, trashColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	items := []*TrashItem{}
+	keys := []string{}
+
+	for rows.Next() {
+		var item TrashItem
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&item.Resource,
+			&item.ID,
+			&item.Label,
+			&item.DeletedAt,
+			&item.DeletedBy,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		items = append(items, &item)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&items, keys, totalRecords)
+
+	return items, metadata, nil
+}
+
+// Purge hard-deletes records that have been in the trash for longer than
+// retention and returns how many were removed.
+func (m TrashModel) Purge(retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention)
+	purged := 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, p := range trashPurges {
+		ids := []string{}
+
+		for _, query := range p.queries {
+			rows, err := tx.QueryContext(ctx, query, cutoff)
+			if err != nil {
+				return 0, fmt.Errorf("purge %s: %w", p.source.resource, err)
+			}
+
+			for rows.Next() {
+				var id string
+
+				err = rows.Scan(&id)
+				if err != nil {
+					rows.Close()
+					return 0, err
+				}
+
+				ids = append(ids, id)
+			}
+
+			rows.Close()
+
+			if err = rows.Err(); err != nil {
+				return 0, err
+			}
+		}
+
+		for _, id := range ids {
+			err = p.source.record(ctx, tx, Actor{}, "purge", id, nil)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		purged += len(ids)
+	}
+
+	return purged, tx.Commit()
+}
@@ -0,0 +1,207 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrTwoFactorEnabled is returned when enrolling a user whose second factor
+// has already been confirmed.
+var ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+
+// TOTP is a user's authenticator app. It only counts as a second factor once
+// the user has confirmed it with a code, which sets ConfirmedAt. Secret is
+// stored as given, which is sealed by the caller so that the database alone
+// cannot produce codes.
+type TOTP struct {
+	UserID       int64
+	Secret       string
+	CreatedAt    time.Time
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+// Confirmed reports whether t is set and confirmed.
+func (t *TOTP) Confirmed() bool {
+	return t != nil && t.ConfirmedAt != nil
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Get returns the user's authenticator, confirmed or not.
+func (m TwoFactorModel) Get(userID int64) (*TOTP, error) {
+	query := `
+        SELECT user_id, secret, created_at, confirmed_at, last_used_step
+        FROM users_totp
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t TOTP
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.CreatedAt, &t.ConfirmedAt, &t.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Enrol gives the user a new, unconfirmed, authenticator secret, replacing
+// any earlier one that was never confirmed.
+func (m TwoFactorModel) Enrol(userID int64, secret string) error {
+	query := `
+        INSERT INTO users_totp (user_id, secret)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret = EXCLUDED.secret, created_at = now(), last_used_step = 0
+        WHERE users_totp.confirmed_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// UseStep records that the code for step has been used. It reports false if
+// that code, or a later one, was used before, so that a code seen by someone
+// else cannot be replayed.
+func (m TwoFactorModel) UseStep(userID int64, step int64) (bool, error) {
+	query := `
+        UPDATE users_totp
+        SET last_used_step = $2
+        WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+// Confirm turns on the user's authenticator and gives them recoveryCodes.
+func (m TwoFactorModel) Confirm(userID int64, recoveryCodes []string) error {
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE users_totp SET confirmed_at = now() WHERE user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		return setRecoveryCodes(ctx, tx, userID, recoveryCodes)
+	})
+}
+
+// Delete turns off two-factor authentication for the user.
+func (m TwoFactorModel) Delete(userID int64) error {
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+// NewRecoveryCodes returns ten random one-time codes that stand in for the
+// authenticator when it is lost.
+func NewRecoveryCodes() ([]string, error) {
+	codes := make([]string, 10)
+
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+		codes[i] = code[:5] + "-" + code[5:10]
+	}
+
+	return codes, nil
+}
+
+func recoveryCodeHash(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+func setRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64, codes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, recoveryCodeHash(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetRecoveryCodes replaces the user's recovery codes.
+func (m TwoFactorModel) SetRecoveryCodes(userID int64, codes []string) error {
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		return setRecoveryCodes(ctx, tx, userID, codes)
+	})
+}
+
+// UseRecoveryCode spends one of the user's recovery codes, reporting false if
+// code is not one of them.
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+        DELETE FROM recovery_codes
+        WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, recoveryCodeHash(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
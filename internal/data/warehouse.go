@@ -8,34 +8,66 @@ import (
 	"time"
 
 	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/lib/pq"
 )
 
 type Warehouse struct {
-	Perusahaan_Id     int64     `json:"perusahaan_id"`
-	Warehouse_id      int64     `json:"warehouse_id"`
-	Name_perusahaan   string    `json:"name_perusahaan"`
-	Name_warehouse    string    `json:"name_warehouse"`
-	Address_warehouse string    `json:"address_warehouse"`
-	Tlp_warehouse     string    `json:"tlp_warehouse"`
-	Ket_warehouse     string    `json:"ket_warehouse"`
-	User_modified     string    `json:"user_modified"`
-	Created_at        time.Time `json:"created_at"`
-	Version           int32     `json:"Version"`
+	Perusahaan_Id     int64       `json:"perusahaan_id"`
+	Warehouse_id      int64       `json:"warehouse_id"`
+	Name_perusahaan   string      `json:"name_perusahaan"`
+	Name_warehouse    string      `json:"name_warehouse"`
+	Address_warehouse string      `json:"address_warehouse"`
+	Tlp_warehouse     string      `json:"tlp_warehouse"`
+	Ket_warehouse     string      `json:"ket_warehouse"`
+	User_modified     string      `json:"user_modified"`
+	Created_at        time.Time   `json:"created_at"`
+	Version           int32       `json:"Version"`
+	Perusahaan        *Perusahaan `json:"perusahaan,omitempty"`
 }
 
 func ValidateWarehouse(v *validator.Validator, usaha *Warehouse) {
-	v.Check(usaha.Name_warehouse != "", "Nama", "harus diisi")
-	v.Check(len(usaha.Address_warehouse) >= 1888, "Alamat", "harus lebih besar dari 10 karakter")
+	v.Check(usaha.Name_warehouse != "", "Nama", validator.Required)
+	v.Check(len(usaha.Address_warehouse) >= 1888, "Alamat", validator.MinLength, 1888)
 
-	v.Check(usaha.Tlp_warehouse != "", "Tlp", "harus  diisi")
+	v.Check(usaha.Tlp_warehouse != "", "Tlp", validator.Required)
 
 }
 
 type WarehouseModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	scope *Scope
+}
+
+var warehouseColumns = map[string]string{
+	"warehouse_id":      "a.warehouse_id",
+	"perusahaan_id":     "a.perusahaan_id",
+	"name_perusahaan":   "b.name",
+	"name_warehouse":    "a.name_warehouse",
+	"address_warehouse": "a.address_warehouse",
+	"tlp_warehouse":     "a.tlp_warehouse",
+	"ket_warehouse":     "a.ket_warehouse",
+	"user_modified":     "a.user_modified",
+	"created_at":        "a.created_at",
+	"version":           "a.version",
+	"qty":               "(select coalesce(sum(sd.qty), 0) from stok_detail sd inner join stok st on st.id = sd.stok_id where sd.warehouse_id = a.warehouse_id and st.deleted_at is null)",
 }
 
-func (m WarehouseModel) Insert(usaha *Warehouse) error {
+var warehouseJoins = map[string]string{
+	"b": "inner join perusahaan b on a.perusahaan_id = b.id",
+}
+
+var (
+	WarehouseFilterSafelist = safelist(warehouseColumns)
+	WarehouseSortSafelist   = sortSafelist(warehouseColumns)
+	WarehouseFieldSafelist  = jsonFields(Warehouse{})
+	WarehouseRelations      = map[string]string{"perusahaan": "perusahaan"}
+)
+
+func (m WarehouseModel) Insert(usaha *Warehouse, actor Actor) error {
+	if !m.scope.allowsPerusahaan(usaha.Perusahaan_Id) {
+		return ErrOutOfScope
+	}
 
 	query := `
 		INSERT INTO warehouse (name_warehouse, address_warehouse, tlp_warehouse, ket_warehouse,user_modified,perusahaan_id) 
@@ -49,11 +81,14 @@ func (m WarehouseModel) Insert(usaha *Warehouse) error {
 
 	args := []interface{}{usaha.Name_warehouse, usaha.Address_warehouse, usaha.Tlp_warehouse, usaha.Ket_warehouse, usaha.User_modified, usaha.Perusahaan_Id}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&usaha.Warehouse_id, &usaha.Created_at, &usaha.Version)
+		if err != nil {
+			return err
+		}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.Warehouse_id, &usaha.Created_at,
-		&usaha.Version)
+		return warehouseAudit.record(ctx, tx, actor, "insert", usaha.Warehouse_id, nil)
+	})
 }
 
 func (m WarehouseModel) Get(id int64) (*Warehouse, error) {
@@ -66,14 +101,15 @@ func (m WarehouseModel) Get(id int64) (*Warehouse, error) {
 	a.created_at,a.version
 	FROM warehouse a
 	inner join perusahaan b on a.perusahaan_id=b.id
-	WHERE a.warehouse_id= $1 `
+	WHERE a.warehouse_id= $1 AND a.deleted_at IS NULL
+	AND ($2::bigint[] IS NULL OR a.warehouse_id = ANY($2))`
 
 	var usaha Warehouse
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, m.scope.warehouses()).Scan(
 		&usaha.Perusahaan_Id,
 		&usaha.Warehouse_id,
 		&usaha.Name_perusahaan,
@@ -98,11 +134,12 @@ func (m WarehouseModel) Get(id int64) (*Warehouse, error) {
 	return &usaha, nil
 }
 
-func (m WarehouseModel) Update(usaha *Warehouse) error {
+func (m WarehouseModel) Update(usaha *Warehouse, actor Actor) error {
 	query := `
 	UPDATE warehouse 
 	SET name_warehouse = $1, address_warehouse = $2, tlp_warehouse = $3, ket_warehouse = $4, version = version + 1, modified_at= now(),perusahaan_id = $5
-	WHERE warehouse_id = $6 AND version = $7
+	WHERE warehouse_id = $6 AND version = $7 AND deleted_at IS NULL
+	AND ($8::bigint[] IS NULL OR warehouse_id = ANY($8))
 	RETURNING version`
 
 	args := []interface{}{
@@ -113,99 +150,153 @@ func (m WarehouseModel) Update(usaha *Warehouse) error {
 		usaha.Perusahaan_Id,
 		usaha.Warehouse_id,
 		usaha.Version,
+		m.scope.warehouses(),
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := warehouseAudit.snapshot(ctx, tx, usaha.Warehouse_id)
+		if err != nil {
+			return err
+		}
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+		err = m.checkMove(ctx, tx, usaha)
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&usaha.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return warehouseAudit.record(ctx, tx, actor, "update", usaha.Warehouse_id, old)
+	})
 }
 
-func (m WarehouseModel) Delete(id int64) error {
+func (m WarehouseModel) Delete(id int64, version int32, actor Actor) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
-        DELETE FROM warehouse
-        WHERE warehouse_id = $1`
+        UPDATE warehouse
+        SET deleted_at = now(), deleted_by = NULLIF($3::bigint, 0), version = version + 1
+        WHERE warehouse_id = $1 AND version = $2 AND deleted_at IS NULL
+        AND ($4::bigint[] IS NULL OR warehouse_id = ANY($4))`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := warehouseAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+		result, err := tx.ExecContext(ctx, query, id, version, actor.UserID, m.scope.warehouses())
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrEditConflict
+		}
 
-	if rowsAffected == 0 {
+		return warehouseAudit.record(ctx, tx, actor, "delete", id, old)
+	})
+}
+
+func (m WarehouseModel) Restore(id int64, actor Actor) error {
+	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	query := `
+        UPDATE warehouse
+        SET deleted_at = NULL, deleted_by = NULL, version = version + 1
+        WHERE warehouse_id = $1 AND deleted_at IS NOT NULL
+        AND ($2::bigint[] IS NULL OR warehouse_id = ANY($2))`
+
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		old, err := warehouseAudit.snapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, query, id, m.scope.warehouses())
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return warehouseAudit.record(ctx, tx, actor, "restore", id, old)
+	})
 }
 
 func (m WarehouseModel) GetAll(name string, alamat string, filters Filters) ([]*Warehouse, Metadata, error) {
+	q := listQuery{
+		from:  "warehouse a",
+		joins: warehouseJoins,
+		order: filters.sortKeys(warehouseColumns, "a.warehouse_id"),
+	}
 
-	query := fmt.Sprintf(`
-	SELECT count(*) OVER(),a.perusahaan_id,a.warehouse_id,b.name name_perusahaan,a.name_warehouse, a.address_warehouse, a.tlp_warehouse, a.ket_warehouse,a.user_modified,
-	a.created_at,a.version
-	FROM warehouse a
-	inner join perusahaan b on a.perusahaan_id=b.id
-	where lower(a.name_warehouse) like lower('%%` + name + `%%') and  lower(a.address_warehouse) like lower('%%` + alamat + `%%') 
-	ORDER BY a.created_at
-	LIMIT $1 OFFSET $2`)
+	q.selects(filters.Projection, warehouseColumns,
+		"perusahaan_id", "warehouse_id", "name_perusahaan", "name_warehouse", "address_warehouse", "tlp_warehouse", "ket_warehouse", "user_modified",
+		"created_at", "version")
+
+	q.filter("a.deleted_at IS NULL")
+	m.scope.filter(&q, "a.warehouse_id = ANY(%s)")
+
+	q.like("a.name_warehouse", name)
+	q.like("a.address_warehouse", alamat)
 
-	// query := fmt.Sprintf(`
-	// SELECT count(*) OVER(), id, created_at, name, address, tlp, npwp, rek,ket,version,0
-	// FROM perusahaan
-	// WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-	// ORDER BY %s %s
-	// LIMIT $2 OFFSET $3`, "name", "asc")
+	q.conditions(filters.Conditions, warehouseColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	//args := []interface{}{name}
-	args := []interface{}{filters.limit(), filters.offset()}
-
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		fmt.Println("err-db")
-		return nil, Metadata{}, err
+		return nil, Metadata{}, listError(err)
 	}
 
 	defer rows.Close()
 
 	totalRecords := 0
 	usahas := []*Warehouse{}
+	keys := []string{}
 
 	for rows.Next() {
 		var usaha Warehouse
+		var namePerusahaan sql.NullString
+		var key string
 
-		// SELECT count(*) OVER(),a.perusahaan_id,a.warehouse_id,b.name name_perusahaan,a.name_warehouse,
-		// a.address_warehouse, a.tlp_warehouse, a.ket_warehouse,a.user_modified,
-		// a.created_at,a.version
 		err := rows.Scan(
 			&totalRecords,
 			&usaha.Perusahaan_Id,
 			&usaha.Warehouse_id,
-			&usaha.Name_perusahaan,
+			&namePerusahaan,
 			&usaha.Name_warehouse,
 			&usaha.Address_warehouse,
 			&usaha.Tlp_warehouse,
@@ -213,19 +304,144 @@ func (m WarehouseModel) GetAll(name string, alamat string, filters Filters) ([]*
 			&usaha.User_modified,
 			&usaha.Created_at,
 			&usaha.Version,
+			&key,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
+		usaha.Name_perusahaan = namePerusahaan.String
+
 		usahas = append(usahas, &usaha)
+		keys = append(keys, key)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := filters.paginate(&usahas, keys, totalRecords)
+
+	if filters.includes("perusahaan") {
+		err = m.loadPerusahaans(usahas)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
 
 	return usahas, metadata, nil
 }
+
+// checkMove returns ErrOutOfScope if an update would move a warehouse to a
+// perusahaan outside the model's scope.
+func (m WarehouseModel) checkMove(ctx context.Context, tx *sql.Tx, usaha *Warehouse) error {
+	if m.scope.allowsPerusahaan(usaha.Perusahaan_Id) {
+		return nil
+	}
+
+	var current int64
+
+	err := tx.QueryRowContext(ctx, `SELECT perusahaan_id FROM warehouse WHERE warehouse_id = $1`, usaha.Warehouse_id).Scan(&current)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if current != usaha.Perusahaan_Id {
+		return ErrOutOfScope
+	}
+
+	return nil
+}
+
+func (m WarehouseModel) GetWith(id int64, p Projection) (*Warehouse, error) {
+	usaha, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.includes("perusahaan") {
+		err = m.loadPerusahaans([]*Warehouse{usaha})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return usaha, nil
+}
+
+func (m WarehouseModel) getMany(ids []int64) (map[int64]*Warehouse, error) {
+	usahas := make(map[int64]*Warehouse)
+
+	if len(ids) == 0 {
+		return usahas, nil
+	}
+
+	query := `
+	SELECT a.perusahaan_id,a.warehouse_id,b.name name_perusahaan,a.name_warehouse, a.address_warehouse, a.tlp_warehouse, a.ket_warehouse,a.user_modified,
+	a.created_at,a.version
+	FROM warehouse a
+	inner join perusahaan b on a.perusahaan_id=b.id
+	WHERE a.warehouse_id = ANY($1) AND a.deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var usaha Warehouse
+
+		err := rows.Scan(
+			&usaha.Perusahaan_Id,
+			&usaha.Warehouse_id,
+			&usaha.Name_perusahaan,
+			&usaha.Name_warehouse,
+			&usaha.Address_warehouse,
+			&usaha.Tlp_warehouse,
+			&usaha.Ket_warehouse,
+			&usaha.User_modified,
+			&usaha.Created_at,
+			&usaha.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		usahas[usaha.Warehouse_id] = &usaha
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return usahas, nil
+}
+
+func (m WarehouseModel) loadPerusahaans(usahas []*Warehouse) error {
+	ids := []int64{}
+
+	for _, usaha := range usahas {
+		ids = append(ids, usaha.Perusahaan_Id)
+	}
+
+	perusahaans, err := PerusahaanModel{DB: m.DB}.getMany(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, usaha := range usahas {
+		usaha.Perusahaan = perusahaans[usaha.Perusahaan_Id]
+	}
+
+	return nil
+}
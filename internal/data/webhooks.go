@@ -0,0 +1,564 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"greenlight.alexedwards.net/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+// Delivery statuses. A pending delivery is retried until it succeeds or runs
+// out of attempts.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+type WebhookDelivery struct {
+	ID            int64             `json:"id"`
+	CreatedAt     time.Time         `json:"created_at"`
+	WebhookID     int64             `json:"webhook_id"`
+	Event         string            `json:"event"`
+	Payload       json.RawMessage   `json:"payload,omitempty"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt time.Time         `json:"next_attempt_at"`
+	DeliveredAt   *time.Time        `json:"delivered_at"`
+	History       []*WebhookAttempt `json:"history,omitempty"`
+
+	// URL and Secret are filled in by Claim for the sender.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+type WebhookAttempt struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	DeliveryID int64     `json:"-"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// WebhookEvents lists the event types a webhook can subscribe to.
+var WebhookEvents = func() []string {
+	events := []string{}
+
+	for _, resource := range []string{"perusahaan", "warehouse", "rak", "brand", "brandasset", "stok"} {
+		for _, action := range []string{"created", "updated", "deleted", "restored", "reverted"} {
+			events = append(events, resource+"."+action)
+		}
+	}
+
+	return append(events, "stok.quantity_changed", "stok_detail.created", "stok_detail.updated", "stok_detail.deleted")
+}()
+
+var webhookColumns = map[string]string{
+	"id":         "id",
+	"created_at": "created_at",
+	"url":        "url",
+	"active":     "active",
+}
+
+var deliveryColumns = map[string]string{
+	"id":              "id",
+	"created_at":      "created_at",
+	"event":           "event",
+	"status":          "status",
+	"attempts":        "attempts",
+	"next_attempt_at": "next_attempt_at",
+	"delivered_at":    "delivered_at",
+}
+
+var (
+	WebhookFilterSafelist  = safelist(webhookColumns)
+	WebhookSortSafelist    = sortSafelist(webhookColumns)
+	DeliveryFilterSafelist = safelist(deliveryColumns)
+	DeliverySortSafelist   = sortSafelist(deliveryColumns)
+)
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && validator.In(u.Scheme, "http", "https") && u.Host != "", "url", validator.InvalidURL)
+
+	v.Check(len(webhook.Secret) >= 16, "secret", validator.MinLength, 16)
+
+	v.Check(len(webhook.Events) > 0, "events", validator.NotEmpty)
+	v.Check(validator.Unique(webhook.Events), "events", validator.Duplicate)
+
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", validator.UnknownEvent, event)
+	}
+}
+
+// Enqueue queues a delivery of event for every active webhook subscribed to
+// it. It is safe to call more than once for the same event.
+func (m WebhookModel) Enqueue(event *OutboxEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, outbox_id, event, payload)
+		SELECT id, $1, $2, $3 FROM webhooks
+		WHERE active AND $2 = ANY(events)
+		ON CONFLICT (webhook_id, outbox_id) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, event.ID, event.Event, string(payload))
+	return err
+}
+
+func (m WebhookModel) Insert(webhook *Webhook, actor Actor) error {
+	query := `
+		INSERT INTO webhooks (user_id, url, secret, events, active)
+		VALUES (NULLIF($1::bigint, 0), $2, $3, $4, $5)
+		RETURNING id, created_at, version`
+
+	args := []interface{}{actor.UserID, webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Get returns a webhook. The secret is included so that updates can keep it,
+// and must be cleared before the webhook is shown to a client.
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		WHERE id = $1`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, secret = $2, events = $3, active = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	args := []interface{}{
+		webhook.URL,
+		webhook.Secret,
+		pq.Array(webhook.Events),
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m WebhookModel) Delete(id int64, version int32) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1 AND version = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+func (m WebhookModel) GetAll(filters Filters) ([]*Webhook, Metadata, error) {
+	q := listQuery{
+		columns: `id, created_at, url, events, active, version`,
+		from:    `webhooks`,
+		order:   filters.sortKeys(webhookColumns, "id"),
+	}
+
+	q.conditions(filters.Conditions, webhookColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	webhooks := []*Webhook{}
+	keys := []string{}
+
+	for rows.Next() {
+		var webhook Webhook
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&webhooks, keys, totalRecords)
+
+	return webhooks, metadata, nil
+}
+
+func (m WebhookModel) GetDeliveries(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	q := listQuery{
+		columns: `id, created_at, webhook_id, event, status, attempts, next_attempt_at, delivered_at`,
+		from:    `webhook_deliveries`,
+		order:   filters.sortKeys(deliveryColumns, "id"),
+	}
+
+	q.filter("webhook_id = " + q.arg(webhookID))
+
+	q.conditions(filters.Conditions, deliveryColumns)
+
+	query, args, err := q.build(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, listError(err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	keys := []string{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var key string
+
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.DeliveredAt,
+			&key,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := filters.paginate(&deliveries, keys, totalRecords)
+
+	return deliveries, metadata, nil
+}
+
+// GetDelivery returns a delivery of the webhook with its payload and the
+// history of attempts to send it.
+func (m WebhookModel) GetDelivery(webhookID int64, id int64) (*WebhookDelivery, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, webhook_id, event, payload, status, attempts, next_attempt_at, delivered_at
+		FROM webhook_deliveries
+		WHERE id = $1 AND webhook_id = $2`
+
+	var delivery WebhookDelivery
+	var payload []byte
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, webhookID).Scan(
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.DeliveredAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	delivery.Payload = payload
+
+	query = `
+		SELECT id, created_at, delivery_id, status_code, error, duration_ms
+		FROM webhook_attempts
+		WHERE delivery_id = $1
+		ORDER BY id`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	delivery.History = []*WebhookAttempt{}
+
+	for rows.Next() {
+		var attempt WebhookAttempt
+
+		err := rows.Scan(
+			&attempt.ID,
+			&attempt.CreatedAt,
+			&attempt.DeliveryID,
+			&attempt.StatusCode,
+			&attempt.Error,
+			&attempt.DurationMS,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		delivery.History = append(delivery.History, &attempt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// Claim picks up to limit pending deliveries that are due and pushes their
+// next attempt back by lease, so that other senders leave them alone while
+// they are being sent.
+func (m WebhookModel) Claim(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = now() + make_interval(secs => $2)
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT dd.id FROM webhook_deliveries dd
+			INNER JOIN webhooks ww ON ww.id = dd.webhook_id
+			WHERE dd.status = 'pending' AND dd.next_attempt_at <= now() AND ww.active
+			ORDER BY dd.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF dd SKIP LOCKED)
+		RETURNING d.id, d.created_at, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload []byte
+
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&payload,
+			&delivery.Attempts,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		delivery.Payload = payload
+		delivery.Status = DeliveryPending
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// RecordAttempt stores the outcome of one attempt to send a delivery and
+// moves the delivery to status, retrying at next if it is still pending.
+func (m WebhookModel) RecordAttempt(attempt *WebhookAttempt, status string, next time.Time) error {
+	return withTx(m.DB, nil, func(ctx context.Context, tx *sql.Tx) error {
+		query := `
+			INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at`
+
+		args := []interface{}{attempt.DeliveryID, attempt.StatusCode, attempt.Error, attempt.DurationMS}
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&attempt.ID, &attempt.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, status = $2, next_attempt_at = $3,
+				delivered_at = CASE WHEN $2 = 'succeeded' THEN now() END
+			WHERE id = $1`
+
+		_, err = tx.ExecContext(ctx, query, attempt.DeliveryID, status, next)
+		return err
+	})
+}
+
+// Redeliver queues a delivery to be sent again straight away, with a fresh
+// set of attempts.
+func (m WebhookModel) Redeliver(webhookID int64, id int64) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = now(), delivered_at = NULL
+		WHERE id = $1 AND webhook_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, webhookID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookClaim(t *testing.T) {
+	m := WebhookModel{DB: newTestDB(t)}
+
+	webhook := &Webhook{
+		URL:    "http://127.0.0.1/hook",
+		Secret: "0123456789abcdef",
+		Events: []string{"stok.updated"},
+		Active: true,
+	}
+
+	err := m.Insert(webhook, Actor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		m.DB.Exec(`DELETE FROM webhooks WHERE id = $1`, webhook.ID)
+	})
+
+	// Outbox IDs only need to be unique per webhook, so events that were
+	// never in the outbox will do.
+	base := time.Now().UnixNano()
+
+	for _, event := range []*OutboxEvent{
+		{ID: base, Event: "stok.updated"},
+		{ID: base, Event: "stok.updated"},
+		{ID: base + 1, Event: "stok.updated"},
+		{ID: base + 2, Event: "warehouse.created"},
+	} {
+		err = m.Enqueue(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// claim returns the deliveries of this test's webhook that Claim leases.
+	claim := func() []*WebhookDelivery {
+		t.Helper()
+
+		deliveries, err := m.Claim(100, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		own := []*WebhookDelivery{}
+
+		for _, d := range deliveries {
+			if d.WebhookID == webhook.ID {
+				own = append(own, d)
+			}
+		}
+
+		return own
+	}
+
+	// Two senders claiming at once must never get the same delivery.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := map[int64]int{}
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			deliveries, err := m.Claim(100, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for _, d := range deliveries {
+				if d.WebhookID == webhook.ID {
+					seen[d.ID]++
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(seen) != 2 {
+		t.Fatalf("claimed %d deliveries, want one for each subscribed event", len(seen))
+	}
+
+	ids := []int64{}
+
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("delivery %d claimed %d times", id, n)
+		}
+		ids = append(ids, id)
+	}
+
+	if got := claim(); len(got) != 0 {
+		t.Fatalf("claimed %d deliveries that are still leased", len(got))
+	}
+
+	// A failed attempt makes the delivery due again at the time given.
+	err = m.RecordAttempt(&WebhookAttempt{DeliveryID: ids[0], StatusCode: 500, Error: "boom"}, DeliveryPending, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := claim()
+	if len(got) != 1 || got[0].ID != ids[0] || got[0].Attempts != 1 {
+		t.Fatalf("got %+v, want delivery %d after one attempt", got, ids[0])
+	}
+
+	if got[0].URL != webhook.URL || got[0].Secret != webhook.Secret {
+		t.Errorf("claimed delivery has URL %q and secret %q", got[0].URL, got[0].Secret)
+	}
+
+	// Neither a delivered one nor one for an inactive webhook is claimed.
+	err = m.RecordAttempt(&WebhookAttempt{DeliveryID: ids[0], StatusCode: 200}, DeliverySucceeded, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.RecordAttempt(&WebhookAttempt{DeliveryID: ids[1], StatusCode: 500}, DeliveryPending, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.DB.Exec(`UPDATE webhooks SET active = false WHERE id = $1`, webhook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := claim(); len(got) != 0 {
+		t.Fatalf("claimed %d deliveries, want none", len(got))
+	}
+}
@@ -0,0 +1,78 @@
+// Package i18n holds the catalogue of messages the API returns to clients, in
+// every language it speaks, and picks a language for a request.
+package i18n
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Supported languages.
+const (
+	English    = "en"
+	Indonesian = "id"
+)
+
+var Languages = []string{English, Indonesian}
+
+func Supported(lang string) bool {
+	_, ok := catalogue[lang]
+	return ok
+}
+
+// Message returns the message for code in lang with params filled in. It
+// falls back to English, and then to the code itself, for a message that has
+// not been translated.
+func Message(lang, code string, params ...interface{}) string {
+	format, ok := catalogue[lang][code]
+	if !ok {
+		format, ok = catalogue[English][code]
+	}
+
+	if !ok {
+		return code
+	}
+
+	if len(params) == 0 {
+		return format
+	}
+
+	return fmt.Sprintf(format, params...)
+}
+
+// Negotiate returns the supported language that an Accept-Language header
+// prefers most, going by the primary subtag of each entry, so "id-ID" picks
+// Indonesian. It returns "" if the header names none of them.
+func Negotiate(header string) string {
+	best := ""
+	bestQ := 0.0
+
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ";")
+
+		tag := strings.ToLower(strings.TrimSpace(parts[0]))
+		if i := strings.Index(tag, "-"); i >= 0 {
+			tag = tag[:i]
+		}
+
+		q := 1.0
+
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+
+			if strings.HasPrefix(param, "q=") {
+				n, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = n
+				}
+			}
+		}
+
+		if Supported(tag) && q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,132 @@
+package i18n
+
+import "greenlight.alexedwards.net/internal/validator"
+
+var catalogue = map[string]map[string]string{
+	English: {
+		validator.Required:              "must be provided",
+		validator.InvalidEmail:          "must be a valid email address",
+		validator.InvalidURL:            "must be an absolute http or https URL",
+		validator.PrivateAddress:        "must not point to a private, loopback or link-local address",
+		validator.UnknownHost:           "must have a host name that can be resolved",
+		validator.MinLength:             "must be at least %d bytes long",
+		validator.MaxLength:             "must not be more than %d bytes long",
+		validator.ExactLength:           "must be %d bytes long",
+		validator.Positive:              "must be greater than zero",
+		validator.GreaterThan:           "must be greater than %v",
+		validator.MaxValue:              "must be a maximum of %v",
+		validator.NotInFuture:           "must not be in the future",
+		validator.NotEmpty:              "must contain at least one value",
+		validator.MaxItems:              "must not contain more than %d values",
+		validator.SingleValue:           "must contain exactly one value",
+		validator.Duplicate:             "must not contain duplicate values",
+		validator.OneOf:                 "must be one of %s",
+		validator.Integer:               "must be an integer value",
+		validator.Boolean:               "must be a boolean value",
+		validator.InvalidFilter:         "invalid filter expression",
+		validator.UnknownFilterField:    "invalid filter field",
+		validator.UnknownFilterOperator: "invalid filter operator",
+		validator.InvalidSort:           "invalid sort value",
+		validator.InvalidCursor:         "invalid cursor value",
+		validator.CursorMismatch:        "does not match the sort value",
+		validator.UnknownField:          "invalid field %s",
+		validator.UnknownInclude:        "invalid include value %s",
+		validator.UnknownEvent:          "contains an unknown event: %s",
+		validator.InvalidIDList:         "must be a comma separated list of IDs",
+		validator.InvalidEventID:        "is not an ID sent by this stream",
+		validator.EmailTaken:            "a user with this email address already exists",
+		validator.EmailNotFound:         "no matching email address found",
+		validator.AccountInactive:       "user account must be activated",
+		validator.AlreadyActivated:      "user has already been activated",
+		validator.InvalidToken:          "invalid or expired token",
+		validator.AlreadyExists:         "is already in use",
+		validator.UnknownPermission:     "contains an unknown permission: %s",
+		validator.PermissionNotHeld:     "contains a permission you do not hold: %s",
+		validator.Exclusive:             "must not be given together with %s",
+		validator.OutOfScope:            "must be one you have access to",
+		validator.InvalidIP:             "contains an invalid IP address or network: %s",
+		validator.AlreadyEnabled:        "is already enabled",
+
+		"server_error":                 "the server encountered a problem and could not process your request",
+		"operation_failed":             "the server encountered a problem and could not process this operation",
+		"not_found":                    "the requested resource could not be found",
+		"method_not_allowed":           "the %s method is not supported for this resource",
+		"edit_conflict":                "unable to update the record due to an edit conflict, please try again",
+		"precondition_failed":          "the record has been modified since it was fetched, please fetch it again",
+		"precondition_required":        "this request must include an If-Match header with the record's ETag",
+		"idempotency_key_reused":       "this Idempotency-Key has already been used for a different request",
+		"idempotency_key_in_progress":  "a request with this Idempotency-Key is still being processed, please try again later",
+		"rate_limit_exceeded":          "rate limit exceeded",
+		"too_many_sign_in_attempts":    "too many failed sign in attempts, please try again later",
+		"invalid_credentials":          "invalid authentication credentials",
+		"invalid_authentication_token": "invalid or missing authentication token",
+		"authentication_required":      "you must be authenticated to access this resource",
+		"inactive_account":             "your user account must be activated to access this resource",
+		"not_permitted":                "your user account doesn't have the necessary permissions to access this resource",
+		"no_linked_account":            "no user account is linked to your identity provider account",
+		"linked_to_other_user":         "your identity provider account is already linked to another user account",
+	},
+	Indonesian: {
+		validator.Required:              "harus diisi",
+		validator.InvalidEmail:          "harus berupa alamat email yang valid",
+		validator.InvalidURL:            "harus berupa URL http atau https yang lengkap",
+		validator.PrivateAddress:        "tidak boleh mengarah ke alamat privat, loopback atau link-local",
+		validator.UnknownHost:           "harus memiliki nama host yang dapat ditemukan",
+		validator.MinLength:             "harus minimal %d byte",
+		validator.MaxLength:             "tidak boleh lebih dari %d byte",
+		validator.ExactLength:           "harus tepat %d byte",
+		validator.Positive:              "harus lebih besar dari nol",
+		validator.GreaterThan:           "harus lebih besar dari %v",
+		validator.MaxValue:              "tidak boleh lebih dari %v",
+		validator.NotInFuture:           "tidak boleh di masa depan",
+		validator.NotEmpty:              "harus berisi minimal satu nilai",
+		validator.MaxItems:              "tidak boleh berisi lebih dari %d nilai",
+		validator.SingleValue:           "harus berisi tepat satu nilai",
+		validator.Duplicate:             "tidak boleh berisi nilai yang sama",
+		validator.OneOf:                 "harus salah satu dari %s",
+		validator.Integer:               "harus berupa bilangan bulat",
+		validator.Boolean:               "harus berupa nilai boolean",
+		validator.InvalidFilter:         "ekspresi filter tidak valid",
+		validator.UnknownFilterField:    "field filter tidak valid",
+		validator.UnknownFilterOperator: "operator filter tidak valid",
+		validator.InvalidSort:           "nilai sort tidak valid",
+		validator.InvalidCursor:         "nilai cursor tidak valid",
+		validator.CursorMismatch:        "tidak sesuai dengan nilai sort",
+		validator.UnknownField:          "field tidak valid: %s",
+		validator.UnknownInclude:        "nilai include tidak valid: %s",
+		validator.UnknownEvent:          "berisi event yang tidak dikenal: %s",
+		validator.InvalidIDList:         "harus berupa daftar ID yang dipisahkan koma",
+		validator.InvalidEventID:        "bukan ID yang dikirim oleh stream ini",
+		validator.EmailTaken:            "pengguna dengan alamat email ini sudah terdaftar",
+		validator.EmailNotFound:         "alamat email tidak ditemukan",
+		validator.AccountInactive:       "akun pengguna harus diaktifkan",
+		validator.AlreadyActivated:      "pengguna sudah diaktifkan",
+		validator.InvalidToken:          "token tidak valid atau sudah kedaluwarsa",
+		validator.AlreadyExists:         "sudah dipakai",
+		validator.UnknownPermission:     "berisi izin yang tidak dikenal: %s",
+		validator.PermissionNotHeld:     "berisi izin yang tidak Anda miliki: %s",
+		validator.Exclusive:             "tidak boleh diisi bersama %s",
+		validator.OutOfScope:            "harus yang dapat Anda akses",
+		validator.InvalidIP:             "berisi alamat IP atau jaringan yang tidak valid: %s",
+		validator.AlreadyEnabled:        "sudah diaktifkan",
+
+		"server_error":                 "server mengalami masalah dan tidak dapat memproses permintaan Anda",
+		"operation_failed":             "server mengalami masalah dan tidak dapat memproses operasi ini",
+		"not_found":                    "sumber daya yang diminta tidak ditemukan",
+		"method_not_allowed":           "metode %s tidak didukung untuk sumber daya ini",
+		"edit_conflict":                "data tidak dapat diperbarui karena konflik perubahan, silakan coba lagi",
+		"precondition_failed":          "data telah diubah sejak diambil, silakan ambil ulang",
+		"precondition_required":        "permintaan ini harus menyertakan header If-Match berisi ETag data",
+		"idempotency_key_reused":       "Idempotency-Key ini sudah dipakai untuk permintaan lain",
+		"idempotency_key_in_progress":  "permintaan dengan Idempotency-Key ini masih diproses, silakan coba lagi nanti",
+		"rate_limit_exceeded":          "batas jumlah permintaan terlampaui",
+		"too_many_sign_in_attempts":    "terlalu banyak percobaan login yang gagal, silakan coba lagi nanti",
+		"invalid_credentials":          "kredensial autentikasi tidak valid",
+		"invalid_authentication_token": "token autentikasi tidak valid atau tidak ada",
+		"authentication_required":      "Anda harus login untuk mengakses sumber daya ini",
+		"inactive_account":             "akun pengguna Anda harus diaktifkan untuk mengakses sumber daya ini",
+		"not_permitted":                "akun pengguna Anda tidak memiliki izin untuk mengakses sumber daya ini",
+		"no_linked_account":            "tidak ada akun pengguna yang terhubung dengan akun penyedia identitas Anda",
+		"linked_to_other_user":         "akun penyedia identitas Anda sudah terhubung dengan akun pengguna lain",
+	},
+}
@@ -0,0 +1,195 @@
+// Package jwt signs and verifies HS256 JSON Web Tokens. Tokens carry the ID of
+// the key that signed them, so that a new signing key can be brought in while
+// tokens signed with the old one are still accepted.
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid = errors.New("jwt: invalid token")
+	ErrExpired = errors.New("jwt: token has expired")
+)
+
+// MinSecretLength is the shortest secret a key may have, the size of the
+// HMAC-SHA256 output.
+const MinSecretLength = 32
+
+var encoding = base64.RawURLEncoding
+
+// Key is a named HMAC secret.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring signs tokens with its first key and verifies them with any of its
+// keys.
+type Keyring struct {
+	keys []Key
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// NewKeyring returns a keyring that signs with keys[0].
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: no keys given")
+	}
+
+	seen := map[string]bool{}
+
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("jwt: key has no ID")
+		}
+
+		if seen[key.ID] {
+			return nil, fmt.Errorf("jwt: key %q given more than once", key.ID)
+		}
+
+		if len(key.Secret) < MinSecretLength {
+			return nil, fmt.Errorf("jwt: key %q must be at least %d bytes long", key.ID, MinSecretLength)
+		}
+
+		seen[key.ID] = true
+	}
+
+	return &Keyring{keys: keys}, nil
+}
+
+// ParseKeys parses space separated id=secret pairs, the signing key first.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+
+	for _, field := range strings.Fields(s) {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("jwt: key %q is not of the form id=secret", field)
+		}
+
+		keys = append(keys, Key{ID: pair[0], Secret: []byte(pair[1])})
+	}
+
+	return keys, nil
+}
+
+// RandomKey returns a key with a random secret, for when none is configured.
+// Tokens signed with it stop working when the process exits.
+func RandomKey() (Key, error) {
+	secret := make([]byte, MinSecretLength)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return Key{}, err
+	}
+
+	return Key{ID: "random", Secret: secret}, nil
+}
+
+func sign(secret []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return encoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns claims, which must marshal to a JSON object, as a signed token.
+func (k *Keyring) Sign(claims interface{}) (string, error) {
+	key := k.keys[0]
+
+	h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+
+	return signingInput + "." + sign(key.Secret, signingInput), nil
+}
+
+// Verify checks the signature of token and its "exp" and "nbf" claims at now,
+// then unmarshals its claims into dst.
+func (k *Keyring) Verify(token string, now time.Time, dst interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalid
+	}
+
+	h, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalid
+	}
+
+	var hdr header
+
+	err = json.Unmarshal(h, &hdr)
+	if err != nil || hdr.Alg != "HS256" {
+		return ErrInvalid
+	}
+
+	var secret []byte
+
+	for _, key := range k.keys {
+		if key.ID == hdr.Kid {
+			secret = key.Secret
+			break
+		}
+	}
+
+	if secret == nil {
+		return ErrInvalid
+	}
+
+	expected := sign(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return ErrInvalid
+	}
+
+	c, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalid
+	}
+
+	var registered struct {
+		ExpiresAt *int64 `json:"exp"`
+		NotBefore *int64 `json:"nbf"`
+	}
+
+	err = json.Unmarshal(c, &registered)
+	if err != nil {
+		return ErrInvalid
+	}
+
+	if registered.ExpiresAt == nil || now.Unix() >= *registered.ExpiresAt {
+		return ErrExpired
+	}
+
+	if registered.NotBefore != nil && now.Unix() < *registered.NotBefore {
+		return ErrInvalid
+	}
+
+	err = json.Unmarshal(c, dst)
+	if err != nil {
+		return ErrInvalid
+	}
+
+	return nil
+}
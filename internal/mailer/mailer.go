@@ -4,64 +4,84 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
+	"io/fs"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
 
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// Message is an email rendered from one of the templates, ready to be handed
+// to a Transport.
+type Message struct {
+	To        string
+	From      string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+type Mailer struct {
+	transport Transport
+	sender    string
+}
 
+func New(transport Transport, sender string) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
 	}
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// Render builds the message for recipient from templateFile, which must
+// define the "subject", "plainBody" and "htmlBody" templates. The template is
+// taken from the templates/<lang> directory when it has a copy, and from
+// templates itself otherwise.
+func (m Mailer) Render(lang, recipient, templateFile string, data interface{}) (*Message, error) {
+	pattern := "templates/" + templateFile
+
+	if _, err := fs.Stat(templateFS, "templates/"+lang+"/"+templateFile); err == nil {
+		pattern = "templates/" + lang + "/" + templateFile
+	}
+
+	tmpl, err := template.New("email").ParseFS(templateFS, pattern)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg := &Message{
+		To:        recipient,
+		From:      m.sender,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}
 
-	err = m.dialer.DialAndSend(msg)
-	if err != nil {
-		return err
+	return msg, nil
+}
+
+// Send hands msg to the transport. Messages without a sender get the mailer's.
+func (m Mailer) Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = m.sender
 	}
 
-	return nil
+	return m.transport.Send(msg)
 }
@@ -0,0 +1,121 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// Transport delivers rendered messages.
+type Transport interface {
+	Send(msg *Message) error
+}
+
+func (msg *Message) build() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	return m
+}
+
+// SMTPTransport sends messages through an SMTP server, dialling it for each
+// message.
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPTransport{dialer: dialer}
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	return t.dialer.DialAndSend(msg.build())
+}
+
+// FileTransport drops each message into the maildir at Dir as an .eml file,
+// which most mail clients can open. It is meant for development.
+type FileTransport struct {
+	Dir string
+
+	seq uint64
+}
+
+func (t *FileTransport) Send(msg *Message) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(t.Dir, sub), 0o755)
+		if err != nil {
+			return err
+		}
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s.eml", time.Now().Unix(), os.Getpid(), atomic.AddUint64(&t.seq, 1), host)
+
+	// Maildir readers only look in new, so the file is written to tmp first
+	// and moved across once it is complete.
+	tmp := filepath.Join(t.Dir, "tmp", name)
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.build().WriteTo(f)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(t.Dir, "new", name))
+}
+
+// MemoryTransport keeps messages in memory instead of sending them, for
+// development and tests.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (t *MemoryTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, *msg)
+
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far.
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Message(nil), t.messages...)
+}
+
+// Reset forgets every message sent so far.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = nil
+}
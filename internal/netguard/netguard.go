@@ -0,0 +1,138 @@
+// Package netguard keeps requests that the server makes on behalf of its
+// users, such as webhook deliveries, away from its own network: loopback,
+// private and link-local addresses, and the cloud metadata endpoints on them.
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrNotPublic is returned for an address that is not on the public internet.
+var ErrNotPublic = errors.New("netguard: address is not public")
+
+// reserved are the ranges that are not public but that the net.IP methods do
+// not cover.
+var reserved = mustParseCIDRs(
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade NAT, and some cloud metadata endpoints
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, and the broadcast address
+	"64:ff9b::/96",    // NAT64, which can reach any IPv4 address
+	"2001:db8::/32",   // documentation
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		nets[i] = n
+	}
+
+	return nets
+}
+
+// Public reports whether ip is an address on the public internet.
+func Public(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+
+	for _, n := range reserved {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckHost resolves host, a name or an IP address, and returns ErrNotPublic
+// if any of its addresses is not public.
+func CheckHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !Public(ip) {
+			return fmt.Errorf("%w: %s", ErrNotPublic, host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !Public(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrNotPublic, host, addr.IP)
+		}
+	}
+
+	return nil
+}
+
+// control refuses to connect to an address that is not public. It runs after
+// the name has been resolved, so a name that resolved to a public address when
+// it was checked cannot be pointed somewhere else for the request itself.
+func control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !Public(ip) {
+		return fmt.Errorf("%w: %s", ErrNotPublic, host)
+	}
+
+	return nil
+}
+
+// Client returns an HTTP client that only connects to public addresses, does
+// not use a proxy and does not follow redirects, giving the caller the
+// redirect response instead.
+func Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: NoRedirects,
+	}
+}
+
+// NoRedirects is an http.Client CheckRedirect function that stops at the first
+// redirect and returns it as the response.
+func NoRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
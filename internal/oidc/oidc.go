@@ -0,0 +1,322 @@
+// Package oidc signs users in with an OpenID Connect identity provider, using
+// the authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRejected is returned when the identity provider does not accept a sign
+// in, or hands back an ID token that is not for this client or this sign in.
+var ErrRejected = errors.New("oidc: sign in rejected")
+
+var encoding = base64.RawURLEncoding
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Provider is an identity provider. Its endpoints are discovered from the
+// issuer the first time they are needed.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+func New(config Config) *Provider {
+	return &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery returned %s", res.Status)
+	}
+
+	var m metadata
+
+	err = json.NewDecoder(res.Body).Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+
+	if m.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery is for issuer %q, not %q", m.Issuer, p.config.Issuer)
+	}
+
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" {
+		return nil, errors.New("oidc: discovery is missing an endpoint")
+	}
+
+	p.metadata = &m
+
+	return p.metadata, nil
+}
+
+// Login is a sign in in progress. The caller keeps it, looked up by State,
+// between sending the user to AuthCodeURL and calling Exchange.
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func random() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// NewLogin starts a sign in with a random state, nonce and PKCE verifier.
+func NewLogin() (*Login, error) {
+	var login Login
+	var err error
+
+	for _, s := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		*s, err = random()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &login, nil
+}
+
+// AuthCodeURL returns the URL to send the user to for login.
+func (p *Provider) AuthCodeURL(ctx context.Context, login *Login) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {encoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return m.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Claims are the claims of an ID token.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+
+	raw map[string]json.RawMessage
+}
+
+// Strings returns the claim called name as a list, whether the provider gave
+// it as a list or as a single string, such as for a groups claim.
+func (c *Claims) Strings(name string) []string {
+	raw, ok := c.raw[name]
+	if !ok {
+		return nil
+	}
+
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+
+	var single string
+	if json.Unmarshal(raw, &single) == nil && single != "" {
+		return []string{single}
+	}
+
+	return nil
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*a = list
+	return err
+}
+
+// Exchange trades the code the provider sent back for the user's ID token,
+// and returns its claims once they have been checked against login.
+//
+// The ID token's signature is not checked. It comes straight from the token
+// endpoint over a connection this client opened, which OpenID Connect Core
+// 3.1.3.7 allows in place of the signature.
+func (p *Provider) Exchange(ctx context.Context, code string, login *Login) (*Claims, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {login.Verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		return nil, fmt.Errorf("%w: token endpoint returned %s: %s", ErrRejected, res.Status, body)
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("oidc: token endpoint returned %s", res.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token response: %w", err)
+	}
+
+	return p.verify(m, tokens.IDToken, login, time.Now())
+}
+
+func (p *Provider) verify(m *metadata, idToken string, login *Login, now time.Time) (*Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed ID token", ErrRejected)
+	}
+
+	payload, err := encoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed ID token", ErrRejected)
+	}
+
+	var claims Claims
+
+	err = json.Unmarshal(payload, &claims)
+	if err == nil {
+		err = json.Unmarshal(payload, &claims.raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed ID token claims", ErrRejected)
+	}
+
+	switch {
+	case claims.Issuer != m.Issuer:
+		return nil, fmt.Errorf("%w: ID token is from issuer %q", ErrRejected, claims.Issuer)
+	case !claims.Audience.includes(p.config.ClientID):
+		return nil, fmt.Errorf("%w: ID token is not for this client", ErrRejected)
+	case now.Unix() >= claims.ExpiresAt:
+		return nil, fmt.Errorf("%w: ID token has expired", ErrRejected)
+	case claims.Nonce != login.Nonce:
+		return nil, fmt.Errorf("%w: ID token nonce does not match", ErrRejected)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrRejected)
+	}
+
+	return &claims, nil
+}
+
+func (a audience) includes(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,326 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIdP is an identity provider serving discovery and a token endpoint that
+// hands back an ID token with claims. It keeps the last token request.
+type testIdP struct {
+	*httptest.Server
+
+	claims map[string]interface{}
+	status int
+
+	form     url.Values
+	username string
+	password string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{status: http.StatusOK}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.form = r.PostForm
+		idp.username, idp.password, _ = r.BasicAuth()
+
+		if idp.status != http.StatusOK {
+			http.Error(w, `{"error":"invalid_grant"}`, idp.status)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idToken(t, idp.claims),
+		})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+// provider returns a client of the identity provider.
+func (idp *testIdP) provider(secret string) *Provider {
+	return New(Config{
+		Issuer:       idp.URL,
+		ClientID:     "greenlight",
+		ClientSecret: secret,
+		RedirectURL:  "https://app.example.com/callback",
+		Scopes:       []string{"openid", "email"},
+	})
+}
+
+// validClaims returns the claims of an ID token the provider would accept
+// for login.
+func (idp *testIdP) validClaims(login *Login) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            idp.URL,
+		"sub":            "user-1",
+		"aud":            "greenlight",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          login.Nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+// idToken returns an unsigned ID token with claims.
+func idToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoding.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + encoding.EncodeToString(payload) + ".c2ln"
+}
+
+func newTestLogin(t *testing.T) *Login {
+	login, err := NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return login
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := newTestIdP(t)
+	login := newTestLogin(t)
+
+	authURL, err := idp.provider("").AuthCodeURL(context.Background(), login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(authURL, idp.URL+"/authorize?") {
+		t.Fatalf("got %q", authURL)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "greenlight",
+		"scope":                 "openid email",
+		"state":                 login.State,
+		"nonce":                 login.Nonce,
+		"code_challenge":        encoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range want {
+		if got := q.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	if q.Get("code_verifier") != "" {
+		t.Error("code_verifier sent in the authorization URL")
+	}
+}
+
+func TestDiscoverWrongIssuer(t *testing.T) {
+	idp := newTestIdP(t)
+
+	p := New(Config{Issuer: idp.URL + "/", ClientID: "greenlight"})
+
+	_, err := p.AuthCodeURL(context.Background(), newTestLogin(t))
+	if err == nil || !strings.Contains(err.Error(), "discovery is for issuer") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := newTestIdP(t)
+	login := newTestLogin(t)
+	idp.claims = idp.validClaims(login)
+
+	claims, err := idp.provider("s3cret").Exchange(context.Background(), "the-code", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "user-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("got claims %+v", claims)
+	}
+
+	want := map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          "the-code",
+		"redirect_uri":  "https://app.example.com/callback",
+		"client_id":     "greenlight",
+		"code_verifier": login.Verifier,
+	}
+
+	for name, value := range want {
+		if got := idp.form.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	if idp.username != "greenlight" || idp.password != "s3cret" {
+		t.Errorf("basic auth = %q:%q", idp.username, idp.password)
+	}
+}
+
+func TestExchangePublicClient(t *testing.T) {
+	idp := newTestIdP(t)
+	login := newTestLogin(t)
+	idp.claims = idp.validClaims(login)
+
+	_, err := idp.provider("").Exchange(context.Background(), "the-code", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if idp.username != "" || idp.password != "" {
+		t.Errorf("public client sent basic auth %q:%q", idp.username, idp.password)
+	}
+}
+
+func TestExchangeTokenEndpointError(t *testing.T) {
+	tests := []struct {
+		status   int
+		rejected bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, false},
+	}
+
+	for _, tt := range tests {
+		idp := newTestIdP(t)
+		idp.status = tt.status
+
+		_, err := idp.provider("").Exchange(context.Background(), "the-code", newTestLogin(t))
+		if err == nil {
+			t.Fatalf("status %d: no error", tt.status)
+		}
+
+		if errors.Is(err, ErrRejected) != tt.rejected {
+			t.Errorf("status %d: got %v, rejected = %t", tt.status, err, tt.rejected)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider("")
+	m := &metadata{Issuer: idp.URL}
+	login := newTestLogin(t)
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		edit  func(claims map[string]interface{})
+		valid bool
+	}{
+		{"valid", func(map[string]interface{}) {}, true},
+		{"audience list", func(c map[string]interface{}) { c["aud"] = []string{"other", "greenlight"} }, true},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, false},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		{"audience list without client", func(c map[string]interface{}) { c["aud"] = []string{"other"} }, false},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Second).Unix() }, false},
+		{"expires now", func(c map[string]interface{}) { c["exp"] = now.Unix() }, false},
+		{"no expiry", func(c map[string]interface{}) { delete(c, "exp") }, false},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }, false},
+		{"no nonce", func(c map[string]interface{}) { delete(c, "nonce") }, false},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.validClaims(login)
+			tt.edit(claims)
+
+			_, err := p.verify(m, idToken(t, claims), login, now)
+
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("got %v", err)
+			case !tt.valid && !errors.Is(err, ErrRejected):
+				t.Errorf("got %v, want ErrRejected", err)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider("")
+	m := &metadata{Issuer: idp.URL}
+	login := newTestLogin(t)
+
+	for _, token := range []string{"", "a.b", "a.!!!.c", "a." + encoding.EncodeToString([]byte("[1]")) + ".c"} {
+		_, err := p.verify(m, token, login, time.Now())
+		if !errors.Is(err, ErrRejected) {
+			t.Errorf("%q: got %v, want ErrRejected", token, err)
+		}
+	}
+}
+
+func TestClaimsStrings(t *testing.T) {
+	idp := newTestIdP(t)
+	login := newTestLogin(t)
+
+	claims := idp.validClaims(login)
+	claims["groups"] = []string{"admins", "staff"}
+	claims["role"] = "auditor"
+	claims["empty"] = ""
+
+	c, err := idp.provider("").verify(&metadata{Issuer: idp.URL}, idToken(t, claims), login, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"groups", []string{"admins", "staff"}},
+		{"role", []string{"auditor"}},
+		{"empty", nil},
+		{"missing", nil},
+		{"exp", nil},
+	}
+
+	for _, tt := range tests {
+		if got := c.Strings(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Strings(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
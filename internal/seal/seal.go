@@ -0,0 +1,152 @@
+// Package seal encrypts short secrets that must be stored but read back, such
+// as authenticator secrets, with AES-256-GCM. Sealed values carry the ID of
+// the key that sealed them, so that a new sealing key can be brought in while
+// values sealed with the old one can still be opened.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalid is returned for a value that was not sealed by a key of the
+// keyring, or not for the context it is opened with.
+var ErrInvalid = errors.New("seal: invalid sealed value")
+
+// MinSecretLength is the shortest secret a key may have. The AES key is the
+// SHA-256 hash of the secret, so it must be at least as strong.
+const MinSecretLength = 32
+
+var encoding = base64.RawURLEncoding
+
+// Key is a named secret.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring seals values with its first key and opens them with any of its
+// keys.
+type Keyring struct {
+	ids   []string
+	aeads map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring that seals with keys[0].
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("seal: no keys given")
+	}
+
+	k := &Keyring{aeads: map[string]cipher.AEAD{}}
+
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			return nil, fmt.Errorf("seal: key ID %q must not be empty or contain a dot", key.ID)
+		}
+
+		if _, ok := k.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("seal: key %q given more than once", key.ID)
+		}
+
+		if len(key.Secret) < MinSecretLength {
+			return nil, fmt.Errorf("seal: key %q must be at least %d bytes long", key.ID, MinSecretLength)
+		}
+
+		sum := sha256.Sum256(key.Secret)
+
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		k.ids = append(k.ids, key.ID)
+		k.aeads[key.ID] = aead
+	}
+
+	return k, nil
+}
+
+// ParseKeys parses space separated id=secret pairs, the sealing key first.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+
+	for _, field := range strings.Fields(s) {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("seal: key %q is not of the form id=secret", field)
+		}
+
+		keys = append(keys, Key{ID: pair[0], Secret: []byte(pair[1])})
+	}
+
+	return keys, nil
+}
+
+// RandomKey returns a key with a random secret, for when none is configured.
+// Values sealed with it cannot be opened once the process exits.
+func RandomKey() (Key, error) {
+	secret := make([]byte, MinSecretLength)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return Key{}, err
+	}
+
+	return Key{ID: "random", Secret: secret}, nil
+}
+
+// Seal encrypts plaintext for context, which is not stored but must be given
+// again to open it, so that a sealed value copied to another record cannot be
+// opened there.
+func (k *Keyring) Seal(plaintext string, context []byte) (string, error) {
+	id := k.ids[0]
+	aead := k.aeads[id]
+
+	nonce := make([]byte, aead.NonceSize())
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), context)
+
+	return id + "." + encoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed for context by any key of the keyring.
+func (k *Keyring) Open(sealed string, context []byte) (string, error) {
+	parts := strings.SplitN(sealed, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalid
+	}
+
+	aead, ok := k.aeads[parts[0]]
+	if !ok {
+		return "", ErrInvalid
+	}
+
+	b, err := encoding.DecodeString(parts[1])
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", ErrInvalid
+	}
+
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], context)
+	if err != nil {
+		return "", ErrInvalid
+	}
+
+	return string(plaintext), nil
+}
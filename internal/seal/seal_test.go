@@ -0,0 +1,90 @@
+package seal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func keyring(t *testing.T, keys ...Key) *Keyring {
+	t.Helper()
+
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func TestSealOpen(t *testing.T) {
+	old := Key{ID: "old", Secret: []byte(strings.Repeat("o", MinSecretLength))}
+	current := Key{ID: "current", Secret: []byte(strings.Repeat("c", MinSecretLength))}
+
+	before := keyring(t, old)
+	after := keyring(t, current, old)
+
+	sealed, err := before.Seal("JBSWY3DPEHPK3PXP", []byte("user:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("sealed value %q holds the plaintext", sealed)
+	}
+
+	got, err := after.Open(sealed, []byte("user:1"))
+	if err != nil || got != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("opened with a rotated keyring: got %q, %v", got, err)
+	}
+
+	resealed, err := after.Seal("JBSWY3DPEHPK3PXP", []byte("user:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(resealed, "current.") {
+		t.Errorf("sealed with %q, want the first key", resealed)
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		sealed  string
+		context string
+	}{
+		{"other context", after, sealed, "user:2"},
+		{"unknown key", keyring(t, current), sealed, "user:1"},
+		{"tampered", after, sealed[:len(sealed)-2] + "AA", "user:1"},
+		{"no key ID", after, "JBSWY3DPEHPK3PXP", "user:1"},
+		{"short", after, "old.AAAA", "user:1"},
+	}
+
+	for _, tt := range tests {
+		_, err := tt.keyring.Open(tt.sealed, []byte(tt.context))
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: got %v, want ErrInvalid", tt.name, err)
+		}
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	secret := []byte(strings.Repeat("s", MinSecretLength))
+
+	tests := []struct {
+		name string
+		keys []Key
+	}{
+		{"no keys", nil},
+		{"no ID", []Key{{Secret: secret}}},
+		{"dot in ID", []Key{{ID: "a.b", Secret: secret}}},
+		{"short secret", []Key{{ID: "a", Secret: secret[1:]}}},
+		{"duplicate ID", []Key{{ID: "a", Secret: secret}, {ID: "a", Secret: secret}}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewKeyring(tt.keys...); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}
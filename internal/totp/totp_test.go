@@ -0,0 +1,98 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC gives 8 digit codes; a 6 digit code is their last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		want := tt.code[len(tt.code)-Digits:]
+
+		if got := Code(rfcSecret, time.Unix(tt.unix, 0)); got != want {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestCodeLowerCaseSecret(t *testing.T) {
+	at := time.Unix(59, 0)
+
+	if got, want := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", at), Code(rfcSecret, at); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name     string
+		passcode string
+		ok       bool
+		step     int64
+	}{
+		{"current step", Code(rfcSecret, now), true, step},
+		{"with spaces", "050 471", true, step},
+		{"one step behind", Code(rfcSecret, now.Add(-Period*time.Second)), true, step - 1},
+		{"one step ahead", Code(rfcSecret, now.Add(Period*time.Second)), true, step + 1},
+		{"two steps behind", Code(rfcSecret, now.Add(-2*Period*time.Second)), false, 0},
+		{"two steps ahead", Code(rfcSecret, now.Add(2*Period*time.Second)), false, 0},
+		{"wrong code", "000000", false, 0},
+		{"too short", "50471", false, 0},
+		{"too long", "14050471", false, 0},
+		{"empty", "", false, 0},
+	}
+
+	for _, tt := range tests {
+		got, ok := Validate(rfcSecret, tt.passcode, now)
+		if ok != tt.ok || got != tt.step {
+			t.Errorf("%s: got step %d, %t, want %d, %t", tt.name, got, ok, tt.step, tt.ok)
+		}
+	}
+}
+
+func TestValidateInvalidSecret(t *testing.T) {
+	if _, ok := Validate("not base32!", "000000", time.Unix(59, 0)); ok {
+		t.Error("a code matched an invalid secret")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v", secret, len(key), err)
+	}
+
+	other, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other == secret {
+		t.Error("two secrets are the same")
+	}
+}
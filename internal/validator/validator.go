@@ -8,27 +8,82 @@ var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
+// Codes of the validation rules. They are returned to clients alongside the
+// message, so they must not change; the messages themselves come from the
+// i18n catalogue.
+const (
+	Required              = "required"
+	InvalidEmail          = "invalid_email"
+	InvalidURL            = "invalid_url"
+	PrivateAddress        = "private_address"
+	UnknownHost           = "unknown_host"
+	MinLength             = "min_length"
+	MaxLength             = "max_length"
+	ExactLength           = "exact_length"
+	Positive              = "positive"
+	GreaterThan           = "greater_than"
+	MaxValue              = "max_value"
+	NotInFuture           = "not_in_future"
+	NotEmpty              = "not_empty"
+	MaxItems              = "max_items"
+	SingleValue           = "single_value"
+	Duplicate             = "duplicate"
+	OneOf                 = "one_of"
+	Integer               = "integer"
+	Boolean               = "boolean"
+	InvalidFilter         = "invalid_filter"
+	UnknownFilterField    = "unknown_filter_field"
+	UnknownFilterOperator = "unknown_filter_operator"
+	InvalidSort           = "invalid_sort"
+	InvalidCursor         = "invalid_cursor"
+	CursorMismatch        = "cursor_mismatch"
+	UnknownField          = "unknown_field"
+	UnknownInclude        = "unknown_include"
+	UnknownEvent          = "unknown_event"
+	InvalidIDList         = "invalid_id_list"
+	InvalidEventID        = "invalid_event_id"
+	EmailTaken            = "email_taken"
+	EmailNotFound         = "email_not_found"
+	AccountInactive       = "account_inactive"
+	AlreadyActivated      = "already_activated"
+	InvalidToken          = "invalid_token"
+	AlreadyExists         = "already_exists"
+	UnknownPermission     = "unknown_permission"
+	Exclusive             = "exclusive"
+	OutOfScope            = "out_of_scope"
+	InvalidIP             = "invalid_ip"
+	AlreadyEnabled        = "already_enabled"
+	PermissionNotHeld     = "permission_not_held"
+)
+
+// Error is a rule that a field failed, with the parameters its message needs,
+// such as the minimum length.
+type Error struct {
+	Code   string
+	Params []interface{}
+}
+
 type Validator struct {
-	Errors map[string]string
+	Errors map[string]Error
 }
 
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{Errors: make(map[string]Error)}
 }
 
 func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
-func (v *Validator) AddError(key, message string) {
+func (v *Validator) AddError(key, code string, params ...interface{}) {
 	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
+		v.Errors[key] = Error{Code: code, Params: params}
 	}
 }
 
-func (v *Validator) Check(ok bool, key, message string) {
+func (v *Validator) Check(ok bool, key, code string, params ...interface{}) {
 	if !ok {
-		v.AddError(key, message)
+		v.AddError(key, code, params...)
 	}
 }
 
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code IN ('audit:read');
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    resource text NOT NULL,
+    resource_id text NOT NULL,
+    changes jsonb NOT NULL,
+    request_id text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_resource_idx ON audit_log (resource, resource_id);
+
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('audit:read')) AS p (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
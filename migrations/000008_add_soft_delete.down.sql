@@ -0,0 +1,14 @@
+DELETE FROM permissions WHERE code IN ('trash:read', 'warehouse:write', 'rak:write', 'stok:write');
+
+DROP INDEX IF EXISTS stok_deleted_at_idx;
+DROP INDEX IF EXISTS rak_deleted_at_idx;
+DROP INDEX IF EXISTS warehouse_deleted_at_idx;
+
+ALTER TABLE stok DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE stok DROP COLUMN IF EXISTS deleted_at;
+
+ALTER TABLE rak DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE rak DROP COLUMN IF EXISTS deleted_at;
+
+ALTER TABLE warehouse DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE warehouse DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,16 @@
+ALTER TABLE warehouse ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE warehouse ADD COLUMN IF NOT EXISTS deleted_by bigint REFERENCES users ON DELETE SET NULL;
+
+ALTER TABLE rak ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE rak ADD COLUMN IF NOT EXISTS deleted_by bigint REFERENCES users ON DELETE SET NULL;
+
+ALTER TABLE stok ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE stok ADD COLUMN IF NOT EXISTS deleted_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS warehouse_deleted_at_idx ON warehouse (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS rak_deleted_at_idx ON rak (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS stok_deleted_at_idx ON stok (deleted_at) WHERE deleted_at IS NOT NULL;
+
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('trash:read'), ('warehouse:write'), ('rak:write'), ('stok:write')) AS p (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code IN ('brand:read', 'brand:write', 'warehouse:read', 'rak:read', 'stok:read');
+DROP TABLE IF EXISTS revisions;
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS revisions (
+    resource text NOT NULL,
+    resource_id text NOT NULL,
+    version integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    data jsonb NOT NULL,
+    PRIMARY KEY (resource, resource_id, version)
+);
+
+-- Seed the current state of existing records as their first known revision.
+INSERT INTO revisions (resource, resource_id, version, data)
+SELECT 'brand', t.id::text, t.version, to_jsonb(t) FROM brand t
+ON CONFLICT DO NOTHING;
+
+INSERT INTO revisions (resource, resource_id, version, data)
+SELECT 'rak', t.rak_id::text, t.version, to_jsonb(t) FROM rak t
+ON CONFLICT DO NOTHING;
+
+INSERT INTO revisions (resource, resource_id, version, data)
+SELECT 'warehouse', t.warehouse_id::text, t.version, to_jsonb(t) FROM warehouse t
+ON CONFLICT DO NOTHING;
+
+INSERT INTO revisions (resource, resource_id, version, data)
+SELECT 'stok', t.id::text, t.version, to_jsonb(t) || jsonb_build_object('details',
+    (SELECT coalesce(jsonb_agg(to_jsonb(d) - 'id' - 'stok_id' ORDER BY d.warehouse_id, d.rak_id), '[]')
+    FROM stok_detail d WHERE d.stok_id = t.id))
+FROM stok t
+ON CONFLICT DO NOTHING;
+
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('brand:read'), ('brand:write'), ('warehouse:read'), ('rak:read'), ('stok:read')) AS p (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
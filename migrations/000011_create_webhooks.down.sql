@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code IN ('webhooks:read', 'webhooks:write');
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
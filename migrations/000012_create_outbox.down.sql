@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS webhook_deliveries_outbox_idx;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS outbox_id;
+
+DROP TABLE IF EXISTS outbox_cursors;
+DROP TABLE IF EXISTS outbox;
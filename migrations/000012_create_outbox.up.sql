@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    txid bigint NOT NULL DEFAULT txid_current(),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event text NOT NULL,
+    action text NOT NULL,
+    resource text NOT NULL,
+    resource_id text NOT NULL,
+    user_id bigint,
+    request_id text NOT NULL DEFAULT '',
+    data jsonb,
+    changes jsonb NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS outbox_txid_id_idx ON outbox (txid, id);
+CREATE INDEX IF NOT EXISTS outbox_created_at_idx ON outbox (created_at);
+
+CREATE TABLE IF NOT EXISTS outbox_cursors (
+    subscriber text PRIMARY KEY,
+    txid bigint NOT NULL,
+    last_id bigint NOT NULL,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS outbox_id bigint;
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_outbox_idx ON webhook_deliveries (webhook_id, outbox_id);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    kind text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL,
+    run_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone,
+    last_error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS jobs_due_idx ON jobs (kind, run_at) WHERE status <> 'dead';
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status);
+
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('jobs:read'), ('jobs:write')) AS p (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
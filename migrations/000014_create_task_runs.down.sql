@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code IN ('tasks:read', 'tasks:write');
+DROP TABLE IF EXISTS stock_snapshots;
+DROP TABLE IF EXISTS task_runs;
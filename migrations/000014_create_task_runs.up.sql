@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS task_runs (
+    id bigserial PRIMARY KEY,
+    task text NOT NULL,
+    trigger text NOT NULL,
+    scheduled_at timestamp(0) with time zone NOT NULL,
+    started_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    finished_at timestamp(0) with time zone,
+    status text NOT NULL DEFAULT 'running',
+    error text NOT NULL DEFAULT '',
+    user_id bigint REFERENCES users ON DELETE SET NULL
+);
+
+-- A scheduled slot runs once however many API instances reach it.
+CREATE UNIQUE INDEX IF NOT EXISTS task_runs_slot_idx ON task_runs (task, scheduled_at) WHERE trigger = 'schedule';
+CREATE INDEX IF NOT EXISTS task_runs_task_idx ON task_runs (task, started_at);
+
+CREATE TABLE IF NOT EXISTS stock_snapshots (
+    snapshot_date date NOT NULL,
+    stok_id text NOT NULL,
+    warehouse_id bigint NOT NULL,
+    rak_id bigint NOT NULL,
+    qty numeric NOT NULL,
+    PRIMARY KEY (snapshot_date, stok_id, warehouse_id, rak_id)
+);
+
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('tasks:read'), ('tasks:write')) AS p (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code IN ('emails:read', 'emails:write');
+DROP TABLE IF EXISTS emails;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+
+DELETE FROM permissions WHERE code IN ('perusahaan:read', 'perusahaan:write', 'brandasset:read', 'brandasset:write', 'roles:read', 'roles:write');
+DROP INDEX IF EXISTS permissions_code_idx;
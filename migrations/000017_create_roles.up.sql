@@ -0,0 +1,55 @@
+CREATE UNIQUE INDEX IF NOT EXISTS permissions_code_idx ON permissions (code);
+
+INSERT INTO permissions (code)
+SELECT r.resource || ':' || a.action
+FROM (VALUES ('movies'), ('perusahaan'), ('warehouse'), ('rak'), ('brand'), ('brandasset'), ('stok'),
+             ('webhooks'), ('jobs'), ('tasks'), ('emails'), ('roles')) AS r (resource)
+CROSS JOIN (VALUES ('read'), ('write')) AS a (action)
+UNION ALL
+SELECT code FROM (VALUES ('audit:read'), ('trash:read')) AS p (code)
+ON CONFLICT (code) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_roles_role_idx ON users_roles (role_id);
+
+INSERT INTO roles (name, description)
+VALUES
+    ('admin', 'Full access, including users, roles and system settings'),
+    ('warehouse_staff', 'Manages warehouses, racks, brands and stock'),
+    ('sales', 'Reads inventory and manages companies'),
+    ('viewer', 'Reads inventory')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON
+    roles.name = 'admin'
+    OR (roles.name = 'warehouse_staff' AND permissions.code IN (
+        'perusahaan:read', 'warehouse:read', 'warehouse:write', 'rak:read', 'rak:write',
+        'brand:read', 'brand:write', 'brandasset:read', 'brandasset:write', 'stok:read', 'stok:write'))
+    OR (roles.name = 'sales' AND permissions.code IN (
+        'perusahaan:read', 'perusahaan:write', 'warehouse:read', 'rak:read',
+        'brand:read', 'brandasset:read', 'stok:read'))
+    OR (roles.name = 'viewer' AND permissions.code IN (
+        'perusahaan:read', 'warehouse:read', 'rak:read', 'brand:read', 'brandasset:read', 'stok:read'))
+ON CONFLICT DO NOTHING;
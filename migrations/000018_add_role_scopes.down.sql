@@ -0,0 +1,6 @@
+DELETE FROM users_roles WHERE warehouse_id IS NOT NULL OR perusahaan_id IS NOT NULL;
+
+DROP INDEX IF EXISTS users_roles_grant_idx;
+ALTER TABLE users_roles DROP COLUMN IF EXISTS perusahaan_id;
+ALTER TABLE users_roles DROP COLUMN IF EXISTS warehouse_id;
+ALTER TABLE users_roles ADD PRIMARY KEY (user_id, role_id);
@@ -0,0 +1,7 @@
+ALTER TABLE users_roles ADD COLUMN IF NOT EXISTS warehouse_id bigint REFERENCES warehouse (warehouse_id) ON DELETE CASCADE;
+ALTER TABLE users_roles ADD COLUMN IF NOT EXISTS perusahaan_id bigint REFERENCES perusahaan (id) ON DELETE CASCADE;
+ALTER TABLE users_roles ADD CONSTRAINT users_roles_scope_check CHECK (warehouse_id IS NULL OR perusahaan_id IS NULL);
+
+ALTER TABLE users_roles DROP CONSTRAINT IF EXISTS users_roles_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS users_roles_grant_idx
+    ON users_roles (user_id, role_id, coalesce(warehouse_id, 0), coalesce(perusahaan_id, 0));
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS api_keys_permissions;
+DROP TABLE IF EXISTS api_keys;
+
+DELETE FROM permissions WHERE code IN ('api_keys:read', 'api_keys:write');
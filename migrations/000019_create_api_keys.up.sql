@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    prefix text NOT NULL,
+    hash bytea NOT NULL UNIQUE,
+    previous_hash bytea,
+    previous_expiry timestamp(0) with time zone,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    allowed_ips text[] NOT NULL DEFAULT '{}',
+    warehouse_id bigint REFERENCES warehouse (warehouse_id) ON DELETE CASCADE,
+    perusahaan_id bigint REFERENCES perusahaan (id) ON DELETE CASCADE,
+    last_used_at timestamp(0) with time zone,
+    last_used_ip text,
+    rotated_at timestamp(0) with time zone,
+    revoked_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1,
+    CHECK (warehouse_id IS NULL OR perusahaan_id IS NULL)
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_previous_hash_idx ON api_keys (previous_hash) WHERE previous_hash IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS api_keys_permissions (
+    api_key_id bigint NOT NULL REFERENCES api_keys ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (api_key_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES ('api_keys:read'), ('api_keys:write')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON permissions.code IN ('api_keys:read', 'api_keys:write')
+WHERE roles.name = 'admin'
+ON CONFLICT DO NOTHING;
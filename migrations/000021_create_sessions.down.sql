@@ -0,0 +1,2 @@
+ALTER TABLE tokens DROP CONSTRAINT IF EXISTS tokens_family_fkey;
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS users_totp;
+
+DELETE FROM tokens WHERE scope = 'two-factor';
+ALTER TABLE tokens DROP COLUMN IF EXISTS attempts;
+
+ALTER TABLE roles DROP COLUMN IF EXISTS require_two_factor;
@@ -0,0 +1,7 @@
+DELETE FROM permissions WHERE code IN ('lockouts:read', 'lockouts:write');
+
+DROP TABLE IF EXISTS login_ip_failures;
+
+ALTER TABLE users DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE users DROP COLUMN IF EXISTS last_failed_login_at;
+ALTER TABLE users DROP COLUMN IF EXISTS failed_logins;
@@ -0,0 +1,21 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_failed_login_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until timestamp(0) with time zone;
+
+CREATE TABLE IF NOT EXISTS login_ip_failures (
+    ip text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone
+);
+
+INSERT INTO permissions (code)
+VALUES ('lockouts:read'), ('lockouts:write')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON permissions.code IN ('lockouts:read', 'lockouts:write')
+WHERE roles.name = 'admin'
+ON CONFLICT DO NOTHING;